@@ -0,0 +1,57 @@
+// Command backfillimages adds the image files on disk that aren't in the
+// database yet, like the ones uploaded before images were kept there. It
+// reads the database settings from .env like the server, and is safe to
+// run more than once.
+//
+//	go run ./cmd/backfillimages [-dir images]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/joho/godotenv"
+	"github.com/joncalhoun/lenslocked/migrations"
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+func main() {
+	dir := flag.String("dir", "images", "directory the gallery images are stored in")
+	flag.Parse()
+
+	err := godotenv.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading .env: %v\n", err)
+		os.Exit(1)
+	}
+	db, err := models.Open(models.PostgresConfig{
+		Host:     os.Getenv("PSQL_HOST"),
+		Port:     os.Getenv("PSQL_PORT"),
+		User:     os.Getenv("PSQL_USER"),
+		Password: os.Getenv("PSQL_PASSWORD"),
+		Database: os.Getenv("PSQL_DATABASE"),
+		SSLMode:  os.Getenv("PSQL_SSLMODE"),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	err = models.MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error migrating database: %v\n", err)
+		os.Exit(1)
+	}
+
+	galleryService := &models.GalleryService{
+		DB:        db,
+		ImagesDir: *dir,
+	}
+	added, err := galleryService.IndexImages()
+	fmt.Printf("Added %d images\n", added)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error indexing images: %v\n", err)
+		os.Exit(1)
+	}
+}
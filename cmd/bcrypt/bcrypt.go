@@ -1,38 +1,167 @@
+// Command bcrypt hashes and verifies passwords the way the server does,
+// and benchmarks hasher parameters to help pick them for our hardware. It
+// keeps its name from when bcrypt was the only algorithm, and still accepts
+// compare as another name for verify.
+//
+//	bcrypt hash [-algo argon2id|bcrypt] [parameter flags] <password>
+//	bcrypt verify <password> <hash>
+//	bcrypt benchmark [-target 250ms]
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/joncalhoun/lenslocked/models"
 	"golang.org/x/crypto/bcrypt"
 )
 
 func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
 	switch os.Args[1] {
 	case "hash":
-		hash(os.Args[2])
-	case "compare":
-		compare(os.Args[2], os.Args[3])
+		hash(os.Args[2:])
+	case "verify", "compare":
+		verify(os.Args[2:])
+	case "benchmark":
+		benchmark(os.Args[2:])
 	default:
 		fmt.Printf("Unknown command: %q\n", os.Args[1])
+		usage()
 	}
 }
 
-func hash(password string) {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func usage() {
+	fmt.Println("Usage:")
+	fmt.Println("  bcrypt hash [-algo argon2id|bcrypt] [parameter flags] <password>")
+	fmt.Println("  bcrypt verify <password> <hash>")
+	fmt.Println("  bcrypt benchmark [-target 250ms]")
+	os.Exit(2)
+}
+
+func hash(args []string) {
+	flags := flag.NewFlagSet("hash", flag.ExitOnError)
+	algo := flags.String("algo", "argon2id", "hash algorithm: argon2id or bcrypt")
+	cost := flags.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	memory := flags.Uint("m", models.DefaultArgon2Memory, "argon2id memory in KiB")
+	iterations := flags.Uint("t", models.DefaultArgon2Iterations, "argon2id iterations")
+	parallelism := flags.Uint("p", models.DefaultArgon2Parallelism, "argon2id parallelism")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	var hasher models.PasswordHasher
+	switch *algo {
+	case "argon2id":
+		hasher = models.Argon2idHasher{
+			Memory:      uint32(*memory),
+			Iterations:  uint32(*iterations),
+			Parallelism: uint8(*parallelism),
+		}
+	case "bcrypt":
+		hasher = models.BcryptHasher{Cost: *cost}
+	default:
+		fmt.Printf("Unknown algorithm: %q\n", *algo)
+		os.Exit(2)
+	}
+	start := time.Now()
+	hash, err := hasher.Hash(flags.Arg(0))
 	if err != nil {
 		fmt.Printf("Error hashing: %v\n", err)
-		return
+		os.Exit(1)
 	}
-	hash := string(hashedBytes)
 	fmt.Println(hash)
+	fmt.Fprintf(os.Stderr, "Took %v\n", time.Since(start).Round(time.Millisecond))
 }
 
-func compare(password, hash string) {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+func verify(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+	match, err := models.VerifyPassword(args[0], args[1])
 	if err != nil {
-		fmt.Printf("Invalid password error: %v\n", err)
-		return
+		fmt.Printf("Error verifying: %v\n", err)
+		os.Exit(1)
+	}
+	if !match {
+		fmt.Println("Invalid password")
+		os.Exit(1)
 	}
 	fmt.Println("Password correct!")
 }
+
+// Time a range of parameters for each algorithm and suggest the strongest
+// that hashes within the target. Run it on the same kind of machine the
+// server runs on, while it isn't busy.
+func benchmark(args []string) {
+	flags := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	target := flags.Duration("target", 250*time.Millisecond, "longest acceptable time to hash a password")
+	flags.Parse(args)
+
+	const password = "correct horse battery staple"
+
+	fmt.Println("bcrypt")
+	bestCost := 0
+	for cost := 10; cost <= 14; cost++ {
+		took := timeHash(models.BcryptHasher{Cost: cost}, password)
+		fmt.Printf("  cost=%-2d  %v\n", cost, took)
+		if took <= *target {
+			bestCost = cost
+		}
+	}
+
+	fmt.Println("argon2id")
+	var best *models.Argon2idHasher
+	for _, memory := range []uint32{19 * 1024, 32 * 1024, 64 * 1024, 128 * 1024, 256 * 1024} {
+		for _, iterations := range []uint32{1, 2, 3, 4} {
+			hasher := models.Argon2idHasher{
+				Memory:      memory,
+				Iterations:  iterations,
+				Parallelism: models.DefaultArgon2Parallelism,
+			}
+			took := timeHash(hasher, password)
+			fmt.Printf("  m=%-6d t=%d p=%d  %v\n", memory, iterations, hasher.Parallelism, took)
+			// More memory beats more iterations against GPU cracking, so
+			// prefer it when both fit in the target.
+			if took <= *target {
+				best = &hasher
+			}
+		}
+	}
+
+	fmt.Printf("\nWithin %v:\n", *target)
+	if bestCost == 0 {
+		fmt.Println("  bcrypt: no cost tried was fast enough")
+	} else {
+		fmt.Printf("  bcrypt: BCRYPT_COST=%d\n", bestCost)
+	}
+	if best == nil {
+		fmt.Println("  argon2id: no parameters tried were fast enough")
+	} else {
+		fmt.Printf("  argon2id: ARGON2_MEMORY=%d ARGON2_ITERATIONS=%d ARGON2_PARALLELISM=%d\n",
+			best.Memory, best.Iterations, best.Parallelism)
+	}
+}
+
+// The fastest of a few runs, to smooth out noise
+func timeHash(hasher models.PasswordHasher, password string) time.Duration {
+	var fastest time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		_, err := hasher.Hash(password)
+		if err != nil {
+			fmt.Printf("Error hashing: %v\n", err)
+			os.Exit(1)
+		}
+		took := time.Since(start)
+		if fastest == 0 || took < fastest {
+			fastest = took
+		}
+	}
+	return fastest.Round(time.Millisecond)
+}
@@ -0,0 +1,66 @@
+// Command breachedpw builds a breached password list for the password
+// policy from a list of passwords on stdin, one per line, and writes it to
+// stdout.
+//
+//	go run ./cmd/breachedpw < passwords.txt > breached.bin
+//
+// With -sha1, each line is instead a hex SHA-1 hash optionally followed by
+// ":count", which is the format of the Have I Been Pwned downloads.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+func main() {
+	sha1Input := flag.Bool("sha1", false, "input lines are hex SHA-1 hashes instead of passwords")
+	flag.Parse()
+
+	var keys []uint64
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if !*sha1Input {
+			keys = append(keys, models.BreachedPasswordKey(line))
+			continue
+		}
+		hash, _, _ := strings.Cut(line, ":")
+		sum, err := hex.DecodeString(hash)
+		if err != nil || len(sum) < models.BreachedRecordSize {
+			fmt.Fprintf(os.Stderr, "Invalid SHA-1 hash: %q\n", hash)
+			os.Exit(1)
+		}
+		keys = append(keys, binary.BigEndian.Uint64(sum[:models.BreachedRecordSize]))
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		os.Exit(1)
+	}
+
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	w := bufio.NewWriter(os.Stdout)
+	record := make([]byte, models.BreachedRecordSize)
+	for _, key := range keys {
+		binary.BigEndian.PutUint64(record, key)
+		w.Write(record)
+	}
+	err := w.Flush()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		os.Exit(1)
+	}
+}
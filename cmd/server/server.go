@@ -1,23 +1,40 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gorilla/csrf"
 	"github.com/joho/godotenv"
 	"github.com/joncalhoun/lenslocked/controllers"
 	"github.com/joncalhoun/lenslocked/migrations"
 	"github.com/joncalhoun/lenslocked/models"
-	"golang.org/x/oauth2"
+	"github.com/joncalhoun/lenslocked/passwords"
 
 	"github.com/joncalhoun/lenslocked/templates"
 	"github.com/joncalhoun/lenslocked/views"
 )
 
+type oauthClient struct {
+	ClientID     string
+	ClientSecret string
+}
+
+type importClient struct {
+	oauthClient
+	// Scopes replace the provider's default scopes when set
+	Scopes []string
+}
+
 type config struct {
 	PSQL models.PostgresConfig
 	SMTP models.SMTPConfig
@@ -27,8 +44,84 @@ type config struct {
 	}
 	Server struct {
 		Address string
+		// BaseURL is the site's public URL, used for links in emails and
+		// OAuth redirects. It is required, so links never point where the
+		// Host header says.
+		BaseURL string
+		// TrustProxy takes the client's address, scheme and host from the
+		// X-Forwarded-* headers. Only enable it behind a proxy that sets them.
+		TrustProxy bool
+	}
+	// Session timeouts. The defaults are used for any that are 0.
+	Session struct {
+		IdleTimeout             time.Duration
+		AbsoluteTimeout         time.Duration
+		RememberIdleTimeout     time.Duration
+		RememberAbsoluteTimeout time.Duration
+	}
+	// RateLimitStore is either "memory" (the default) or "postgres", which
+	// is needed when running more than one server.
+	RateLimitStore string
+	WebAuthn       webauthn.Config
+	// Import holds the services users can import photos from. Each one is
+	// only enabled when its client ID is set.
+	Import struct {
+		Dropbox     importClient
+		GoogleDrive importClient
+		OneDrive    importClient
+	}
+	// OAuthTokenKey encrypts the stored tokens of connected services
+	OAuthTokenKey []byte
+	// GalleryUnlockKey signs the cookies of visitors who have entered a
+	// gallery's password
+	GalleryUnlockKey []byte
+	// Storage is where image files are kept
+	Storage struct {
+		// Backend is either "local" (the default), which keeps them in
+		// ImagesDir, or "s3"
+		Backend   string
+		ImagesDir string
+		S3        models.S3Storage
+		// Redirect sends browsers to presigned S3 URLs for images instead
+		// of streaming them through the server
+		Redirect bool
+	}
+	// ImageSizes are the widths, in pixels, smaller variants of images are
+	// made in. The defaults are used when it is empty.
+	ImageSizes []int
+	// MaxImageSize is the largest image file, in bytes, that can be
+	// uploaded or imported. The default is used when it is 0.
+	MaxImageSize int64
+	// ImageTransform signs the URLs of transformed images, which can be
+	// at most MaxSize pixels wide or high
+	ImageTransform struct {
+		Key     []byte
+		MaxSize int
+	}
+	// SignIn holds the identity providers users can sign in with. Each one
+	// is only enabled when its client ID is set.
+	SignIn struct {
+		Google oauthClient
+		GitHub oauthClient
+		// OIDC is any other OpenID Connect provider
+		OIDC struct {
+			oauthClient
+			Issuer      string
+			DisplayName string
+		}
+	}
+	Password struct {
+		MinLength int
+		MaxLength int
+		// BreachedFile is a breached password list built with
+		// cmd/breachedpw. The bundled list is used when it is empty.
+		BreachedFile string
+		// Hasher is either "argon2id" (the default) or "bcrypt". Existing
+		// hashes are upgraded to it as users sign in.
+		Hasher   string
+		Bcrypt   models.BcryptHasher
+		Argon2id models.Argon2idHasher
 	}
-	OAuthProviders map[string]*oauth2.Config
 }
 
 func loadEnvConfig() (config, error) {
@@ -62,18 +155,166 @@ func loadEnvConfig() (config, error) {
 	cfg.CSRF.Secure = os.Getenv("CSRF_SECURE") == "true"
 
 	cfg.Server.Address = os.Getenv("SERVER_ADDRESS")
+	cfg.Server.BaseURL = os.Getenv("SERVER_BASE_URL")
+	baseURL, err := url.Parse(cfg.Server.BaseURL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		return cfg, fmt.Errorf("SERVER_BASE_URL must be the site's URL, like https://www.lenslocked.com")
+	}
+	cfg.Server.TrustProxy = os.Getenv("TRUST_PROXY") == "true"
+
+	for _, timeout := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"SESSION_IDLE_TIMEOUT", &cfg.Session.IdleTimeout},
+		{"SESSION_ABSOLUTE_TIMEOUT", &cfg.Session.AbsoluteTimeout},
+		{"SESSION_REMEMBER_IDLE_TIMEOUT", &cfg.Session.RememberIdleTimeout},
+		{"SESSION_REMEMBER_ABSOLUTE_TIMEOUT", &cfg.Session.RememberAbsoluteTimeout},
+	} {
+		value := os.Getenv(timeout.name)
+		if value == "" {
+			continue
+		}
+		*timeout.dst, err = time.ParseDuration(value)
+		if err != nil || *timeout.dst <= 0 {
+			return cfg, fmt.Errorf("%s must be a positive duration, like 2h", timeout.name)
+		}
+	}
 
-	cfg.OAuthProviders = make(map[string]*oauth2.Config)
-	dbxConfig := &oauth2.Config{
-		ClientID:     os.Getenv("DROPBOX_APP_ID"),
-		ClientSecret: os.Getenv("DROPBOX_APP_SECRET"),
-		Scopes:       []string{"files.metadata.read", "files.content.read"},
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://www.dropbox.com/oauth2/authorize",
-			TokenURL: "https://api.dropboxapi.com/oauth2/token",
-		},
+	cfg.RateLimitStore = os.Getenv("RATE_LIMIT_STORE")
+
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		cfg.Password.MinLength, err = strconv.Atoi(minLength)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if maxLength := os.Getenv("PASSWORD_MAX_LENGTH"); maxLength != "" {
+		cfg.Password.MaxLength, err = strconv.Atoi(maxLength)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	cfg.Password.BreachedFile = os.Getenv("BREACHED_PASSWORDS_FILE")
+
+	cfg.Password.Hasher = os.Getenv("PASSWORD_HASHER")
+	if cost := os.Getenv("BCRYPT_COST"); cost != "" {
+		cfg.Password.Bcrypt.Cost, err = strconv.Atoi(cost)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if memory := os.Getenv("ARGON2_MEMORY"); memory != "" {
+		m, err := strconv.ParseUint(memory, 10, 32)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Password.Argon2id.Memory = uint32(m)
+	}
+	if iterations := os.Getenv("ARGON2_ITERATIONS"); iterations != "" {
+		t, err := strconv.ParseUint(iterations, 10, 32)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Password.Argon2id.Iterations = uint32(t)
+	}
+	if parallelism := os.Getenv("ARGON2_PARALLELISM"); parallelism != "" {
+		p, err := strconv.ParseUint(parallelism, 10, 8)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Password.Argon2id.Parallelism = uint8(p)
+	}
+
+	// Passkeys belong to the site's public URL unless configured otherwise,
+	// e.g. to share them with other subdomains.
+	rpID := os.Getenv("WEBAUTHN_RPID")
+	if rpID == "" {
+		rpID = baseURL.Hostname()
+	}
+	origin := os.Getenv("WEBAUTHN_ORIGIN")
+	if origin == "" {
+		// An origin is only the scheme and host, even if the site lives
+		// under a path
+		origin = (&url.URL{Scheme: baseURL.Scheme, Host: baseURL.Host}).String()
+	}
+	if origin == "" {
+		return cfg, fmt.Errorf("WEBAUTHN_ORIGIN must be the site's origin, like https://www.lenslocked.com")
+	}
+	cfg.WebAuthn = webauthn.Config{
+		RPDisplayName: "Lenslocked",
+		RPID:          rpID,
+		RPOrigins:     []string{origin},
+	}
+
+	cfg.Import.Dropbox.ClientID = os.Getenv("DROPBOX_APP_ID")
+	cfg.Import.Dropbox.ClientSecret = os.Getenv("DROPBOX_APP_SECRET")
+	cfg.Import.Dropbox.Scopes = strings.Fields(os.Getenv("DROPBOX_SCOPES"))
+	cfg.Import.GoogleDrive.ClientID = os.Getenv("GOOGLE_DRIVE_CLIENT_ID")
+	cfg.Import.GoogleDrive.ClientSecret = os.Getenv("GOOGLE_DRIVE_CLIENT_SECRET")
+	cfg.Import.GoogleDrive.Scopes = strings.Fields(os.Getenv("GOOGLE_DRIVE_SCOPES"))
+	cfg.Import.OneDrive.ClientID = os.Getenv("ONEDRIVE_CLIENT_ID")
+	cfg.Import.OneDrive.ClientSecret = os.Getenv("ONEDRIVE_CLIENT_SECRET")
+	cfg.Import.OneDrive.Scopes = strings.Fields(os.Getenv("ONEDRIVE_SCOPES"))
+	cfg.OAuthTokenKey, err = base64.StdEncoding.DecodeString(os.Getenv("OAUTH_TOKEN_KEY"))
+	if err != nil {
+		return cfg, fmt.Errorf("OAUTH_TOKEN_KEY: %w", err)
+	}
+	cfg.GalleryUnlockKey, err = base64.StdEncoding.DecodeString(os.Getenv("GALLERY_UNLOCK_KEY"))
+	if err != nil {
+		return cfg, fmt.Errorf("GALLERY_UNLOCK_KEY: %w", err)
+	}
+
+	cfg.Storage.Backend = os.Getenv("STORAGE")
+	cfg.Storage.ImagesDir = os.Getenv("IMAGES_DIR")
+	if cfg.Storage.ImagesDir == "" {
+		cfg.Storage.ImagesDir = "images"
+	}
+	cfg.Storage.S3 = models.S3Storage{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PathStyle:       os.Getenv("S3_PATH_STYLE") == "true",
+	}
+	cfg.Storage.Redirect = os.Getenv("STORAGE_REDIRECT") == "true"
+	for _, size := range strings.Fields(os.Getenv("IMAGE_SIZES")) {
+		width, err := strconv.Atoi(size)
+		if err != nil || width < 1 {
+			return cfg, fmt.Errorf("IMAGE_SIZES: invalid width %q", size)
+		}
+		cfg.ImageSizes = append(cfg.ImageSizes, width)
+	}
+	if maxSize := os.Getenv("MAX_IMAGE_SIZE_MB"); maxSize != "" {
+		megabytes, err := strconv.Atoi(maxSize)
+		if err != nil || megabytes < 1 {
+			return cfg, fmt.Errorf("MAX_IMAGE_SIZE_MB: invalid size %q", maxSize)
+		}
+		cfg.MaxImageSize = int64(megabytes) << 20
+	}
+	cfg.ImageTransform.Key, err = base64.StdEncoding.DecodeString(os.Getenv("IMAGE_TRANSFORM_KEY"))
+	if err != nil {
+		return cfg, fmt.Errorf("IMAGE_TRANSFORM_KEY: %w", err)
+	}
+	if maxSize := os.Getenv("IMAGE_TRANSFORM_MAX_SIZE"); maxSize != "" {
+		cfg.ImageTransform.MaxSize, err = strconv.Atoi(maxSize)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	cfg.SignIn.Google.ClientID = os.Getenv("GOOGLE_CLIENT_ID")
+	cfg.SignIn.Google.ClientSecret = os.Getenv("GOOGLE_CLIENT_SECRET")
+	cfg.SignIn.GitHub.ClientID = os.Getenv("GITHUB_CLIENT_ID")
+	cfg.SignIn.GitHub.ClientSecret = os.Getenv("GITHUB_CLIENT_SECRET")
+	cfg.SignIn.OIDC.Issuer = os.Getenv("OIDC_ISSUER")
+	cfg.SignIn.OIDC.ClientID = os.Getenv("OIDC_CLIENT_ID")
+	cfg.SignIn.OIDC.ClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	cfg.SignIn.OIDC.DisplayName = os.Getenv("OIDC_DISPLAY_NAME")
+	if cfg.SignIn.OIDC.DisplayName == "" {
+		cfg.SignIn.OIDC.DisplayName = "Single sign-on"
 	}
-	cfg.OAuthProviders["dropbox"] = dbxConfig
 
 	return cfg, nil
 }
@@ -96,12 +337,41 @@ func main() {
 	}
 
 	// Set services
+	var breached *models.BreachedPasswords
+	if cfg.Password.BreachedFile != "" {
+		breached, err = models.OpenBreachedPasswords(cfg.Password.BreachedFile)
+	} else {
+		breached, err = models.OpenBreachedPasswordsFS(passwords.FS, "common.bin")
+	}
+	if err != nil {
+		panic(err)
+	}
+	var hasher models.PasswordHasher
+	switch cfg.Password.Hasher {
+	case "bcrypt":
+		hasher = cfg.Password.Bcrypt
+	case "argon2id", "":
+		hasher = cfg.Password.Argon2id
+	default:
+		panic(fmt.Sprintf("unknown password hasher %q", cfg.Password.Hasher))
+	}
 	userService := &models.UserService{
 		DB: db,
+		PasswordPolicy: &models.PasswordPolicy{
+			MinLength: cfg.Password.MinLength,
+			MaxLength: cfg.Password.MaxLength,
+			Breached:  breached,
+		},
+		Hasher: hasher,
 	}
 	sessionService := &models.SessionService{
-		DB: db,
+		DB:                      db,
+		IdleTimeout:             cfg.Session.IdleTimeout,
+		AbsoluteTimeout:         cfg.Session.AbsoluteTimeout,
+		RememberIdleTimeout:     cfg.Session.RememberIdleTimeout,
+		RememberAbsoluteTimeout: cfg.Session.RememberAbsoluteTimeout,
 	}
+	go sessionService.Sweep(context.Background(), time.Hour)
 	pwResetService := &models.PasswordResetService{
 		DB: db,
 	}
@@ -111,9 +381,122 @@ func main() {
 	emailResetService := &models.EmailResetService{
 		DB: db,
 	}
+	galleryShareService := &models.GalleryShareService{
+		DB: db,
+	}
+	galleryMemberService := &models.GalleryMemberService{
+		DB: db,
+	}
+	var storage models.BlobStorage
+	switch cfg.Storage.Backend {
+	case "", "local":
+		storage = &models.LocalStorage{Dir: cfg.Storage.ImagesDir}
+	case "s3":
+		storage = &cfg.Storage.S3
+	default:
+		panic(fmt.Sprintf("unknown storage %q", cfg.Storage.Backend))
+	}
 	galleryService := &models.GalleryService{
+		DB:               db,
+		Storage:          storage,
+		ImageSizes:       cfg.ImageSizes,
+		MaxImageSize:     cfg.MaxImageSize,
+		TransformKey:     cfg.ImageTransform.Key,
+		MaxTransformSize: cfg.ImageTransform.MaxSize,
+		Hasher:           hasher,
+		UnlockKey:        cfg.GalleryUnlockKey,
+	}
+	totpService := &models.TOTPService{
+		DB: db,
+	}
+	signInChallengeService := &models.SignInChallengeService{
+		DB: db,
+	}
+	webAuthn, err := webauthn.New(&cfg.WebAuthn)
+	if err != nil {
+		panic(err)
+	}
+	passkeyService := &models.PasskeyService{
+		DB:       db,
+		WebAuthn: webAuthn,
+	}
+	accountUnlockService := &models.AccountUnlockService{
+		DB: db,
+	}
+	emailVerificationService := &models.EmailVerificationService{
+		DB: db,
+	}
+	oauthIdentityService := &models.OAuthIdentityService{
+		DB: db,
+	}
+	oauthStateService := &models.OAuthStateService{
 		DB: db,
 	}
+	oauthTokenService := &models.OAuthTokenService{
+		DB:  db,
+		Key: cfg.OAuthTokenKey,
+	}
+	importService := &models.ImportService{
+		DB:             db,
+		GalleryService: galleryService,
+	}
+	importProviders := make(map[string]*models.ImportProvider)
+	if c := cfg.Import.Dropbox; c.ClientID != "" {
+		provider := models.NewDropboxProvider(c.ClientID, c.ClientSecret, c.Scopes)
+		importProviders[provider.Name] = provider
+	}
+	if c := cfg.Import.GoogleDrive; c.ClientID != "" {
+		provider := models.NewGoogleDriveProvider(c.ClientID, c.ClientSecret, c.Scopes)
+		importProviders[provider.Name] = provider
+	}
+	if c := cfg.Import.OneDrive; c.ClientID != "" {
+		provider := models.NewOneDriveProvider(c.ClientID, c.ClientSecret, c.Scopes)
+		importProviders[provider.Name] = provider
+	}
+	signInProviders := make(map[string]*models.OAuthProvider)
+	if cfg.SignIn.Google.ClientID != "" {
+		provider, err := models.NewOIDCProvider(context.Background(), "google", "Google",
+			"https://accounts.google.com", cfg.SignIn.Google.ClientID, cfg.SignIn.Google.ClientSecret)
+		if err != nil {
+			panic(err)
+		}
+		signInProviders[provider.Name] = provider
+	}
+	if cfg.SignIn.GitHub.ClientID != "" {
+		provider := models.NewGitHubProvider(cfg.SignIn.GitHub.ClientID, cfg.SignIn.GitHub.ClientSecret)
+		signInProviders[provider.Name] = provider
+	}
+	if cfg.SignIn.OIDC.ClientID != "" {
+		provider, err := models.NewOIDCProvider(context.Background(), "oidc", cfg.SignIn.OIDC.DisplayName,
+			cfg.SignIn.OIDC.Issuer, cfg.SignIn.OIDC.ClientID, cfg.SignIn.OIDC.ClientSecret)
+		if err != nil {
+			panic(err)
+		}
+		signInProviders[provider.Name] = provider
+	}
+	var rateLimiter models.RateLimiter
+	switch cfg.RateLimitStore {
+	case "", "memory":
+		rateLimiter = &models.MemoryRateLimiter{}
+	case "postgres":
+		pgLimiter := &models.PostgresRateLimiter{
+			DB: db,
+		}
+		go func() {
+			for range time.Tick(time.Hour) {
+				err := pgLimiter.DeleteExpired()
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}()
+		rateLimiter = pgLimiter
+	default:
+		panic(fmt.Sprintf("unknown rate limit store %q", cfg.RateLimitStore))
+	}
+	throttle := &models.Throttle{
+		Limiter: rateLimiter,
+	}
 	// Set up middlewares
 	userMw := controllers.UserMiddleWare{
 		SessionService: sessionService,
@@ -126,12 +509,27 @@ func main() {
 	)
 
 	// Set up controllers
+	urls := controllers.URLBuilder{
+		BaseURL: cfg.Server.BaseURL,
+	}
 	usersC := controllers.Users{
-		UserService:          userService,
-		SessionService:       sessionService,
-		PasswordResetService: pwResetService,
-		EmailService:         emailService,
-		EmailResetService:    emailResetService,
+		UserService:              userService,
+		SessionService:           sessionService,
+		PasswordResetService:     pwResetService,
+		EmailService:             emailService,
+		EmailResetService:        emailResetService,
+		TOTPService:              totpService,
+		SignInChallengeService:   signInChallengeService,
+		PasskeyService:           passkeyService,
+		AccountUnlockService:     accountUnlockService,
+		Throttle:                 throttle,
+		EmailVerificationService: emailVerificationService,
+		OAuthIdentityService:     oauthIdentityService,
+		OAuthProviders:           signInProviders,
+		OAuthTokenService:        oauthTokenService,
+		OAuthStateService:        oauthStateService,
+		ImportProviders:          importProviders,
+		URLs:                     urls,
 	}
 
 	usersC.Templates.SignUp = views.Must(views.ParseFS(
@@ -140,7 +538,7 @@ func main() {
 	))
 	usersC.Templates.SignIn = views.Must(views.ParseFS(
 		templates.FS,
-		"signin.gohtml", "tailwind.gohtml",
+		"signin.gohtml", "passkeys.gohtml", "tailwind.gohtml",
 	))
 	usersC.Templates.ForgotPassword = views.Must(views.ParseFS(
 		templates.FS,
@@ -156,7 +554,7 @@ func main() {
 	))
 	usersC.Templates.Setting = views.Must(views.ParseFS(
 		templates.FS,
-		"setting.gohtml", "tailwind.gohtml",
+		"setting.gohtml", "passkeys.gohtml", "tailwind.gohtml",
 	))
 	usersC.Templates.EmailUpdateSuccess = views.Must(views.ParseFS(
 		templates.FS,
@@ -166,9 +564,50 @@ func main() {
 		templates.FS,
 		"password-successful-reset.gohtml", "tailwind.gohtml",
 	))
+	usersC.Templates.TwoFactor = views.Must(views.ParseFS(
+		templates.FS,
+		"two-factor.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.TwoFactorSetup = views.Must(views.ParseFS(
+		templates.FS,
+		"two-factor-setup.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.RecoveryCodes = views.Must(views.ParseFS(
+		templates.FS,
+		"recovery-codes.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.TooManyAttempts = views.Must(views.ParseFS(
+		templates.FS,
+		"too-many-attempts.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.VerifyEmail = views.Must(views.ParseFS(
+		templates.FS,
+		"verify-email.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.EmailChangeCancelled = views.Must(views.ParseFS(
+		templates.FS,
+		"email-change-cancelled.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.ResetLinkExpired = views.Must(views.ParseFS(
+		templates.FS,
+		"reset-link-expired.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.OAuthError = views.Must(views.ParseFS(
+		templates.FS,
+		"oauth-error.gohtml", "tailwind.gohtml",
+	))
 
 	galleriesC := controllers.Galleries{
-		GalleryService: galleryService,
+		GalleryService:    galleryService,
+		RedirectImages:    cfg.Storage.Redirect,
+		Throttle:          throttle,
+		ShareService:      galleryShareService,
+		URLs:              urls,
+		MemberService:     galleryMemberService,
+		EmailService:      emailService,
+		ImportProviders:   importProviders,
+		OAuthTokenService: oauthTokenService,
+		ImportService:     importService,
 	}
 
 	galleriesC.Templates.New = views.Must(views.ParseFS(
@@ -191,12 +630,43 @@ func main() {
 		"galleries/show.gohtml", "tailwind.gohtml",
 	))
 
+	galleriesC.Templates.Import = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/import.gohtml", "tailwind.gohtml",
+	))
+
+	galleriesC.Templates.Unlock = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/unlock.gohtml", "tailwind.gohtml",
+	))
+
+	galleriesC.Templates.Shares = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/shares.gohtml", "tailwind.gohtml",
+	))
+
+	galleriesC.Templates.Invitation = views.Must(views.ParseFS(
+		templates.FS,
+		"invitation.gohtml", "tailwind.gohtml",
+	))
+	galleriesC.Templates.Image = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/image.gohtml", "tailwind.gohtml",
+	))
+
 	oauthC := controllers.OAuth{
-		ProviderConfigs: cfg.OAuthProviders,
+		Providers:    importProviders,
+		TokenService: oauthTokenService,
+		StateService: oauthStateService,
+		URLs:         urls,
 	}
+	oauthC.Templates.Error = usersC.Templates.OAuthError
 
 	// Set up routers and routes
 	r := chi.NewRouter()
+	if cfg.Server.TrustProxy {
+		r.Use(controllers.TrustProxy)
+	}
 	r.Use(csrfMw)
 	r.Use(userMw.SetUser) //applied everywhere
 
@@ -213,10 +683,21 @@ func main() {
 	r.Post("/signup", usersC.ProcessSignUp)
 	r.Get("/signin", usersC.SignIn)
 	r.Post("/signin", usersC.ProcessSignIn)
+	r.Get("/signin/2fa", usersC.TwoFactor)
+	r.Post("/signin/2fa", usersC.ProcessTwoFactor)
+	r.Post("/signin/passkey/begin", usersC.ProcessPasskeySignInBegin)
+	r.Post("/signin/passkey/finish", usersC.ProcessPasskeySignInFinish)
+	r.Get("/signin/oauth/{provider}", usersC.ProcessOAuthSignIn)
+	r.Get("/signin/oauth/{provider}/callback", usersC.OAuthSignInCallback)
 	r.Get("/forgot-pw", usersC.ForgotPassword)
 	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
 	r.Get("/reset-pw", usersC.ResetPassword)
 	r.Post("/reset-pw", usersC.ProcessResetPassword)
+	r.Get("/unlock", usersC.ProcessUnlock)
+	r.Get("/cancel-email-change", usersC.ProcessCancelEmailChange)
+	r.Get("/verify-email/confirm", usersC.ProcessVerifyEmail)
+	r.With(userMw.RequireUser).Get("/verify-email", usersC.VerifyEmail)
+	r.With(userMw.RequireUser).Post("/verify-email", usersC.ProcessResendVerification)
 	r.With(userMw.RequireUser).Post("/signout", usersC.ProcessSignOut)
 
 	r.Route("/setting", func(r chi.Router) {
@@ -225,11 +706,32 @@ func main() {
 		r.Post("/update-password", usersC.ProcessUpdatePassword)
 		r.Post("/update-email", usersC.ProcessUpdateEmail)
 		r.Get("/reset-email", usersC.ProcessResetEmail)
+		r.Post("/sessions/{id}/revoke", usersC.ProcessRevokeSession)
+		r.Post("/sessions/revoke-others", usersC.ProcessRevokeOtherSessions)
+		r.Post("/2fa/enroll", usersC.ProcessTwoFactorEnroll)
+		r.Post("/2fa/confirm", usersC.ProcessTwoFactorConfirm)
+		r.Post("/2fa/disable", usersC.ProcessTwoFactorDisable)
+		r.Post("/passkeys/begin", usersC.ProcessPasskeyRegisterBegin)
+		r.Post("/passkeys/finish", usersC.ProcessPasskeyRegisterFinish)
+		r.Post("/passkeys/{id}/delete", usersC.ProcessPasskeyDelete)
+		r.Post("/identities/{provider}/link", usersC.ProcessOAuthLink)
+		r.Post("/identities/{id}/delete", usersC.ProcessOAuthUnlink)
 	})
 
+	r.Get("/invitations/{token}", galleriesC.Invitation)
+	r.With(userMw.RequireUser, userMw.RequireVerifiedEmail).Post("/invitations/{token}", galleriesC.AcceptInvitation)
+
+	r.Get("/s/{token}", galleriesC.ShowShare)
+	r.Get("/s/{token}/images/{image}", galleriesC.ShareImage)
+	r.Get("/s/{token}/images/{image}/details", galleriesC.ShareImageDetails)
+	r.Get("/img/{signature}/*", galleriesC.TransformImage)
+
 	r.Route("/galleries", func(r chi.Router) {
 		r.Get("/{id}", galleriesC.Show)
-		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Get("/{id}/images/{image}", galleriesC.Image)
+		r.Get("/{id}/images/{image}/details", galleriesC.ImageDetails)
+		r.Get("/{id}/images/{image}/transform", galleriesC.ImageTransformURL)
+		r.Post("/{id}/unlock", galleriesC.ProcessUnlock)
 		r.Group(func(r chi.Router) {
 			r.Use(userMw.RequireUser)
 			r.Get("/", galleriesC.Index)
@@ -238,9 +740,20 @@ func main() {
 			r.Get("/{id}/edit", galleriesC.Edit)
 			r.Post("/{id}", galleriesC.Update)
 			r.Post("/{id}/delete", galleriesC.Delete)
+			r.Post("/{id}/visibility", galleriesC.UpdateVisibility)
+			r.Post("/{id}/metadata", galleriesC.UpdateStripMetadata)
+			r.Get("/{id}/shares", galleriesC.Shares)
+			r.With(userMw.RequireVerifiedEmail).Post("/{id}/shares", galleriesC.CreateShare)
+			r.Post("/{id}/shares/{shareID}/delete", galleriesC.RevokeShare)
+			r.With(userMw.RequireVerifiedEmail).Post("/{id}/members", galleriesC.InviteMember)
+			r.Post("/{id}/members/{userID}/role", galleriesC.UpdateMemberRole)
+			r.Post("/{id}/members/{userID}/delete", galleriesC.RemoveMember)
+			r.Post("/{id}/invitations/{invitationID}/delete", galleriesC.RevokeInvitation)
 			r.Post("/{id}/images/delete", galleriesC.DeleteImages)
 			r.Post("/{id}/images", galleriesC.UploadImage)
 			r.Post("/{id}/images/url", galleriesC.ImageViaURL)
+			r.Get("/{id}/import/{provider}", galleriesC.Import)
+			r.Post("/{id}/import/{provider}", galleriesC.ProcessImport)
 		})
 	})
 
@@ -248,6 +761,7 @@ func main() {
 		r.Use(userMw.RequireUser)
 		r.Get("/connect", oauthC.Connect)
 		r.Get("/callback", oauthC.Callback)
+		r.Post("/disconnect", oauthC.Disconnect)
 	})
 
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
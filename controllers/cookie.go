@@ -3,6 +3,9 @@ package controllers
 import (
 	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/models"
 )
 
 const (
@@ -26,6 +29,23 @@ func setCookie(w http.ResponseWriter, name, value string) {
 	http.SetCookie(w, cookie)
 }
 
+// Create and set a cookie that outlives the browser session until expiresAt
+func setPersistentCookie(w http.ResponseWriter, name, value string, expiresAt time.Time) {
+	cookie := newCookie(name, value)
+	cookie.MaxAge = int(time.Until(expiresAt).Seconds())
+	http.SetCookie(w, cookie)
+}
+
+// Set the session cookie, remembering it across browser restarts for
+// persistent sessions
+func setSessionCookie(w http.ResponseWriter, session *models.Session) {
+	if session.Persistent {
+		setPersistentCookie(w, CookieSession, session.Token, session.ExpiresAt)
+		return
+	}
+	setCookie(w, CookieSession, session.Token)
+}
+
 // Read the cookie value with given name
 func readCookie(r *http.Request, name string) (string, error) {
 	cookie, err := r.Cookie(name)
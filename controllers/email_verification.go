@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/joncalhoun/lenslocked/context"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+// Email the user a link to verify their email address
+func (u Users) sendVerification(r *http.Request, user *models.User) error {
+	verification, err := u.EmailVerificationService.Create(user.ID)
+	if err != nil {
+		return fmt.Errorf("send verification: %w", err)
+	}
+	vals := url.Values{
+		"token": {verification.Token},
+	}
+	verifyURL := u.URLs.URL("/verify-email/confirm?" + vals.Encode())
+	err = u.EmailService.VerifyEmail(user.Email, verifyURL)
+	if err != nil {
+		return fmt.Errorf("send verification: %w", err)
+	}
+	return nil
+}
+
+// Render the page asking the user to verify their email address
+func (u Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email    string
+		Verified bool
+	}
+	user := context.User(r.Context())
+	data.Email = user.Email
+	data.Verified = user.EmailVerified()
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+// Send the current user another verification email
+func (u Users) ProcessResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.EmailVerified() {
+		http.Redirect(w, r, "/verify-email", http.StatusFound)
+		return
+	}
+	key := "verify-email:account:" + strconv.Itoa(user.ID)
+	if u.throttled(w, r, key) {
+		return
+	}
+	_, err := u.Throttle.Fail(key)
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = u.sendVerification(r, user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Email string
+	}
+	data.Email = user.Email
+	u.Templates.CheckYourEmail.Execute(w, r, data)
+}
+
+// Verify the email address from the link in the verification email
+func (u Users) ProcessVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := u.EmailVerificationService.Consume(r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrTokenInvalid) || errors.Is(err, models.ErrTokenExpired) {
+			http.Error(w, "This verification link is invalid or has expired.", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	err = u.UserService.MarkEmailVerified(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/verify-email", http.StatusFound)
+}
+
+// Require the current user to have verified their email address.
+// RequireUser must run first.
+func (userMw UserMiddleWare) RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if !user.EmailVerified() {
+			http.Redirect(w, r, "/verify-email", http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -2,10 +2,13 @@ package controllers
 
 import (
 	"fmt"
+	"mime"
 	"net/http"
 	"net/url"
-	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joncalhoun/lenslocked/context"
@@ -16,12 +19,38 @@ import (
 
 type Galleries struct {
 	Templates struct {
-		New   Template
-		Edit  Template
-		Index Template
-		Show  Template
+		New        Template
+		Edit       Template
+		Index      Template
+		Show       Template
+		Import     Template
+		Unlock     Template
+		Shares     Template
+		Invitation Template
+		// Image shows one image with its camera details
+		Image Template
 	}
 	GalleryService *models.GalleryService
+	// RedirectImages sends browsers to a presigned storage URL for each
+	// image, when the storage can make one, instead of streaming images
+	// through the server
+	RedirectImages bool
+	// Throttle slows down guessing gallery passwords
+	Throttle *models.Throttle
+	// ShareService keeps the links galleries are shared with, which are
+	// built with URLs
+	ShareService *models.GalleryShareService
+	URLs         URLBuilder
+	// MemberService keeps who else can see and work on each gallery, who
+	// are invited through the EmailService
+	MemberService *models.GalleryMemberService
+	EmailService  *models.EmailService
+	// ImportProviders are the services users can import photos from, by
+	// name. Their tokens are kept by the OAuthTokenService.
+	ImportProviders   map[string]*models.ImportProvider
+	OAuthTokenService *models.OAuthTokenService
+	// ImportService runs imports and keeps how they went
+	ImportService *models.ImportService
 }
 
 type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
@@ -48,27 +77,138 @@ func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// This page doesn't exist, but we will want to redirect here eventually.
-	//editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	//editPath := fmt.Sprintf("/galleries/%s/edit", gallery.Slug())
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
 	if err != nil {
 		return
 	}
+	g.renderEdit(w, r, gallery)
+}
+
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
 	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
+		ID       string
+		Filename string
+		URL      string
+		imageSources
+	}
+	type Member struct {
+		UserID int
+		Email  string
+		Role   string
+	}
+	type Invitation struct {
+		ID        int
+		Email     string
+		Role      string
+		ExpiresAt string
+	}
+	type ImportFile struct {
+		Filename string
+		Error    string
+	}
+	type Import struct {
+		Provider  string
+		CreatedAt string
+		Running   bool
+		Imported  int
+		Pending   int
+		Failed    []ImportFile
 	}
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		Slug       string
+		Title      string
+		TitleInURL bool
+		Images     []Image
+		// ImportProviders are the services photos can be imported from,
+		// and Imports how the latest imports went
+		ImportProviders []oauthProvider
+		Imports         []Import
+		Visibility      string
+		HasPassword     bool
+		StripMetadata   string
+		// Editors can change the gallery and delete images, and owners can
+		// also manage members
+		CanEdit     bool
+		IsOwner     bool
+		Members     []Member
+		Invitations []Invitation
+	}
+	role, err := g.galleryRole(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.CanEdit = models.RoleAtLeast(role, models.RoleEditor)
+	data.IsOwner = role == models.RoleOwner
+	if data.IsOwner {
+		members, err := g.MemberService.Members(gallery.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		for _, member := range members {
+			data.Members = append(data.Members, Member{
+				UserID: member.UserID,
+				Email:  member.Email,
+				Role:   member.Role,
+			})
+		}
+		invitations, err := g.MemberService.Invitations(gallery.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		for _, invitation := range invitations {
+			data.Invitations = append(data.Invitations, Invitation{
+				ID:        invitation.ID,
+				Email:     invitation.Email,
+				Role:      invitation.Role,
+				ExpiresAt: invitation.ExpiresAt.Format("Jan 2, 2006 15:04"),
+			})
+		}
 	}
-	data.ID = gallery.ID
+	data.Slug = gallery.Slug()
 	data.Title = gallery.Title
+	data.TitleInURL = gallery.TitleInURL
+	data.Visibility = gallery.Visibility
+	data.HasPassword = gallery.PasswordHash != ""
+	data.StripMetadata = gallery.StripMetadata
+	data.ImportProviders = importProviders(g.ImportProviders)
+	imports, err := g.ImportService.Recent(gallery.ID, recentImports)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, imp := range imports {
+		summary := Import{
+			Provider:  imp.Provider,
+			CreatedAt: imp.CreatedAt.Format("Jan 2, 2006 15:04"),
+			Running:   imp.FinishedAt.IsZero(),
+		}
+		if provider, ok := g.ImportProviders[imp.Provider]; ok {
+			summary.Provider = provider.DisplayName
+		}
+		for _, file := range imp.Files {
+			switch file.Status {
+			case models.ImportImported:
+				summary.Imported++
+			case models.ImportFailed:
+				summary.Failed = append(summary.Failed, ImportFile{file.Filename, file.Error})
+			default:
+				summary.Pending++
+			}
+		}
+		data.Imports = append(data.Imports, summary)
+	}
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
 		fmt.Println(err)
@@ -76,40 +216,53 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	for _, image := range images {
+		imageURL := fmt.Sprintf("/galleries/%s/images/%s", gallery.Slug(), image.PublicID)
 		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
+			ID:           image.PublicID,
+			Filename:     image.Filename,
+			URL:          imageURL,
+			imageSources: g.imageSources(imageURL, image),
 		})
 	}
-	g.Templates.Edit.Execute(w, r, data)
+	g.Templates.Edit.Execute(w, r, data, errs...)
 
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
 	if err != nil {
 		return
 	}
 
 	title := r.FormValue("title")
 	gallery.Title = title
+	gallery.TitleInURL = r.FormValue("title_in_url") == "true"
 	err = g.GalleryService.Update(gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.Slug())
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
-		ID    int
-		Title string
+		Slug       string
+		Title      string
+		Visibility string
+	}
+	type SharedGallery struct {
+		Slug string
+		// Only contributors and editors can open the edit page
+		CanContribute bool
+		Title         string
+		Role          string
 	}
 	var data struct {
 		Galleries []Gallery
+		// Shared are the galleries the user is a member of
+		Shared []SharedGallery
 	}
 	user := context.User(r.Context())
 	galleries, err := g.GalleryService.FindByUserID(user.ID)
@@ -119,8 +272,23 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	}
 	for _, gallery := range galleries {
 		data.Galleries = append(data.Galleries, Gallery{
-			ID:    gallery.ID,
-			Title: gallery.Title,
+			Slug:       gallery.Slug(),
+			Title:      gallery.Title,
+			Visibility: gallery.Visibility,
+		})
+	}
+	shared, err := g.MemberService.Galleries(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range shared {
+		data.Shared = append(data.Shared, SharedGallery{
+			Slug:          gallery.Slug(),
+			CanContribute: models.RoleAtLeast(gallery.Role, models.RoleContributor),
+			Title:         gallery.Title,
+			Role:          gallery.Role,
 		})
 	}
 	g.Templates.Index.Execute(w, r, data)
@@ -128,21 +296,30 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 
 // Show all images in the gallery
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
 	if err != nil {
 		return
 	}
+	if gallery.Visibility != models.VisibilityPublic {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+	g.renderShow(w, r, gallery, fmt.Sprintf("/galleries/%s/images/", gallery.Slug()), false)
+}
+
+// Render the gallery's images, which are served under imagesPath. When
+// downloads is set, each image gets a download link too.
+func (g Galleries) renderShow(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, imagesPath string, downloads bool) {
 	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
+		Filename    string
+		URL         string
+		DetailsURL  string
+		DownloadURL string
+		imageSources
 	}
 	var data struct {
-		ID     int
 		Title  string
 		Images []Image
 	}
-	data.ID = gallery.ID
 	data.Title = gallery.Title
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
@@ -151,17 +328,22 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	for _, image := range images {
-		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
-		})
+		img := Image{
+			Filename: image.Filename,
+			URL:      imagesPath + image.PublicID,
+		}
+		img.DetailsURL = img.URL + "/details"
+		img.imageSources = g.imageSources(img.URL, image)
+		if downloads {
+			img.DownloadURL = img.URL + "?download=true"
+		}
+		data.Images = append(data.Images, img)
 	}
 	g.Templates.Show.Execute(w, r, data)
 }
 
 func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
 	if err != nil {
 		return
 	}
@@ -175,44 +357,170 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 
 // Render the image
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
-	filename := g.filename(w, r)
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
-	image, err := g.GalleryService.Image(galleryID, filename)
+	image, err := g.imageByID(w, r, gallery, fmt.Sprintf("/galleries/%s/images/", gallery.Slug()))
 	if err != nil {
-		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	g.serveGalleryImage(w, r, gallery, image, false)
+}
+
+// The URLs of an image's smaller sizes, for the srcset attributes of
+// <picture> elements. Src is the largest JPEG, for browsers without
+// srcset support.
+type imageSources struct {
+	Src        string
+	SrcSet     string
+	WebPSrcSet string
+	Width      int
+	Height     int
+}
+
+func (g Galleries) imageSources(imageURL string, image models.Image) imageSources {
+	sources := imageSources{
+		Src:    imageURL,
+		Width:  image.Width,
+		Height: image.Height,
+	}
+	var srcSet, webpSrcSet []string
+	for _, width := range g.GalleryService.ImageWidths(image) {
+		sizeURL := fmt.Sprintf("%s?size=%d&format=", imageURL, width)
+		srcSet = append(srcSet, fmt.Sprintf("%s%s %dw", sizeURL, models.FormatJPEG, width))
+		webpSrcSet = append(webpSrcSet, fmt.Sprintf("%s%s %dw", sizeURL, models.FormatWebP, width))
+		sources.Src = sizeURL + models.FormatJPEG
+	}
+	if len(srcSet) > 0 {
+		// The original is the biggest size there is
+		srcSet = append(srcSet, fmt.Sprintf("%s %dw", imageURL, image.Width))
+		webpSrcSet = append(webpSrcSet, fmt.Sprintf("%s %dw", imageURL, image.Width))
+		sources.SrcSet = strings.Join(srcSet, ", ")
+		if slices.Contains(models.ImageFormats(), models.FormatWebP) {
+			sources.WebPSrcSet = strings.Join(webpSrcSet, ", ")
+		}
+	}
+	return sources
+}
+
+// How many of a gallery's latest imports the edit page shows
+const recentImports = 3
+
+// The most images that can be uploaded at once
+const maxUploadFiles = 20
+
+// How long the presigned URLs images are redirected to work for
+const imageURLExpiry = 15 * time.Minute
+
+// Send one of the gallery's images. Smaller variants are sent for ?size=
+// with one of the configured widths, as WebP or JPEG by ?format=, or by
+// what the browser accepts. Otherwise the original is sent without the
+// metadata the gallery strips.
+func (g Galleries) serveGalleryImage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, image *models.Image, download bool) {
+	original := image.StorageKey
+	if size := r.FormValue("size"); size != "" && !download {
+		format := r.FormValue("format")
+		if format == "" {
+			w.Header().Add("Vary", "Accept")
+			format = models.FormatJPEG
+			if strings.Contains(r.Header.Get("Accept"), "image/webp") &&
+				slices.Contains(models.ImageFormats(), models.FormatWebP) {
+				format = models.FormatWebP
+			}
+		}
+		width, err := strconv.Atoi(size)
+		if err != nil {
+			http.Error(w, "Image size not found", http.StatusNotFound)
+			return
+		}
+		image, err = g.GalleryService.ImageVariant(r.Context(), *image, width, format)
+		if err != nil {
+			if errors.Is(err, models.ErrImageSize) {
+				http.Error(w, "Image size not found", http.StatusNotFound)
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Variants are encoded without metadata, but sizes the image is no
+	// wider than are the original
+	if image.StorageKey == original {
+		var err error
+		image, err = g.GalleryService.ServedImage(r.Context(), gallery, *image)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
 			return
 		}
-		fmt.Println(err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
-		return
 	}
-	http.ServeFile(w, r, image.Path)
+	g.serveImage(w, r, image, download)
 }
 
-// Require the user to be the owner of the gallery
-func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
-	user := context.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
-		return fmt.Errorf("user does not have access to this gallery")
+// Send the image's file, with Range requests supported. Downloads are
+// always streamed, as the storage URL wouldn't set their filename.
+func (g Galleries) serveImage(w http.ResponseWriter, r *http.Request, image *models.Image, download bool) {
+	if g.RedirectImages && !download {
+		imageURL, err := g.GalleryService.ImageURL(r.Context(), image, imageURLExpiry)
+		if err == nil {
+			http.Redirect(w, r, imageURL, http.StatusFound)
+			return
+		}
+		if !errors.Is(err, models.ErrPresignNotSupported) {
+			fmt.Println(err)
+		}
+	}
+	if download {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": image.Filename}))
 	}
-	return nil
+	content := g.GalleryService.OpenImage(r.Context(), image)
+	defer content.Close()
+	w.Header().Set("Content-Type", image.ContentType)
+	http.ServeContent(w, r, image.Filename, image.CreatedAt, content)
 }
 
-// Query for gallery by ID
-func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+// Query for the gallery's image by the ID in the URL. Old URLs with the
+// filename of a legacy image instead are redirected to imagesPath plus
+// the ID.
+func (g Galleries) imageByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, imagesPath string) (*models.Image, error) {
+	id := chi.URLParam(r, "image")
+	image, err := g.GalleryService.Image(gallery.ID, id)
+	if errors.Is(err, models.ErrNotFound) && g.GalleryService.IsImage(id) {
+		image, err = g.GalleryService.ImageByFilename(gallery.ID, id)
+		if err == nil {
+			target := url.URL{Path: imagesPath + image.PublicID, RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+			return nil, fmt.Errorf("image %q moved to %s", id, image.PublicID)
+		}
+	}
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return nil, err
 	}
+	return &image, nil
+}
 
-	gallery, err := g.GalleryService.FindByID(id)
+// Query for gallery by the slug in the URL. Galleries from before slugs
+// can still be found by their numeric ID, and any URL that isn't the
+// gallery's current one is redirected to it once the opts pass.
+func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
+	param := chi.URLParam(r, "id")
+	// Public IDs are too long to parse as an int
+	id, err := strconv.Atoi(param)
+	numeric := err == nil
+	var gallery *models.Gallery
+	if numeric {
+		gallery, err = g.GalleryService.FindByID(id)
+	} else {
+		gallery, err = g.GalleryService.FindBySlug(param)
+	}
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Gallery not found", http.StatusNotFound)
@@ -221,6 +529,15 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return nil, err
 	}
+	if numeric && !gallery.LegacyURLs {
+		// Only the owner may use the numeric ID of a newer gallery, so
+		// others can't find galleries by counting
+		user := context.User(r.Context())
+		if user == nil || user.ID != gallery.UserID {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return nil, fmt.Errorf("gallery %d has no numeric URL", gallery.ID)
+		}
+	}
 
 	for _, opt := range opts {
 		err = opt(w, r, gallery)
@@ -229,6 +546,17 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 		}
 	}
 
+	if param != gallery.Slug() {
+		prefix := "/galleries/" + param
+		target := url.URL{
+			Path:     "/galleries/" + gallery.Slug() + strings.TrimPrefix(r.URL.Path, prefix),
+			RawQuery: r.URL.RawQuery,
+		}
+		// Keep the method, so forms posted to old URLs still work
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+		return nil, fmt.Errorf("gallery %q moved to %q", param, gallery.Slug())
+	}
+
 	return gallery, nil
 }
 
@@ -237,17 +565,17 @@ func (g Galleries) DeleteImages(w http.ResponseWriter, r *http.Request) {
 	//TODO: Print selected images first
 	r.ParseForm()
 	selectedImages := r.Form["selectedImages[]"]
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
 	if err != nil {
 		return
 	}
 
 	var eg errgroup.Group
-	for _, filename := range selectedImages {
-		filenameBase := filepath.Base(filename)
+	for _, imageID := range selectedImages {
+		imageID := imageID
 
 		eg.Go(func() error {
-			return g.GalleryService.DeleteImage(gallery.ID, filenameBase)
+			return g.GalleryService.DeleteImage(gallery.ID, imageID)
 		})
 	}
 
@@ -258,22 +586,36 @@ func (g Galleries) DeleteImages(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.Slug())
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
 // Handle uploading images
 func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
 	if err != nil {
 		return
 	}
+	user := context.User(r.Context())
+	maxSize := g.GalleryService.ImageSizeLimit()
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadFiles*maxSize)
 	err = r.ParseMultipartForm(5 << 20) // 5mb
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			msg := fmt.Sprintf("Up to %d images of %d MB each can be uploaded at once.", maxUploadFiles, maxSize>>20)
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 	fileHeaders := r.MultipartForm.File["images"]
+	if len(fileHeaders) > maxUploadFiles {
+		msg := fmt.Sprintf("Up to %d images can be uploaded at once.", maxUploadFiles)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
 	for _, fileHeader := range fileHeaders {
 		file, err := fileHeader.Open()
 		if err != nil {
@@ -282,11 +624,12 @@ func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 		}
 		defer file.Close()
 
-		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		_, err = g.GalleryService.CreateImage(gallery.ID, user.ID, fileHeader.Filename, file)
 		if err != nil {
 			var fileErr models.FileError
 			if errors.As(err, &fileErr) {
-				msg := fmt.Sprintf("%v has an invalid content type or extension. Only png, gif, and jpg files can be uploaded.", fileHeader.Filename)
+				msg := fmt.Sprintf("%v can't be uploaded (%v). Only png, gif, jpg and webp images up to %d MB can be uploaded.",
+					fileHeader.Filename, fileErr.Issue, maxSize>>20)
 				http.Error(w, msg, http.StatusBadRequest)
 				return
 			}
@@ -295,22 +638,16 @@ func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.Slug())
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
-// Get only the base of filename
-func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
-	filename := chi.URLParam(r, "filename")
-	filename = filepath.Base(filename)
-	return filename
-}
-
 func (g Galleries) ImageViaURL(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
 	if err != nil {
 		return
 	}
+	user := context.User(r.Context())
 	err = r.ParseForm()
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusBadRequest)
@@ -322,7 +659,7 @@ func (g Galleries) ImageViaURL(w http.ResponseWriter, r *http.Request) {
 	for _, fileURL := range files {
 		url := fileURL // Avoid downloading the same file multiple times
 		eg.Go(func() error {
-			return g.GalleryService.CreateImageViaURL(gallery.ID, url)
+			return g.GalleryService.CreateImageViaURL(gallery.ID, user.ID, url)
 		})
 	}
 	err = eg.Wait()
@@ -335,6 +672,6 @@ func (g Galleries) ImageViaURL(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.Slug())
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
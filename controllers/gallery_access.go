@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/context"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+// How long a visitor stays unlocked after entering a gallery's password
+const galleryUnlockDuration = 30 * 24 * time.Hour
+
+// The cookie remembering a visitor has unlocked the gallery. It is only
+// sent with requests for galleries, as the gallery's slug can change.
+func galleryUnlockCookie(gallery *models.Gallery) (name, path string) {
+	return "gallery_unlock_" + gallery.PublicID, "/galleries/"
+}
+
+// Require the user to be allowed to see the gallery. Private galleries
+// look like they don't exist to anyone but their owner and members, and
+// other visitors to password protected ones are asked for the password.
+func (g Galleries) userCanViewGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	switch gallery.Visibility {
+	case models.VisibilityUnlisted, models.VisibilityPublic:
+		return nil
+	}
+	role, err := g.galleryRole(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return err
+	}
+	if role != "" {
+		return nil
+	}
+	switch gallery.Visibility {
+	case models.VisibilityPassword:
+		name, _ := galleryUnlockCookie(gallery)
+		token, err := readCookie(r, name)
+		if err == nil && g.GalleryService.Unlocked(gallery, token) {
+			return nil
+		}
+		g.renderUnlock(w, r, gallery)
+		return fmt.Errorf("gallery %d is locked", gallery.ID)
+	}
+	http.Error(w, "Gallery not found", http.StatusNotFound)
+	return fmt.Errorf("user does not have access to this gallery")
+}
+
+// Ask for the password of a password protected gallery
+func (g Galleries) renderUnlock(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
+	var data struct {
+		Slug  string
+		Title string
+	}
+	data.Slug = gallery.Slug()
+	data.Title = gallery.Title
+	w.Header().Set("X-Robots-Tag", "noindex")
+	g.Templates.Unlock.Execute(w, r, data, errs...)
+}
+
+func galleryUnlockIPKey(r *http.Request, galleryID int) string {
+	return fmt.Sprintf("gallery-unlock:%d:ip:%s", galleryID, device(r).IPAddress)
+}
+
+// POST /galleries/{id}/unlock
+func (g Galleries) ProcessUnlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if gallery.Visibility != models.VisibilityPassword {
+		http.Redirect(w, r, "/galleries/"+gallery.Slug(), http.StatusFound)
+		return
+	}
+	ipKey := galleryUnlockIPKey(r, gallery.ID)
+	wait, err := g.Throttle.Wait(ipKey)
+	if err != nil {
+		// Don't lock everyone out because the limiter is unavailable
+		fmt.Println(err)
+	}
+	if wait > 0 {
+		err = errors.Public(fmt.Errorf("gallery %d unlock throttled", gallery.ID), fmt.Sprintf("Too many wrong passwords. Try again in %s.", humanizeWait(wait)))
+		g.renderUnlock(w, r, gallery, err)
+		return
+	}
+
+	token, err := g.GalleryService.Unlock(gallery, r.FormValue("password"))
+	if err != nil {
+		if errors.Is(err, models.ErrWrongGalleryPassword) {
+			_, err = g.Throttle.Fail(ipKey)
+			if err != nil {
+				fmt.Println(err)
+			}
+			g.renderUnlock(w, r, gallery, errors.Public(models.ErrWrongGalleryPassword, "That password is not correct."))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = g.Throttle.Reset(ipKey)
+	if err != nil {
+		fmt.Println(err)
+	}
+	name, path := galleryUnlockCookie(gallery)
+	cookie := newCookie(name, token)
+	cookie.Path = path
+	cookie.MaxAge = int(galleryUnlockDuration.Seconds())
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, "/galleries/"+gallery.Slug(), http.StatusFound)
+}
+
+// POST /galleries/{id}/visibility
+func (g Galleries) UpdateVisibility(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	visibility := r.FormValue("visibility")
+	// Anything but private publishes the gallery, which needs a verified
+	// email address. Making a gallery private again never does.
+	if visibility != models.VisibilityPrivate && !context.User(r.Context()).EmailVerified() {
+		http.Redirect(w, r, "/verify-email", http.StatusFound)
+		return
+	}
+	err = g.GalleryService.SetVisibility(gallery, visibility, r.FormValue("password"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrWeakPassword):
+			g.renderEdit(w, r, gallery, errors.Public(err, "Please choose a password for the gallery."))
+		case errors.Is(err, models.ErrInvalidVisibility):
+			http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.Slug())
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// POST /galleries/{id}/metadata
+func (g Galleries) UpdateStripMetadata(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.SetStripMetadata(gallery, r.FormValue("strip_metadata"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidStripMetadata) {
+			http.Error(w, "Invalid metadata option", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.Slug())
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joncalhoun/lenslocked/context"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+// The signed in user's role in the gallery, or "" if they have none
+func (g Galleries) galleryRole(r *http.Request, gallery *models.Gallery) (string, error) {
+	user := context.User(r.Context())
+	if user == nil {
+		return "", nil
+	}
+	if user.ID == gallery.UserID {
+		return models.RoleOwner, nil
+	}
+	return g.MemberService.Role(gallery.ID, user.ID)
+}
+
+// Require the user to have at least the given role in the gallery
+func (g Galleries) userMustHaveRole(role string) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		userRole, err := g.galleryRole(r, gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return err
+		}
+		if !models.RoleAtLeast(userRole, role) {
+			http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
+			return fmt.Errorf("user does not have the %s role in this gallery", role)
+		}
+		return nil
+	}
+}
+
+// POST /galleries/{id}/members
+func (g Galleries) InviteMember(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	if email == "" || strings.EqualFold(email, user.Email) {
+		err = errors.Public(fmt.Errorf("invalid invitation email %q", email), "Please enter the email address of someone else to invite.")
+		g.renderEdit(w, r, gallery, err)
+		return
+	}
+	invitation, err := g.MemberService.Invite(gallery.ID, user.ID, email, r.FormValue("role"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidRole) {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	acceptURL := g.URLs.URL("/invitations/" + invitation.Token)
+	err = g.EmailService.GalleryInvitation(invitation.Email, user.Email, gallery.Title, acceptURL)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%s/edit", gallery.Slug()), http.StatusFound)
+}
+
+// POST /galleries/{id}/members/{userID}/role
+func (g Galleries) UpdateMemberRole(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
+	if err != nil {
+		return
+	}
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.MemberService.SetRole(gallery.ID, userID, r.FormValue("role"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidRole) {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%s/edit", gallery.Slug()), http.StatusFound)
+}
+
+// POST /galleries/{id}/members/{userID}/delete
+//
+// The owner can remove any member, and members can remove themselves.
+func (g Galleries) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	leaving := userID == user.ID
+	role := models.RoleOwner
+	if leaving {
+		role = models.RoleViewer
+	}
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(role))
+	if err != nil {
+		return
+	}
+	err = g.MemberService.Remove(gallery.ID, userID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if leaving {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%s/edit", gallery.Slug()), http.StatusFound)
+}
+
+// POST /galleries/{id}/invitations/{invitationID}/delete
+func (g Galleries) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
+	if err != nil {
+		return
+	}
+	invitationID, err := strconv.Atoi(chi.URLParam(r, "invitationID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.MemberService.RevokeInvitation(gallery.ID, invitationID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%s/edit", gallery.Slug()), http.StatusFound)
+}
+
+// GET /invitations/{token}
+func (g Galleries) Invitation(w http.ResponseWriter, r *http.Request) {
+	g.renderInvitation(w, r, chi.URLParam(r, "token"))
+}
+
+// Show the invitation with the given token, and how to accept it
+func (g Galleries) renderInvitation(w http.ResponseWriter, r *http.Request, token string, errs ...error) {
+	var data struct {
+		Token        string
+		Invalid      bool
+		Expired      bool
+		Email        string
+		Role         string
+		GalleryTitle string
+		// OtherEmail is set when the signed in user isn't the one invited
+		OtherEmail bool
+	}
+	data.Token = token
+	// The token is in the URL, so don't pass it on to other sites
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	invitation, err := g.MemberService.Invitation(token)
+	switch {
+	case errors.Is(err, models.ErrTokenInvalid):
+		data.Invalid = true
+	case errors.Is(err, models.ErrTokenExpired):
+		data.Expired = true
+	case err != nil:
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	default:
+		gallery, err := g.GalleryService.FindByID(invitation.GalleryID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.Email = invitation.Email
+		data.Role = invitation.Role
+		data.GalleryTitle = gallery.Title
+		user := context.User(r.Context())
+		data.OtherEmail = user != nil && !strings.EqualFold(user.Email, invitation.Email)
+	}
+	g.Templates.Invitation.Execute(w, r, data, errs...)
+}
+
+// POST /invitations/{token}
+func (g Galleries) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	user := context.User(r.Context())
+	member, err := g.MemberService.Accept(token, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrTokenInvalid), errors.Is(err, models.ErrTokenExpired):
+			g.renderInvitation(w, r, token)
+		case errors.Is(err, models.ErrInvitationEmail):
+			g.renderInvitation(w, r, token, errors.Public(err, "This invitation was sent to another email address."))
+		case errors.Is(err, models.ErrUnverifiedEmail):
+			http.Redirect(w, r, "/verify-email", http.StatusFound)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	gallery, err := g.GalleryService.FindByID(member.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if models.RoleAtLeast(member.Role, models.RoleContributor) {
+		http.Redirect(w, r, fmt.Sprintf("/galleries/%s/edit", gallery.Slug()), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/galleries/"+gallery.Slug(), http.StatusFound)
+}
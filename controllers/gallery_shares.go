@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+// The longest a share link can be made to work for, in days
+const maxShareDays = 90
+
+// Share links carry their secret in the URL, so they must not leak to
+// other sites through the Referer header or end up in search results
+func setShareHeaders(w http.ResponseWriter) {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+}
+
+// GET /s/{token}
+func (g Galleries) ShowShare(w http.ResponseWriter, r *http.Request) {
+	setShareHeaders(w)
+	token := chi.URLParam(r, "token")
+	share, err := g.ShareService.View(token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This link has expired or does not exist", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	gallery, err := g.GalleryService.FindByID(share.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.renderShow(w, r, gallery, "/s/"+token+"/images/", share.AllowDownloads)
+}
+
+// GET /s/{token}/images/{image}
+func (g Galleries) ShareImage(w http.ResponseWriter, r *http.Request) {
+	setShareHeaders(w)
+	share, gallery, err := g.shareByToken(w, r)
+	if err != nil {
+		return
+	}
+	download := r.FormValue("download") == "true"
+	if download && !share.AllowDownloads {
+		http.Error(w, "Downloads are not allowed", http.StatusForbidden)
+		return
+	}
+	image, err := g.imageByID(w, r, gallery, "/s/"+chi.URLParam(r, "token")+"/images/")
+	if err != nil {
+		return
+	}
+	g.serveGalleryImage(w, r, gallery, image, download)
+}
+
+// GET /s/{token}/images/{image}/details
+func (g Galleries) ShareImageDetails(w http.ResponseWriter, r *http.Request) {
+	setShareHeaders(w)
+	share, gallery, err := g.shareByToken(w, r)
+	if err != nil {
+		return
+	}
+	token := chi.URLParam(r, "token")
+	image, err := g.imageByID(w, r, gallery, "/s/"+token+"/images/")
+	if err != nil {
+		return
+	}
+	g.renderImageDetails(w, r, gallery, image, "/s/"+token, share.AllowDownloads, false)
+}
+
+// Query for the share by the token in the URL, and its gallery, without
+// counting a view. Only the gallery page counts as one.
+func (g Galleries) shareByToken(w http.ResponseWriter, r *http.Request) (*models.GalleryShare, *models.Gallery, error) {
+	share, err := g.ShareService.ByToken(chi.URLParam(r, "token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This link has expired or does not exist", http.StatusNotFound)
+			return nil, nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, nil, err
+	}
+	gallery, err := g.GalleryService.FindByID(share.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, nil, err
+	}
+	return share, gallery, nil
+}
+
+// GET /galleries/{id}/shares
+func (g Galleries) Shares(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	g.renderShares(w, r, gallery, "")
+}
+
+// List the gallery's share links. newLink is the URL of a link that was
+// just created, which is the only time it can be shown.
+func (g Galleries) renderShares(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, newLink string, errs ...error) {
+	type Share struct {
+		ID             int
+		CreatedAt      string
+		ExpiresAt      string
+		Views          int
+		MaxViews       int
+		AllowDownloads bool
+	}
+	var data struct {
+		Slug    string
+		Title   string
+		NewLink string
+		MaxDays int
+		Shares  []Share
+	}
+	data.Slug = gallery.Slug()
+	data.Title = gallery.Title
+	data.NewLink = newLink
+	data.MaxDays = maxShareDays
+	shares, err := g.ShareService.ByGalleryID(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, share := range shares {
+		data.Shares = append(data.Shares, Share{
+			ID:             share.ID,
+			CreatedAt:      share.CreatedAt.Format("Jan 2, 2006 15:04"),
+			ExpiresAt:      share.ExpiresAt.Format("Jan 2, 2006 15:04"),
+			Views:          share.Views,
+			MaxViews:       share.MaxViews,
+			AllowDownloads: share.AllowDownloads,
+		})
+	}
+	if newLink != "" {
+		// The page shows a secret that can't be seen again
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	g.Templates.Shares.Execute(w, r, data, errs...)
+}
+
+// POST /galleries/{id}/shares
+func (g Galleries) CreateShare(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 1 || days > maxShareDays {
+		err = errors.Public(fmt.Errorf("invalid share days %q", r.FormValue("days")),
+			fmt.Sprintf("Links can work for between 1 and %d days.", maxShareDays))
+		g.renderShares(w, r, gallery, "", err)
+		return
+	}
+	var maxViews int
+	if v := r.FormValue("max_views"); v != "" {
+		maxViews, err = strconv.Atoi(v)
+		if err != nil || maxViews < 0 {
+			err = errors.Public(fmt.Errorf("invalid max views %q", v),
+				"The number of views must be a whole number, or empty for no limit.")
+			g.renderShares(w, r, gallery, "", err)
+			return
+		}
+	}
+	allowDownloads := r.FormValue("allow_downloads") == "true"
+	share, err := g.ShareService.Create(gallery.ID, time.Duration(days)*24*time.Hour, maxViews, allowDownloads)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.renderShares(w, r, gallery, g.URLs.URL("/s/"+share.Token))
+}
+
+// POST /galleries/{id}/shares/{shareID}/delete
+func (g Galleries) RevokeShare(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	shareID, err := strconv.Atoi(chi.URLParam(r, "shareID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.ShareService.Delete(gallery.ID, shareID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%s/shares", gallery.Slug()), http.StatusFound)
+}
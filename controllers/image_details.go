@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+// GET /galleries/{id}/images/{image}/details
+func (g Galleries) ImageDetails(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	galleryPath := "/galleries/" + gallery.Slug()
+	image, err := g.imageByID(w, r, gallery, galleryPath+"/images/")
+	if err != nil {
+		return
+	}
+	if gallery.Visibility != models.VisibilityPublic {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+	g.renderImageDetails(w, r, gallery, image, galleryPath, false, true)
+}
+
+// Render a page with the image and what its metadata says about how it
+// was taken. The gallery is at galleryPath, with its images under
+// galleryPath/images/. When transforms is set, there is a form to get a
+// signed link to a transformed copy.
+func (g Galleries) renderImageDetails(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, image *models.Image, galleryPath string, downloads, transforms bool) {
+	var data struct {
+		Title        string
+		GalleryURL   string
+		Filename     string
+		URL          string
+		DownloadURL  string
+		TransformURL string
+		imageSources
+		// The details are empty when the photo doesn't have them
+		Camera       string
+		Lens         string
+		ExposureTime string
+		Aperture     string
+		FocalLength  string
+		ISO          string
+		TakenAt      string
+	}
+	data.Title = gallery.Title
+	data.GalleryURL = galleryPath
+	data.Filename = image.Filename
+	data.URL = galleryPath + "/images/" + image.PublicID
+	data.imageSources = g.imageSources(data.URL, *image)
+	if downloads {
+		data.DownloadURL = data.URL + "?download=true"
+	}
+	if transforms {
+		data.TransformURL = data.URL + "/transform"
+	}
+
+	meta := image.Metadata
+	data.Camera = meta.CameraModel
+	if !strings.HasPrefix(strings.ToLower(meta.CameraModel), strings.ToLower(meta.CameraMake)) {
+		// Most models already start with the make, like Canon EOS R5
+		data.Camera = strings.TrimSpace(meta.CameraMake + " " + meta.CameraModel)
+	}
+	data.Lens = meta.Lens
+	if meta.ExposureTime != "" {
+		data.ExposureTime = meta.ExposureTime + " s"
+	}
+	if meta.FNumber > 0 {
+		// Apertures are shown to one decimal place, like f/2.8 or f/8
+		data.Aperture = "f/" + strconv.FormatFloat(math.Round(meta.FNumber*10)/10, 'f', -1, 64)
+	}
+	if meta.FocalLength > 0 {
+		data.FocalLength = fmt.Sprintf("%.0f mm", meta.FocalLength)
+	}
+	if meta.ISO > 0 {
+		data.ISO = strconv.Itoa(meta.ISO)
+	}
+	if !meta.TakenAt.IsZero() {
+		data.TakenAt = meta.TakenAt.Format("Jan 2, 2006 15:04")
+	}
+	g.Templates.Image.Execute(w, r, data)
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+// How long the signed URLs of transformed images work for
+const transformURLExpiry = 24 * time.Hour
+
+// GET /galleries/{id}/images/{image}/transform?options=rs:fill:300:200/f:webp
+//
+// Sign a transform URL for the image, for anyone who can see the gallery,
+// and redirect to it. The signed URL can be copied and embedded until it
+// expires.
+func (g Galleries) ImageTransformURL(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	image, err := g.imageByID(w, r, gallery, fmt.Sprintf("/galleries/%s/images/", gallery.Slug()))
+	if err != nil {
+		return
+	}
+	opts, err := models.ParseTransformOptions(r.FormValue("options"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	transformURL, err := g.GalleryService.TransformURL(gallery, *image, opts, transformURLExpiry)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, transformURL, http.StatusFound)
+}
+
+// GET /img/{signature}/{options...}/{galleryID}/{imageID}
+//
+// The image transformed by the options, like rs:fill:300:200/f:webp. See
+// models.TransformOptions. The signature is only made for people who can
+// see the gallery, but the gallery is checked again, so URLs stop working
+// for everyone but its members once it is made private or password
+// protected.
+func (g Galleries) TransformImage(w http.ResponseWriter, r *http.Request) {
+	gallery, image, opts, err := g.GalleryService.VerifyTransform(chi.URLParam(r, "signature"), chi.URLParam(r, "*"))
+	if err == nil {
+		err = g.transformVisible(r, gallery)
+	}
+	if err == nil {
+		image, err = g.GalleryService.TransformImage(r.Context(), *image, opts)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrTransformSignature):
+			http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+		case errors.Is(err, models.ErrInvalidTransform):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	// Signed URLs can carry access to private galleries
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	g.serveImage(w, r, image, false)
+}
+
+// Whether transformed images of the gallery can still be sent. Galleries
+// that aren't visible to everyone with the link are only for members, as
+// visitors who unlocked a password protected gallery don't send its
+// unlock cookie here.
+func (g Galleries) transformVisible(r *http.Request, gallery *models.Gallery) error {
+	switch gallery.Visibility {
+	case models.VisibilityUnlisted, models.VisibilityPublic:
+		return nil
+	}
+	role, err := g.galleryRole(r, gallery)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return models.ErrNotFound
+	}
+	return nil
+}
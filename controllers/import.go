@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joncalhoun/lenslocked/context"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+// The configured import providers, in a stable order
+func importProviders(providers map[string]*models.ImportProvider) []oauthProvider {
+	var list []oauthProvider
+	for _, provider := range providers {
+		list = append(list, oauthProvider{
+			Name:        provider.Name,
+			DisplayName: provider.DisplayName,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DisplayName < list[j].DisplayName
+	})
+	return list
+}
+
+// GET /galleries/{id}/import/{provider}?folder=&name=&cursor=
+// Browse the user's files at the provider for photos to import into the
+// gallery
+func (g Galleries) Import(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
+	if err != nil {
+		return
+	}
+	provider, ok := g.ImportProviders[strings.ToLower(chi.URLParam(r, "provider"))]
+	if !ok {
+		http.Error(w, "Invalid import service", http.StatusNotFound)
+		return
+	}
+	type Entry struct {
+		ID   string
+		Name string
+	}
+	var data struct {
+		Slug      string
+		Title     string
+		Provider  oauthProvider
+		Connected bool
+		// Folder is the ID of the folder being browsed, and FolderName
+		// its name. Both are empty at the top.
+		Folder     string
+		FolderName string
+		Folders    []Entry
+		Files      []Entry
+		Cursor     string
+		HasMore    bool
+	}
+	data.Slug = gallery.Slug()
+	data.Title = gallery.Title
+	data.Provider = oauthProvider{
+		Name:        provider.Name,
+		DisplayName: provider.DisplayName,
+	}
+	data.Folder = r.FormValue("folder")
+	data.FolderName = r.FormValue("name")
+
+	user := context.User(r.Context())
+	client, err := g.OAuthTokenService.ImportClient(r.Context(), user.ID, provider)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			g.Templates.Import.Execute(w, r, data)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Connected = true
+
+	folder, err := client.ListFolder(r.Context(), data.Folder, r.FormValue("cursor"))
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, entry := range folder.Entries {
+		switch {
+		case entry.Folder:
+			data.Folders = append(data.Folders, Entry{entry.ID, entry.Name})
+		case g.GalleryService.IsImage(entry.Name):
+			data.Files = append(data.Files, Entry{entry.ID, entry.Name})
+		}
+	}
+	data.Cursor = folder.Cursor
+	data.HasMore = folder.HasMore
+	g.Templates.Import.Execute(w, r, data)
+}
+
+// POST /galleries/{id}/import/{provider}
+// Import the selected photos in the background, since downloading a lot
+// of them can take longer than the user should wait for a page.
+func (g Galleries) ProcessImport(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
+	if err != nil {
+		return
+	}
+	provider, ok := g.ImportProviders[strings.ToLower(chi.URLParam(r, "provider"))]
+	if !ok {
+		http.Error(w, "Invalid import service", http.StatusNotFound)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusBadRequest)
+		return
+	}
+	files := r.PostForm["files"]
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.Slug())
+	if len(files) == 0 {
+		http.Redirect(w, r, editPath, http.StatusFound)
+		return
+	}
+
+	// The request is over long before the import is, so the client can't
+	// use its context
+	ctx := stdcontext.WithoutCancel(r.Context())
+	user := context.User(r.Context())
+	client, err := g.OAuthTokenService.ImportClient(ctx, user.ID, provider)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Redirect(w, r, fmt.Sprintf("/galleries/%s/import/%s", gallery.Slug(), provider.Name), http.StatusFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	imp, err := g.ImportService.Start(gallery.ID, user.ID, provider.Name, files)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrTooManyImportFiles):
+			msg := fmt.Sprintf("Up to %d photos can be imported at once.", g.ImportService.MaxImportFiles())
+			http.Error(w, msg, http.StatusBadRequest)
+		case errors.Is(err, models.ErrImportsRunning):
+			http.Error(w, "Please wait for your other imports to finish.", http.StatusTooManyRequests)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	go func() {
+		// How each file went is recorded for the edit page, so the
+		// details are only logged
+		err := g.ImportService.Run(ctx, imp, client)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
@@ -1,112 +1,191 @@
 package controllers
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/subtle"
 	"fmt"
-	"io"
 	"net/http"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/gorilla/csrf"
+	"github.com/joncalhoun/lenslocked/context"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
 	"golang.org/x/oauth2"
 )
 
+const (
+	CookieOAuthState = "oauth_state"
+)
+
 type OAuth struct {
-	ProviderConfigs map[string]*oauth2.Config
+	Templates struct {
+		Error Template
+	}
+	// Providers are the services users can connect to import photos from,
+	// by name
+	Providers    map[string]*models.ImportProvider
+	TokenService *models.OAuthTokenService
+	StateService *models.OAuthStateService
+	URLs         URLBuilder
 }
 
-// GET /oauth/{provider}/connect
+// GET /oauth/{provider}/connect?return_to=
 func (oa OAuth) Connect(w http.ResponseWriter, r *http.Request) {
-	provider := chi.URLParam(r, "provider")
-	provider = strings.ToLower(provider)
-	config, ok := oa.ProviderConfigs[provider]
+	provider, ok := oa.Providers[strings.ToLower(chi.URLParam(r, "provider"))]
 	if !ok {
 		http.Error(w, "Invalid OAuth2 Service", http.StatusBadRequest)
 		return
 	}
+	returnTo := r.FormValue("return_to")
+	if !isLocalPath(returnTo) {
+		returnTo = "/setting"
+	}
 
-	state := csrf.Token(r)
-	setCookie(w, "oauth_state", state)
-	url := config.AuthCodeURL(
-		state,
-		// TODO: Determine the domain dynamically so this works in production.
-		oauth2.SetAuthURLParam("redirect_uri", redirectURI(r, provider)))
+	user := context.User(r.Context())
+	state, err := oa.StateService.Create(provider.Name, user.ID, false, returnTo)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookieOAuthState, state.Token)
+	opts := append([]oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("redirect_uri", oa.redirectURI(provider.Name)),
+	}, provider.AuthParams...)
+	if provider.PKCE {
+		opts = append(opts, oauth2.S256ChallengeOption(state.CodeVerifier))
+	}
+	url := provider.Config.AuthCodeURL(state.Token, opts...)
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
-func redirectURI(r *http.Request, provider string) string {
-	if r.Host == "localhost:3000" {
-		return fmt.Sprintf("http://localhost:3000/oauth/%s/callback", provider)
-	}
-	return fmt.Sprintf("https://casts.pixeland.com/oauth/%s/callback", provider)
+func (oa OAuth) redirectURI(provider string) string {
+	return oa.URLs.URL("/oauth/" + provider + "/callback")
 }
 
+// GET /oauth/{provider}/callback
 func (oa OAuth) Callback(w http.ResponseWriter, r *http.Request) {
-	provider := chi.URLParam(r, "provider")
-	provider = strings.ToLower(provider)
-	config, ok := oa.ProviderConfigs[provider]
+	provider, ok := oa.Providers[strings.ToLower(chi.URLParam(r, "provider"))]
 	if !ok {
 		http.Error(w, "Invalid OAuth2 Service", http.StatusBadRequest)
 		return
 	}
 
-	state := r.FormValue("state")
-	cookieState, err := readCookie(r, "oauth_state")
-	if err != nil || cookieState != state {
-		if err != nil {
+	user := context.User(r.Context())
+	state, err := consumeOAuthState(w, r, oa.StateService, CookieOAuthState, provider.Name)
+	if err == nil && state.UserID != user.ID {
+		err = fmt.Errorf("oauth state was created for user %d: %w", state.UserID, models.ErrNotFound)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
 			fmt.Println(err)
+			renderOAuthError(w, r, oa.Templates.Error, provider.DisplayName, "/setting", false, true)
+			return
 		}
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if errMsg := r.FormValue("error"); errMsg != "" {
+		// The user said no, or the provider couldn't connect them
+		fmt.Printf("oauth connect %s: %s\n", provider.Name, errMsg)
+		renderOAuthError(w, r, oa.Templates.Error, provider.DisplayName, state.ReturnTo, errMsg == "access_denied", false)
 		return
 	}
-	deleteCookie(w, "oauth_state")
 
-	code := r.FormValue("code")
-	token, err := config.Exchange(
-		r.Context(),
-		code,
-		// Dropbox requires us to also set the redirect_uri here so it can verify the access code
-		oauth2.SetAuthURLParam("redirect_uri", redirectURI(r, provider)))
+	opts := []oauth2.AuthCodeOption{
+		// The redirect_uri must match the one the code was issued for
+		oauth2.SetAuthURLParam("redirect_uri", oa.redirectURI(provider.Name)),
+	}
+	if provider.PKCE {
+		opts = append(opts, oauth2.VerifierOption(state.CodeVerifier))
+	}
+	token, err := provider.Config.Exchange(r.Context(), r.FormValue("code"), opts...)
 	if err != nil {
-		http.Error(w, "Something went wrong", http.StatusBadRequest)
+		fmt.Println(err)
+		renderOAuthError(w, r, oa.Templates.Error, provider.DisplayName, state.ReturnTo, false, false)
 		return
 	}
 
-	// Persist the user's oauth token so we can use it in the future...
-	// For now, we just print it out.
-
-	/**
-	w.Header().Set("Content-Type", "application/json")
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "  ")
-	enc.Encode(token)
-	**/
-	// Let's use the token to see if it works.
-	client := config.Client(r.Context(), token)
-	res, err := client.Post(
-		"https://api.dropboxapi.com/2/files/list_folder",
-		"application/json",
-		strings.NewReader(`{"path": ""}`),
-	)
+	// Persist the user's oauth token so we can use it in the future
+	err = oa.TokenService.Save(user.ID, provider.Name, token)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	defer res.Body.Close()
+	http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+}
+
+// Consume the state of the OAuth flow the callback request finishes. The
+// state the provider sends back must match the one in the cookie, so the
+// flow can only be finished in the browser that started it. Returns
+// models.ErrNotFound if there is no such flow, it was already finished, or
+// it has expired.
+func consumeOAuthState(w http.ResponseWriter, r *http.Request, service *models.OAuthStateService, cookieName, provider string) (*models.OAuthState, error) {
+	token, err := readCookie(r, cookieName)
+	if err != nil {
+		return nil, fmt.Errorf("consume oauth state: %w", models.ErrNotFound)
+	}
+	deleteCookie(w, cookieName)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(r.FormValue("state"))) != 1 {
+		return nil, fmt.Errorf("consume oauth state: state doesn't match cookie: %w", models.ErrNotFound)
+	}
+	return service.Consume(provider, token)
+}
 
-	unpretty, err := io.ReadAll(res.Body)
+// Explain why an OAuth flow with the provider didn't finish, rather than
+// showing a bare error. denied is set when the user said no at the
+// provider, and expired when the flow's state couldn't be used.
+func renderOAuthError(w http.ResponseWriter, r *http.Request, tpl Template, provider, returnTo string, denied, expired bool) {
+	var data struct {
+		Provider string
+		ReturnTo string
+		Denied   bool
+		Expired  bool
+	}
+	data.Provider = provider
+	data.ReturnTo = returnTo
+	data.Denied = denied
+	data.Expired = expired
+	tpl.Execute(w, r, data)
+}
+
+// POST /oauth/{provider}/disconnect
+func (oa OAuth) Disconnect(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oa.Providers[strings.ToLower(chi.URLParam(r, "provider"))]
+	if !ok {
+		http.Error(w, "Invalid OAuth2 Service", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	tokenSource, err := oa.TokenService.TokenSource(r.Context(), user.ID, provider.Name, provider.Config)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if errors.Is(err, models.ErrNotFound) {
+			http.Redirect(w, r, "/setting", http.StatusFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	var pretty bytes.Buffer
-	err = json.Indent(&pretty, unpretty, "", "  ")
+	// Revoke the token so it's useless even if a copy is lying around.
+	// Don't keep the user connected just because the provider can't be
+	// reached though.
+	if provider.Revoke != nil {
+		token, err := tokenSource.Token()
+		if err == nil {
+			err = provider.Revoke(r.Context(), token)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	err = oa.TokenService.Delete(user.ID, provider.Name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	pretty.WriteTo(w)
+	http.Redirect(w, r, "/setting", http.StatusFound)
 }
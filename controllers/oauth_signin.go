@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-chi/chi/v5"
+	"github.com/joncalhoun/lenslocked/context"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+	"golang.org/x/oauth2"
+)
+
+const (
+	CookieOAuthSignInState = "oauth_signin_state"
+)
+
+// oauthProvider is what templates need to show a "Sign in with" button
+type oauthProvider struct {
+	Name        string
+	DisplayName string
+}
+
+// The configured identity providers, in a stable order
+func (u Users) oauthProviders() []oauthProvider {
+	var providers []oauthProvider
+	for _, provider := range u.OAuthProviders {
+		providers = append(providers, oauthProvider{
+			Name:        provider.Name,
+			DisplayName: provider.DisplayName,
+		})
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].DisplayName < providers[j].DisplayName
+	})
+	return providers
+}
+
+// GET /signin/oauth/{provider}
+func (u Users) ProcessOAuthSignIn(w http.ResponseWriter, r *http.Request) {
+	u.startOAuth(w, r, false)
+}
+
+// POST /setting/identities/{provider}/link
+func (u Users) ProcessOAuthLink(w http.ResponseWriter, r *http.Request) {
+	u.startOAuth(w, r, true)
+}
+
+// Send the user to the provider to sign in. A local return_to path is
+// where they end up once they have.
+func (u Users) startOAuth(w http.ResponseWriter, r *http.Request, link bool) {
+	provider, ok := u.OAuthProviders[strings.ToLower(chi.URLParam(r, "provider"))]
+	if !ok {
+		http.Error(w, "Invalid OAuth2 Service", http.StatusBadRequest)
+		return
+	}
+	returnTo := r.FormValue("return_to")
+	if !isLocalPath(returnTo) {
+		returnTo = ""
+	}
+	userID := 0
+	if link {
+		userID = context.User(r.Context()).ID
+	}
+	state, err := u.OAuthStateService.Create(provider.Name, userID, link, returnTo)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookieOAuthSignInState, state.Token)
+	opts := []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("redirect_uri", u.signInRedirectURI(provider.Name)),
+	}
+	if provider.Verifier != nil {
+		opts = append(opts, oidc.Nonce(state.Nonce))
+	}
+	if provider.PKCE {
+		opts = append(opts, oauth2.S256ChallengeOption(state.CodeVerifier))
+	}
+	url := provider.Config.AuthCodeURL(state.Token, opts...)
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+func (u Users) signInRedirectURI(provider string) string {
+	return u.URLs.URL("/signin/oauth/" + provider + "/callback")
+}
+
+// GET /signin/oauth/{provider}/callback
+func (u Users) OAuthSignInCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := u.OAuthProviders[strings.ToLower(chi.URLParam(r, "provider"))]
+	if !ok {
+		http.Error(w, "Invalid OAuth2 Service", http.StatusBadRequest)
+		return
+	}
+
+	user := context.User(r.Context())
+	state, err := consumeOAuthState(w, r, u.OAuthStateService, CookieOAuthSignInState, provider.Name)
+	if err == nil && state.Link && (user == nil || user.ID != state.UserID) {
+		err = fmt.Errorf("oauth state was created for user %d: %w", state.UserID, models.ErrNotFound)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+			renderOAuthError(w, r, u.Templates.OAuthError, provider.DisplayName, "/signin", false, true)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	returnTo := state.ReturnTo
+	if returnTo == "" {
+		returnTo = "/galleries"
+		if state.Link {
+			returnTo = "/setting"
+		}
+	}
+
+	if errMsg := r.FormValue("error"); errMsg != "" {
+		// The user said no, or the provider couldn't sign them in
+		fmt.Printf("oauth sign in %s: %s\n", provider.Name, errMsg)
+		back := "/signin"
+		if state.Link {
+			back = returnTo
+		}
+		renderOAuthError(w, r, u.Templates.OAuthError, provider.DisplayName, back, errMsg == "access_denied", false)
+		return
+	}
+
+	opts := []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("redirect_uri", u.signInRedirectURI(provider.Name)),
+	}
+	if provider.PKCE {
+		opts = append(opts, oauth2.VerifierOption(state.CodeVerifier))
+	}
+	token, err := provider.Config.Exchange(r.Context(), r.FormValue("code"), opts...)
+	if err != nil {
+		fmt.Println(err)
+		renderOAuthError(w, r, u.Templates.OAuthError, provider.DisplayName, "/signin", false, false)
+		return
+	}
+	claims, err := provider.Claims(r.Context(), token, state.Nonce)
+	if err != nil {
+		fmt.Println(err)
+		renderOAuthError(w, r, u.Templates.OAuthError, provider.DisplayName, "/signin", false, false)
+		return
+	}
+
+	if state.Link {
+		u.linkIdentity(w, r, provider, claims, returnTo)
+		return
+	}
+	user, err = u.OAuthIdentityService.SignIn(provider.Name, *claims)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailNotVerified) {
+			var data struct {
+				Email     string
+				Providers []oauthProvider
+			}
+			data.Providers = u.oauthProviders()
+			err = errors.Public(err, fmt.Sprintf("Your %s account doesn't have a verified email address. Verify it with %s and try again.", provider.DisplayName, provider.DisplayName))
+			u.Templates.SignIn.Execute(w, r, data, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// Accounts with two-factor authentication still need their code
+	u.signInTo(w, r, user, false, returnTo)
+}
+
+// Link the identity to the current user
+func (u Users) linkIdentity(w http.ResponseWriter, r *http.Request, provider *models.OAuthProvider, claims *models.OAuthClaims, returnTo string) {
+	user := context.User(r.Context())
+	err := u.OAuthIdentityService.Link(user.ID, provider.Name, *claims)
+	if err != nil {
+		if errors.Is(err, models.ErrIdentityTaken) {
+			u.renderSetting(w, r, errors.Public(err, fmt.Sprintf("That %s account is already linked to another Lenslocked account.", provider.DisplayName)))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// POST /setting/identities/{id}/delete
+func (u Users) ProcessOAuthUnlink(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	err = u.OAuthIdentityService.Unlink(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Linked account not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrLastSignInMethod):
+			u.renderSetting(w, r, errors.Public(err, "This is the only way you can sign in. Set a password or add a passkey before removing it."))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, "/setting", http.StatusFound)
+}
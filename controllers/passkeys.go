@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joncalhoun/lenslocked/context"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+const (
+	CookiePasskeyCeremony = "passkey_ceremony"
+)
+
+// Start registering a passkey. Responds with the options for
+// navigator.credentials.create.
+func (u Users) ProcessPasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	ceremony, err := u.PasskeyService.BeginRegistration(user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookiePasskeyCeremony, ceremony.Token)
+	writeJSON(w, ceremony.Options)
+}
+
+// Store the passkey created by the browser
+func (u Users) ProcessPasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookiePasskeyCeremony)
+	if err != nil {
+		http.Error(w, "Passkey registration was not started", http.StatusBadRequest)
+		return
+	}
+	deleteCookie(w, CookiePasskeyCeremony)
+	user := context.User(r.Context())
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "Passkey"
+	}
+	_, err = u.PasskeyService.FinishRegistration(user, token, name, r.Body)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Unable to register passkey", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"redirect": "/setting"})
+}
+
+// Remove one of the current user's passkeys
+func (u Users) ProcessPasskeyDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	err = u.PasskeyService.Delete(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, models.ErrLastSignInMethod) {
+			u.renderSetting(w, r, errors.Public(err, "This is the only way you can sign in. Set a password or link another account before removing it."))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/setting", http.StatusFound)
+}
+
+// Start a passwordless sign in. Responds with the options for
+// navigator.credentials.get.
+func (u Users) ProcessPasskeySignInBegin(w http.ResponseWriter, r *http.Request) {
+	ceremony, err := u.PasskeyService.BeginLogin()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookiePasskeyCeremony, ceremony.Token)
+	writeJSON(w, ceremony.Options)
+}
+
+// Verify the passkey assertion and sign the user in. Passkeys require
+// user verification on the device, so no second factor is asked for.
+func (u Users) ProcessPasskeySignInFinish(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookiePasskeyCeremony)
+	if err != nil {
+		http.Error(w, "Passkey sign in was not started", http.StatusBadRequest)
+		return
+	}
+	deleteCookie(w, CookiePasskeyCeremony)
+	user, err := u.PasskeyService.FinishLogin(token, r.Body)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Unable to sign in with that passkey", http.StatusUnauthorized)
+		return
+	}
+	session, err := u.SessionService.Create(user.ID, device(r), false)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, session)
+	writeJSON(w, map[string]string{"redirect": "/galleries"})
+}
+
+// Write v as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
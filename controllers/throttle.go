@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+)
+
+// Rate limiter keys. Sign in failures are counted both per client and per
+// account, so one attacker can't try many accounts and many attackers
+// can't gang up on one account.
+func signInIPKey(r *http.Request) string {
+	return "signin:ip:" + device(r).IPAddress
+}
+
+func signInAccountKey(email string) string {
+	return "signin:account:" + strings.ToLower(email)
+}
+
+func forgotPasswordIPKey(r *http.Request) string {
+	return "forgot-pw:ip:" + device(r).IPAddress
+}
+
+func forgotPasswordAccountKey(email string) string {
+	return "forgot-pw:account:" + strings.ToLower(email)
+}
+
+func resetPasswordIPKey(r *http.Request) string {
+	return "reset-pw:ip:" + device(r).IPAddress
+}
+
+// Render the "too many attempts" page when any of the keys needs to wait.
+// Returns true if the request was handled.
+func (u Users) throttled(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	wait, err := u.Throttle.Wait(keys...)
+	if err != nil {
+		// Don't lock everyone out because the limiter is unavailable
+		fmt.Println(err)
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+	var data struct {
+		RetryAfter string
+	}
+	data.RetryAfter = humanizeWait(wait)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	u.Templates.TooManyAttempts.Execute(w, r, data)
+	return true
+}
+
+// Record a failed sign in, locking the account and emailing its owner an
+// unlock link once it has had too many.
+func (u Users) failSignIn(r *http.Request, email string) {
+	_, err := u.Throttle.Fail(signInIPKey(r))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	failures, err := u.Throttle.Fail(signInAccountKey(email))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !u.Throttle.ShouldLock(failures) {
+		return
+	}
+	user, err := u.UserService.Lock(email, u.Throttle.LockedUntil())
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+		}
+		return
+	}
+	unlock, err := u.AccountUnlockService.Create(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	vals := url.Values{
+		"token": {unlock.Token},
+	}
+	unlockURL := u.URLs.URL("/unlock?" + vals.Encode())
+	err = u.EmailService.UnlockAccount(user.Email, unlockURL)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Unlock an account from the link in the lockout email
+func (u Users) ProcessUnlock(w http.ResponseWriter, r *http.Request) {
+	user, err := u.AccountUnlockService.Consume(r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrTokenInvalid) || errors.Is(err, models.ErrTokenExpired) {
+			http.Error(w, "This unlock link is invalid or has expired.", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.UserService.Unlock(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.Throttle.Reset(signInAccountKey(user.Email))
+	if err != nil {
+		fmt.Println(err)
+	}
+	vals := url.Values{
+		"email": {user.Email},
+	}
+	http.Redirect(w, r, "/signin?"+vals.Encode(), http.StatusFound)
+}
+
+// Describe a wait in words for the "too many attempts" page
+func humanizeWait(wait time.Duration) string {
+	switch {
+	case wait < time.Minute:
+		seconds := int(math.Ceil(wait.Seconds()))
+		if seconds == 1 {
+			return "1 second"
+		}
+		return fmt.Sprintf("%d seconds", seconds)
+	default:
+		minutes := int(math.Ceil(wait.Minutes()))
+		if minutes == 1 {
+			return "1 minute"
+		}
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+}
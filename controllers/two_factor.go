@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/joncalhoun/lenslocked/context"
+	"github.com/joncalhoun/lenslocked/errors"
+	"github.com/joncalhoun/lenslocked/models"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	CookieSignInChallenge = "signin_challenge"
+)
+
+// Finish signing in a user whose password has been verified. Users with
+// two-factor authentication enabled are sent to enter their code first.
+func (u Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User, persistent bool) {
+	u.signInTo(w, r, user, persistent, "/galleries")
+}
+
+// signInTo is signIn, sending the user to returnTo once they're signed in.
+// Users with two-factor authentication end up at their galleries after
+// entering their code, as usual.
+//
+// The account's sign in failures are only forgotten once every factor has
+// passed. Until then wrong codes count against the account like wrong
+// passwords, and no new challenge is handed out while it is throttled, so
+// knowing the password doesn't allow guessing codes without limit.
+func (u Users) signInTo(w http.ResponseWriter, r *http.Request, user *models.User, persistent bool, returnTo string) {
+	enabled, err := u.TOTPService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		if u.throttled(w, r, signInIPKey(r), signInAccountKey(user.Email)) {
+			return
+		}
+		challenge, err := u.SignInChallengeService.Create(user.ID, persistent)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, CookieSignInChallenge, challenge.Token)
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return
+	}
+
+	err = u.Throttle.Reset(signInAccountKey(user.Email))
+	if err != nil {
+		fmt.Println(err)
+	}
+	session, err := u.SessionService.Create(user.ID, device(r), persistent)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, session)
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// Render the form asking for the second factor
+func (u Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	_, err := readCookie(r, CookieSignInChallenge)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	u.Templates.TwoFactor.Execute(w, r, nil)
+}
+
+// Check the second factor and sign the user in
+func (u Users) ProcessTwoFactor(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookieSignInChallenge)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	challenge, err := u.SignInChallengeService.Find(token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			// Expired or too many wrong codes; start over.
+			deleteCookie(w, CookieSignInChallenge)
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if u.throttled(w, r, signInIPKey(r), signInAccountKey(challenge.Email)) {
+		return
+	}
+
+	err = u.TOTPService.Verify(challenge.UserID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			err = u.SignInChallengeService.Fail(challenge.ID)
+			if err != nil {
+				fmt.Println(err)
+			}
+			u.failSignIn(r, challenge.Email)
+			err = errors.Public(models.ErrInvalidCode, "That code didn't work. Please try again.")
+		}
+		u.Templates.TwoFactor.Execute(w, r, nil, err)
+		return
+	}
+
+	err = u.SignInChallengeService.Delete(challenge.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = u.Throttle.Reset(signInAccountKey(challenge.Email))
+	if err != nil {
+		fmt.Println(err)
+	}
+	deleteCookie(w, CookieSignInChallenge)
+	session, err := u.SessionService.Create(challenge.UserID, device(r), challenge.Persistent)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, session)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// Start setting up two-factor authentication and show the QR code
+func (u Users) ProcessTwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	enrollment, err := u.TOTPService.Enroll(user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderTwoFactorSetup(w, r, enrollment)
+}
+
+// Confirm the authenticator app works and show the recovery codes
+func (u Users) ProcessTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	codes, err := u.TOTPService.Confirm(user.ID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Redirect(w, r, "/setting", http.StatusFound)
+			return
+		}
+		if !errors.Is(err, models.ErrInvalidCode) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		enrollment, err := u.TOTPService.Pending(user)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		err = errors.Public(models.ErrInvalidCode, "That code didn't work. Check the time on your device and try again.")
+		u.renderTwoFactorSetup(w, r, enrollment, err)
+		return
+	}
+
+	var data struct {
+		RecoveryCodes []string
+	}
+	data.RecoveryCodes = codes
+	u.Templates.RecoveryCodes.Execute(w, r, data)
+}
+
+// Turn off two-factor authentication after checking a current code
+func (u Users) ProcessTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.TOTPService.Verify(user.ID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			http.Error(w, "Invalid two-factor code", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.TOTPService.Disable(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/setting", http.StatusFound)
+}
+
+func (u Users) renderTwoFactorSetup(w http.ResponseWriter, r *http.Request, enrollment *models.TOTPEnrollment, errs ...error) {
+	var data struct {
+		Secret string
+		URI    string
+		QRCode template.URL
+	}
+	data.Secret = enrollment.Secret
+	data.URI = enrollment.URI
+	png, err := qrcode.Encode(enrollment.URI, qrcode.Medium, 256)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	u.Templates.TwoFactorSetup.Execute(w, r, data, errs...)
+}
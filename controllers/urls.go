@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// URLBuilder builds the absolute URLs we put in emails and hand to OAuth
+// providers. They are never worked out from requests, as that would let
+// the Host header decide where links in emails point.
+type URLBuilder struct {
+	// BaseURL is the site's public URL, e.g. "https://www.lenslocked.com".
+	// It must be set.
+	BaseURL string
+}
+
+// Base returns the base URL, without a trailing slash
+func (b URLBuilder) Base() string {
+	return strings.TrimSuffix(b.BaseURL, "/")
+}
+
+// URL returns the absolute URL for the path, which may include a query
+func (b URLBuilder) URL(path string) string {
+	return b.Base() + path
+}
+
+// Whether path is a path on this site, and not a URL that browsers would
+// take to another one, like "//evil.com" or "/\evil.com"
+func isLocalPath(path string) bool {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return false
+	}
+	for _, c := range path {
+		// Browsers treat backslashes like slashes, and ignore tabs and
+		// newlines
+		if c == '\\' || c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// TrustProxy takes the client's address, and the scheme and host they
+// used, from the X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host
+// headers. Only use it behind a proxy that always sets them, otherwise
+// clients can claim to be anyone.
+func TrustProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			// Clients can send their own header, which the proxy appends
+			// to, so only the last address can be trusted
+			addrs := strings.Split(forwardedFor, ",")
+			ip := strings.TrimSpace(addrs[len(addrs)-1])
+			if net.ParseIP(ip) != nil {
+				r.RemoteAddr = net.JoinHostPort(ip, "0")
+			}
+		}
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			r.URL.Scheme = proto
+		}
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+		if r.URL.Scheme != "" {
+			// Make the URL absolute, so the CSRF middleware can check the
+			// Referer of HTTPS requests against it
+			r.URL.Host = r.Host
+		}
+		next.ServeHTTP(w, r)
+	})
+}
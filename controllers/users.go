@@ -2,9 +2,13 @@ package controllers
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/joncalhoun/lenslocked/context"
 	"github.com/joncalhoun/lenslocked/errors"
 	"github.com/joncalhoun/lenslocked/models"
@@ -21,12 +25,36 @@ type Users struct {
 		Setting               Template
 		EmailUpdateSuccess    Template
 		PasswordChangeSuccess Template
+		TwoFactor             Template
+		TwoFactorSetup        Template
+		RecoveryCodes         Template
+		TooManyAttempts       Template
+		VerifyEmail           Template
+		EmailChangeCancelled  Template
+		ResetLinkExpired      Template
+		OAuthError            Template
 	}
-	UserService          *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
-	EmailService         *models.EmailService
-	EmailResetService    *models.EmailResetService
+	UserService              *models.UserService
+	SessionService           *models.SessionService
+	PasswordResetService     *models.PasswordResetService
+	EmailService             *models.EmailService
+	EmailResetService        *models.EmailResetService
+	TOTPService              *models.TOTPService
+	SignInChallengeService   *models.SignInChallengeService
+	PasskeyService           *models.PasskeyService
+	AccountUnlockService     *models.AccountUnlockService
+	Throttle                 *models.Throttle
+	EmailVerificationService *models.EmailVerificationService
+	OAuthIdentityService     *models.OAuthIdentityService
+	// OAuthProviders are the identity providers users can sign in with,
+	// by name
+	OAuthProviders    map[string]*models.OAuthProvider
+	OAuthTokenService *models.OAuthTokenService
+	OAuthStateService *models.OAuthStateService
+	// ImportProviders are the services users can connect to import photos
+	// from, by name
+	ImportProviders map[string]*models.ImportProvider
+	URLs            URLBuilder
 }
 
 // User middleware
@@ -37,18 +65,22 @@ type UserMiddleWare struct {
 // Render sign up form
 func (u Users) SignUp(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Email string
+		Email     string
+		Providers []oauthProvider
 	}
 	data.Email = r.FormValue("email")
+	data.Providers = u.oauthProviders()
 	u.Templates.SignUp.Execute(w, r, data)
 }
 
 // Render sign in form
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Email string
+		Email     string
+		Providers []oauthProvider
 	}
 	data.Email = r.FormValue("email")
+	data.Providers = u.oauthProviders()
 	u.Templates.SignIn.Execute(w, r, data)
 }
 
@@ -56,11 +88,13 @@ func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
 func (u Users) ProcessSignUp(w http.ResponseWriter, r *http.Request) {
 	//Create a new user
 	var data struct {
-		Email    string
-		Password string
+		Email     string
+		Password  string
+		Providers []oauthProvider
 	}
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
+	data.Providers = u.oauthProviders()
 	user, err := u.UserService.Create(data.Email, data.Password)
 	if err != nil {
 		if errors.Is(err, models.ErrEmailTaken) {
@@ -69,9 +103,15 @@ func (u Users) ProcessSignUp(w http.ResponseWriter, r *http.Request) {
 		u.Templates.SignUp.Execute(w, r, data, err)
 		return
 	}
+	// The user can still sign in and look around without verifying, so
+	// failing to send the email shouldn't stop the sign up.
+	err = u.sendVerification(r, user)
+	if err != nil {
+		fmt.Println(err)
+	}
 
 	//Create a new session for the user
-	session, err := u.SessionService.Create(user.ID)
+	session, err := u.SessionService.Create(user.ID, device(r), false)
 	if err != nil {
 		fmt.Println(err)
 		// TODO: Show a warning message about not being able to sign the user in
@@ -80,7 +120,7 @@ func (u Users) ProcessSignUp(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Set session cookie and redirect to user's home page
-	setCookie(w, CookieSession, session.Token)
+	setSessionCookie(w, session)
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
@@ -88,29 +128,32 @@ func (u Users) ProcessSignUp(w http.ResponseWriter, r *http.Request) {
 func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	//Authenticate the user
 	var data struct {
-		Email    string
-		Password string
+		Email     string
+		Password  string
+		Remember  bool
+		Providers []oauthProvider
 	}
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
-	user, err := u.UserService.Authenticate(data.Email, data.Password)
-	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	data.Remember = r.FormValue("remember") == "true"
+	data.Providers = u.oauthProviders()
+	if u.throttled(w, r, signInIPKey(r), signInAccountKey(data.Email)) {
 		return
 	}
-
-	//Create a session for the user
-	session, err := u.SessionService.Create(user.ID)
+	user, err := u.UserService.Authenticate(data.Email, data.Password)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, models.ErrAccountLocked):
+			err = errors.Public(err, "This account has been temporarily locked after too many failed sign in attempts. Check your email for a link to unlock it.")
+		case errors.Is(err, models.ErrInvalidCredentials):
+			u.failSignIn(r, data.Email)
+			err = errors.Public(err, "Invalid email or password.")
+		}
+		u.Templates.SignIn.Execute(w, r, data, err)
 		return
 	}
-
-	//Set session cookie and redirect to user's homepage
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+	//Create a session for the user, or ask for their second factor
+	u.signIn(w, r, user, data.Remember)
 }
 
 // Render current user's home page.
@@ -140,6 +183,18 @@ func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/signin", http.StatusFound)
 }
 
+// Describe the client making the request so it can be shown in the device list
+func device(r *http.Request) models.Device {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return models.Device{
+		IPAddress: ip,
+		UserAgent: r.UserAgent(),
+	}
+}
+
 // Set user in request context
 func (userMw UserMiddleWare) SetUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -148,11 +203,16 @@ func (userMw UserMiddleWare) SetUser(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		user, err := userMw.SessionService.User(token)
+		session, user, err := userMw.SessionService.Lookup(token)
 		if err != nil {
 			next.ServeHTTP(w, r)
 			return
 		}
+		// Keep the browser's copy of a remembered session alive as long
+		// as the session itself.
+		if session.Renewed && session.Persistent {
+			setPersistentCookie(w, CookieSession, token, session.ExpiresAt)
+		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
 		r = r.WithContext(ctx)
@@ -181,42 +241,63 @@ func (u Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	u.Templates.ForgotPassword.Execute(w, r, data)
 }
 
-// Process the forgot password page
+// Process the forgot password page. The response is the same whether or
+// not an account exists for the email, and the lookup and email happen in
+// the background so the timing doesn't give it away either.
 func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email string
 	}
 	data.Email = r.FormValue("email")
-	pwReset, err := u.PasswordResetService.Create(data.Email)
+	// Every request sends an email, so they are all counted
+	ipKey, accountKey := forgotPasswordIPKey(r), forgotPasswordAccountKey(data.Email)
+	if u.throttled(w, r, ipKey, accountKey) {
+		return
+	}
+	_, err := u.Throttle.Fail(ipKey, accountKey)
 	if err != nil {
-		// TODO: Handle other cases in the future. For instance,
-		// if a user doesn't exist with the email address.
 		fmt.Println(err)
-		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+	}
+	go u.sendPasswordReset(u.URLs.Base(), data.Email)
+
+	u.Templates.CheckYourEmail.Execute(w, r, data)
+}
+
+// Email a password reset link if there is an account for the email. The
+// link is to baseURL, since this runs after the request is over.
+func (u Users) sendPasswordReset(baseURL, email string) {
+	pwReset, err := u.PasswordResetService.Create(email)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+		}
 		return
 	}
 
 	vals := url.Values{
 		"token": {pwReset.Token},
 	}
-	// TODO: Make the URL here configurable
-	resetURL := "https://www.lenslocked.com/reset-pw?" + vals.Encode()
-	err = u.EmailService.ForgotPassword(data.Email, resetURL)
+	resetURL := baseURL + "/reset-pw?" + vals.Encode()
+	err = u.EmailService.ForgotPassword(email, resetURL)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
-		return
 	}
-
-	u.Templates.CheckYourEmail.Execute(w, r, data)
 }
 
-// Render reset password form
+// Render reset password form, or explain that the link can't be used
+// any more
 func (u Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Token string
 	}
 	data.Token = r.FormValue("token")
+	if data.Token != "" {
+		_, err := u.PasswordResetService.Check(data.Token)
+		if err != nil {
+			u.resetLinkExpired(w, r, err)
+			return
+		}
+	}
 	u.Templates.ResetPassword.Execute(w, r, data)
 }
 
@@ -228,14 +309,37 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	}
 	data.Token = r.FormValue("token")
 	data.Password = r.FormValue("password")
+	if u.throttled(w, r, resetPasswordIPKey(r)) {
+		return
+	}
 
-	user, err := u.PasswordResetService.Consume(data.Token)
+	user, err := u.PasswordResetService.Check(data.Token)
 	if err != nil {
+		_, failErr := u.Throttle.Fail(resetPasswordIPKey(r))
+		if failErr != nil {
+			fmt.Println(failErr)
+		}
+		u.resetLinkExpired(w, r, err)
+		return
+	}
+	// Check the password before using up the token so the user can try
+	// another one.
+	err = u.UserService.CheckPassword(user.ID, data.Password)
+	if err != nil {
+		if errors.Is(err, models.ErrWeakPassword) {
+			data.Password = ""
+			u.Templates.ResetPassword.Execute(w, r, data, err)
+			return
+		}
 		fmt.Println(err)
-		// TODO: Distinguish between server errors and invalid token errors.
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
+	user, err = u.PasswordResetService.Consume(data.Token)
+	if err != nil {
+		u.resetLinkExpired(w, r, err)
+		return
+	}
 	// Update the user's password.
 	err = u.UserService.UpdatePassword(user.ID, data.Password)
 	if err != nil {
@@ -243,26 +347,234 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
-	// Sign the user in now that they have reset their password.
-	// Any errors from this point onward should redirect to the sign in page.
-	session, err := u.SessionService.Create(user.ID)
+	// Whoever knew the old password may still be signed in somewhere.
+	err = u.SessionService.RevokeAll(user.ID)
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/signin", http.StatusFound)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+	// Sign the user in now that they have reset their password.
+	u.signIn(w, r, user, false)
+}
+
+// Render the "link expired" page for unusable reset tokens, or a server
+// error for anything else
+func (u Users) resetLinkExpired(w http.ResponseWriter, r *http.Request, err error) {
+	var data struct {
+		Expired bool
+	}
+	switch {
+	case errors.Is(err, models.ErrTokenExpired):
+		data.Expired = true
+	case errors.Is(err, models.ErrTokenInvalid):
+	default:
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	u.Templates.ResetLinkExpired.Execute(w, r, data)
 }
 
 // Render setting's page
 func (u Users) RenderSetting(w http.ResponseWriter, r *http.Request) {
+	u.renderSetting(w, r)
+}
+
+// Render setting's page along with any errors from a form on it
+func (u Users) renderSetting(w http.ResponseWriter, r *http.Request, errs ...error) {
+	type Session struct {
+		ID         int
+		Current    bool
+		IPAddress  string
+		UserAgent  string
+		CreatedAt  string
+		LastSeenAt string
+	}
+	type Passkey struct {
+		ID         int
+		Name       string
+		CreatedAt  string
+		LastUsedAt string
+	}
+	type Connection struct {
+		Provider    string
+		Name        string
+		ConnectedAt string
+	}
+	type Identity struct {
+		ID        int
+		Provider  string
+		Email     string
+		CreatedAt string
+	}
 	var data struct {
-		Email string
+		Email            string
+		HasPassword      bool
+		TwoFactorEnabled bool
+		Passkeys         []Passkey
+		Identities       []Identity
+		// Providers the user hasn't linked an identity from yet
+		LinkProviders []oauthProvider
+		Connections   []Connection
+		// Services the user hasn't connected yet
+		ConnectServices []Connection
+		Sessions        []Session
 	}
 	user := context.User(r.Context())
 	data.Email = user.Email
-	u.Templates.Setting.Execute(w, r, data)
+	data.HasPassword = user.HasPassword()
+
+	enabled, err := u.TOTPService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.TwoFactorEnabled = enabled
+
+	passkeys, err := u.PasskeyService.List(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, passkey := range passkeys {
+		lastUsedAt := "Never"
+		if passkey.LastUsedAt != nil {
+			lastUsedAt = passkey.LastUsedAt.Format("Jan 2, 2006 15:04")
+		}
+		data.Passkeys = append(data.Passkeys, Passkey{
+			ID:         passkey.ID,
+			Name:       passkey.Name,
+			CreatedAt:  passkey.CreatedAt.Format("Jan 2, 2006 15:04"),
+			LastUsedAt: lastUsedAt,
+		})
+	}
+
+	identities, err := u.OAuthIdentityService.List(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	linked := make(map[string]bool)
+	for _, identity := range identities {
+		linked[identity.Provider] = true
+		name := identity.Provider
+		if provider, ok := u.OAuthProviders[identity.Provider]; ok {
+			name = provider.DisplayName
+		}
+		data.Identities = append(data.Identities, Identity{
+			ID:        identity.ID,
+			Provider:  name,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt.Format("Jan 2, 2006 15:04"),
+		})
+	}
+	for _, provider := range u.oauthProviders() {
+		if !linked[provider.Name] {
+			data.LinkProviders = append(data.LinkProviders, provider)
+		}
+	}
+
+	connections, err := u.OAuthTokenService.List(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	connected := make(map[string]bool)
+	for _, connection := range connections {
+		connected[connection.Provider] = true
+		data.Connections = append(data.Connections, Connection{
+			Provider:    connection.Provider,
+			Name:        u.serviceName(connection.Provider),
+			ConnectedAt: connection.CreatedAt.Format("Jan 2, 2006 15:04"),
+		})
+	}
+	for _, provider := range importProviders(u.ImportProviders) {
+		if !connected[provider.Name] {
+			data.ConnectServices = append(data.ConnectServices, Connection{
+				Provider: provider.Name,
+				Name:     provider.DisplayName,
+			})
+		}
+	}
+
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	sessions, err := u.SessionService.List(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, Session{
+			ID:         session.ID,
+			Current:    session.Current,
+			IPAddress:  session.IPAddress,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt.Format("Jan 2, 2006 15:04"),
+			LastSeenAt: session.LastSeenAt.Format("Jan 2, 2006 15:04"),
+		})
+	}
+	u.Templates.Setting.Execute(w, r, data, errs...)
+}
+
+// The name of a connectable service as it's shown to users, e.g. "Dropbox"
+func (u Users) serviceName(service string) string {
+	if provider, ok := u.ImportProviders[service]; ok {
+		return provider.DisplayName
+	}
+	if service == "" {
+		return service
+	}
+	return strings.ToUpper(service[:1]) + service[1:]
+}
+
+// Sign out a single device of the current user
+func (u Users) ProcessRevokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	err = u.SessionService.Revoke(user.ID, sessionID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/setting", http.StatusFound)
+}
+
+// Sign out every device of the current user except this one
+func (u Users) ProcessRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	user := context.User(r.Context())
+	err = u.SessionService.RevokeAllExcept(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/setting", http.StatusFound)
 }
 
 // Process password update when signed in
@@ -274,6 +586,10 @@ func (u Users) ProcessUpdatePassword(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
 	err := u.UserService.UpdatePassword(user.ID, data.Password)
 	if err != nil {
+		if errors.Is(err, models.ErrWeakPassword) {
+			u.renderSetting(w, r, err)
+			return
+		}
 		fmt.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
@@ -281,29 +597,42 @@ func (u Users) ProcessUpdatePassword(w http.ResponseWriter, r *http.Request) {
 	u.Templates.PasswordChangeSuccess.Execute(w, r, data)
 }
 
-// Send email-reset email to the new email account and redirect to a email-sent confirmation page
+// Send email-reset email to the new email account, let the old one know
+// how to cancel the change, and redirect to a email-sent confirmation page
 func (u Users) ProcessUpdateEmail(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email string
 	}
 	data.Email = r.FormValue("email")
 	user := context.User(r.Context())
-	emailReset, err := u.EmailResetService.Create(user.ID)
+	emailReset, err := u.EmailResetService.Create(user.ID, data.Email)
 	if err != nil {
-		// TODO: Handle other cases in the future. For instance,
-		// if a user doesn't exist with the email address.
+		if errors.Is(err, models.ErrEmailTaken) {
+			u.renderSetting(w, r, errors.Public(err, "That email address is already associated with an account."))
+			return
+		}
 		fmt.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
+	data.Email = emailReset.NewEmail
 
 	vals := url.Values{
 		"token": {emailReset.Token},
-		"email": {data.Email},
 	}
-	// TODO: Make the URL here configurable
-	resetURL := "https://www.lenslocked.com/setting/reset-email?" + vals.Encode()
-	err = u.EmailService.SendUpdateEmail(data.Email, resetURL)
+	resetURL := u.URLs.URL("/setting/reset-email?" + vals.Encode())
+	err = u.EmailService.SendUpdateEmail(emailReset.NewEmail, resetURL)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	vals = url.Values{
+		"token": {emailReset.CancelToken},
+	}
+	cancelURL := u.URLs.URL("/cancel-email-change?" + vals.Encode())
+	err = u.EmailService.EmailChangeRequested(user.Email, emailReset.NewEmail, cancelURL)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
@@ -314,25 +643,36 @@ func (u Users) ProcessUpdateEmail(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// Process email reset after user clicks on the reset link
+// Process email reset after user clicks on the reset link. The new address
+// comes from the reset itself, never from the request.
 func (u Users) ProcessResetEmail(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Token string
 		Email string
 	}
 	data.Token = r.FormValue("token")
-	data.Email = r.FormValue("email")
 
-	user, err := u.EmailResetService.Consume(data.Token)
+	emailReset, err := u.EmailResetService.Consume(data.Token)
 	if err != nil {
-		fmt.Println(err)
-		// TODO: Distinguish between server errors and invalid token errors.
-		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, models.ErrTokenExpired):
+			http.Error(w, "This link has expired. Please request the email change again.", http.StatusBadRequest)
+		case errors.Is(err, models.ErrTokenInvalid):
+			http.Error(w, "This link is invalid or the change was already made or cancelled.", http.StatusBadRequest)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		}
 		return
 	}
+	data.Email = emailReset.NewEmail
 	// Update the user's email
-	err = u.UserService.UpdateEmail(user.ID, data.Email)
+	err = u.UserService.UpdateEmail(emailReset.UserID, emailReset.NewEmail)
 	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			u.renderSetting(w, r, errors.Public(err, "That email address is already associated with an account."))
+			return
+		}
 		fmt.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
@@ -340,3 +680,18 @@ func (u Users) ProcessResetEmail(w http.ResponseWriter, r *http.Request) {
 
 	u.Templates.EmailUpdateSuccess.Execute(w, r, data)
 }
+
+// Cancel a pending email change from the link sent to the old address
+func (u Users) ProcessCancelEmailChange(w http.ResponseWriter, r *http.Request) {
+	err := u.EmailResetService.Cancel(r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This link is invalid or the change was already made or cancelled.", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.EmailChangeCancelled.Execute(w, r, nil)
+}
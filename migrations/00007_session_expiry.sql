@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+  ADD COLUMN expires_at TIMESTAMPTZ NOT NULL DEFAULT NOW() + INTERVAL '1 day',
+  ADD COLUMN persistent BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE sessions ALTER COLUMN expires_at DROP DEFAULT;
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX sessions_expires_at_idx;
+ALTER TABLE sessions
+  DROP COLUMN expires_at,
+  DROP COLUMN persistent;
+-- +goose StatementEnd
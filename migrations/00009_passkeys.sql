@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE passkeys (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  credential_id BYTEA UNIQUE NOT NULL,
+  name TEXT NOT NULL DEFAULT '',
+  credential JSONB NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_used_at TIMESTAMPTZ
+);
+
+CREATE TABLE webauthn_ceremonies (
+  id SERIAL PRIMARY KEY,
+  user_id INT REFERENCES users (id) ON DELETE CASCADE,
+  token_hash TEXT UNIQUE NOT NULL,
+  session_data JSONB NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE webauthn_ceremonies;
+DROP TABLE passkeys;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE rate_limits (
+  key TEXT PRIMARY KEY,
+  failures INT NOT NULL,
+  last_failure_at TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE users ADD COLUMN locked_until TIMESTAMPTZ;
+
+CREATE TABLE account_unlocks (
+  id SERIAL PRIMARY KEY,
+  user_id INT UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+  token_hash TEXT UNIQUE NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE account_unlocks;
+ALTER TABLE users DROP COLUMN locked_until;
+DROP TABLE rate_limits;
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Pending resets don't know which address they were for, so they can't be
+-- completed safely any more.
+DELETE FROM email_resets;
+ALTER TABLE email_resets ADD COLUMN new_email TEXT NOT NULL;
+ALTER TABLE email_resets ADD COLUMN cancel_token_hash TEXT UNIQUE NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE email_resets DROP COLUMN cancel_token_hash;
+ALTER TABLE email_resets DROP COLUMN new_email;
+-- +goose StatementEnd
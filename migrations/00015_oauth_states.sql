@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE oauth_states (
+  id SERIAL PRIMARY KEY,
+  token_hash TEXT UNIQUE NOT NULL,
+  provider TEXT NOT NULL,
+  -- The signed in user who started the flow, if any
+  user_id INT REFERENCES users (id) ON DELETE CASCADE,
+  link BOOLEAN NOT NULL DEFAULT FALSE,
+  code_verifier TEXT NOT NULL DEFAULT '',
+  nonce TEXT NOT NULL DEFAULT '',
+  return_to TEXT NOT NULL DEFAULT '',
+  expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE oauth_states;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Galleries so far could be seen by anyone with the link, so they start
+-- out unlisted. New ones are private until their owner says otherwise.
+ALTER TABLE galleries
+  ADD COLUMN visibility TEXT NOT NULL DEFAULT 'unlisted'
+    CHECK (visibility IN ('private', 'unlisted', 'public', 'password')),
+  ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE galleries
+  ALTER COLUMN visibility SET DEFAULT 'private';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP COLUMN password_hash,
+  DROP COLUMN visibility;
+-- +goose StatementEnd
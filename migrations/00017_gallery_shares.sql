@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE gallery_shares (
+  id SERIAL PRIMARY KEY,
+  gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+  token_hash TEXT UNIQUE NOT NULL,
+  allow_downloads BOOLEAN NOT NULL DEFAULT FALSE,
+  -- 0 means the link can be viewed any number of times
+  max_views INT NOT NULL DEFAULT 0,
+  views INT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX gallery_shares_gallery_id_idx ON gallery_shares (gallery_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_shares;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+  ADD COLUMN public_id TEXT,
+  ADD COLUMN title_in_url BOOLEAN NOT NULL DEFAULT FALSE,
+  ADD COLUMN legacy_urls BOOLEAN NOT NULL DEFAULT FALSE;
+-- Existing galleries keep answering their numeric URLs, which have
+-- already been shared
+UPDATE galleries
+SET public_id = substr(md5(gen_random_uuid()::text), 1, 20), legacy_urls = TRUE;
+ALTER TABLE galleries
+  ALTER COLUMN public_id SET NOT NULL,
+  ADD CONSTRAINT galleries_public_id_key UNIQUE (public_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP COLUMN public_id,
+  DROP COLUMN title_in_url,
+  DROP COLUMN legacy_urls;
+-- +goose StatementEnd
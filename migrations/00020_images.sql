@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Images uploaded before this table existed are added by the
+-- backfillimages command
+CREATE TABLE images (
+  id SERIAL PRIMARY KEY,
+  public_id TEXT NOT NULL,
+  gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+  -- Where the file is kept, relative to the images directory
+  storage_key TEXT UNIQUE NOT NULL,
+  filename TEXT NOT NULL,
+  content_type TEXT NOT NULL,
+  size BIGINT NOT NULL,
+  width INT NOT NULL,
+  height INT NOT NULL,
+  -- Hex SHA-256 of the file
+  checksum TEXT NOT NULL,
+  uploaded_by INT REFERENCES users (id) ON DELETE SET NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (gallery_id, public_id)
+);
+CREATE INDEX images_gallery_id_created_at_idx ON images (gallery_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE images;
+-- +goose StatementEnd
@@ -0,0 +1,37 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+  ADD COLUMN strip_metadata TEXT NOT NULL DEFAULT 'location';
+-- Images uploaded before metadata was read are assumed to have some,
+-- including a location, so nothing they might have is served
+ALTER TABLE images
+  ADD COLUMN camera_make TEXT NOT NULL DEFAULT '',
+  ADD COLUMN camera_model TEXT NOT NULL DEFAULT '',
+  ADD COLUMN lens TEXT NOT NULL DEFAULT '',
+  ADD COLUMN exposure_time TEXT NOT NULL DEFAULT '',
+  ADD COLUMN f_number REAL NOT NULL DEFAULT 0,
+  ADD COLUMN focal_length REAL NOT NULL DEFAULT 0,
+  ADD COLUMN iso INT NOT NULL DEFAULT 0,
+  -- The camera's local time, as cameras don't record a time zone
+  ADD COLUMN taken_at TIMESTAMP,
+  ADD COLUMN orientation INT NOT NULL DEFAULT 1,
+  ADD COLUMN has_location BOOLEAN NOT NULL DEFAULT TRUE,
+  ADD COLUMN has_metadata BOOLEAN NOT NULL DEFAULT TRUE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+  DROP COLUMN camera_make,
+  DROP COLUMN camera_model,
+  DROP COLUMN lens,
+  DROP COLUMN exposure_time,
+  DROP COLUMN f_number,
+  DROP COLUMN focal_length,
+  DROP COLUMN iso,
+  DROP COLUMN taken_at,
+  DROP COLUMN orientation,
+  DROP COLUMN has_location,
+  DROP COLUMN has_metadata;
+ALTER TABLE galleries DROP COLUMN strip_metadata;
+-- +goose StatementEnd
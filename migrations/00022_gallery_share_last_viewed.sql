@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The images of a link's last view keep loading for a while after its
+-- views run out, and no longer
+ALTER TABLE gallery_shares ADD COLUMN last_viewed_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE gallery_shares DROP COLUMN last_viewed_at;
+-- +goose StatementEnd
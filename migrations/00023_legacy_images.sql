@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Images indexed from before the images table can still be found by their
+-- old filename URLs. Nothing else can.
+ALTER TABLE images ADD COLUMN legacy BOOLEAN NOT NULL DEFAULT FALSE;
+-- Their IDs were a hash of the filename, which anyone could work out, so
+-- they get random ones
+UPDATE images
+  SET legacy = TRUE,
+    public_id = left(encode(sha256(uuid_send(gen_random_uuid())), 'hex'), 20)
+  WHERE public_id = left(encode(sha256(convert_to(filename, 'UTF8')), 'hex'), 20);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images DROP COLUMN legacy;
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE imports (
+  id SERIAL PRIMARY KEY,
+  gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  provider TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  -- NULL while the import is running
+  finished_at TIMESTAMPTZ
+);
+CREATE INDEX imports_gallery_id_idx ON imports (gallery_id);
+CREATE INDEX imports_user_id_idx ON imports (user_id);
+
+CREATE TABLE import_files (
+  id SERIAL PRIMARY KEY,
+  import_id INT NOT NULL REFERENCES imports (id) ON DELETE CASCADE,
+  -- The provider's ID for the file
+  file TEXT NOT NULL,
+  filename TEXT NOT NULL,
+  -- pending, imported or failed
+  status TEXT NOT NULL DEFAULT 'pending',
+  -- Why the file failed, which can be shown to the user
+  error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX import_files_import_id_idx ON import_files (import_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE import_files;
+DROP TABLE imports;
+-- +goose StatementEnd
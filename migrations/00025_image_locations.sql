@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Locations used to be looked for in fewer places, like only in the first
+-- IFD of the EXIF and not in the extra images after a JPEG. Images read
+-- that way are assumed to have one, so their served copies are stripped
+-- again.
+UPDATE images SET has_location = TRUE, has_metadata = TRUE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- Which images really had no location isn't known any more
+SELECT 1;
+-- +goose StatementEnd
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/rand"
+)
+
+const (
+	// DefaultUnlockDuration is the default time that an AccountUnlock is
+	// valid for.
+	DefaultUnlockDuration = 24 * time.Hour
+)
+
+type AccountUnlock struct {
+	ID     int
+	UserID int
+	// Token is only set when an AccountUnlock is being created.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type AccountUnlockService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each unlock token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+	// Duration is the amount of time that an AccountUnlock is valid for.
+	// Defaults to DefaultUnlockDuration
+	Duration time.Duration
+}
+
+// Create a new account_unlocks record for a locked user
+func (service *AccountUnlockService) Create(userID int) (*AccountUnlock, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultUnlockDuration
+	}
+
+	unlock := AccountUnlock{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO account_unlocks (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, expires_at = $3
+		RETURNING id;`, unlock.UserID, unlock.TokenHash, unlock.ExpiresAt)
+	err = row.Scan(&unlock.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	return &unlock, nil
+}
+
+// Consume a token and return the user associated with it. Returns
+// ErrTokenInvalid for unknown tokens and ErrTokenExpired for expired ones.
+func (service *AccountUnlockService) Consume(token string) (*User, error) {
+	tokenHash := service.hash(token)
+	var user User
+	var unlock AccountUnlock
+	row := service.DB.QueryRow(`
+		SELECT
+			a.id,
+			a.expires_at,
+			u.id,
+			u.email
+		FROM account_unlocks AS a
+		JOIN users AS u
+			ON u.id = a.user_id
+		WHERE a.token_hash = $1;`, tokenHash)
+	err := row.Scan(
+		&unlock.ID, &unlock.ExpiresAt,
+		&user.ID, &user.Email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTokenInvalid
+		}
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	if time.Now().After(unlock.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	_, err = service.DB.Exec(`
+		DELETE FROM account_unlocks
+		WHERE id = $1;`, unlock.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	return &user, nil
+}
+
+func (service *AccountUnlockService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,230 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// NewDropboxProvider returns a provider for importing from Dropbox. Scopes
+// default to reading the user's files.
+func NewDropboxProvider(clientID, clientSecret string, scopes []string) *ImportProvider {
+	if len(scopes) == 0 {
+		scopes = []string{"files.metadata.read", "files.content.read"}
+	}
+	return &ImportProvider{
+		Name:        "dropbox",
+		DisplayName: "Dropbox",
+		Config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+				TokenURL: "https://api.dropboxapi.com/oauth2/token",
+			},
+		},
+		AuthParams: []oauth2.AuthCodeOption{
+			oauth2.SetAuthURLParam("token_access_type", "offline"),
+		},
+		PKCE: true,
+		NewClient: func(client *http.Client) ImportClient {
+			return &DropboxAPI{Client: client}
+		},
+		Revoke: revokeDropboxToken,
+	}
+}
+
+// Dropbox revokes the token a request is made with
+func revokeDropboxToken(ctx context.Context, token *oauth2.Token) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dropboxAPIURL+"/2/auth/token/revoke", nil)
+	if err != nil {
+		return fmt.Errorf("revoke dropbox token: %w", err)
+	}
+	token.SetAuthHeader(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("revoke dropbox token: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("revoke dropbox token: %w", dropboxError(res))
+	}
+	return nil
+}
+
+type dropboxEntry struct {
+	// Tag is "file", "folder" or "deleted"
+	Tag       string `json:".tag"`
+	Name      string `json:"name"`
+	PathLower string `json:"path_lower"`
+}
+
+type dropboxFolder struct {
+	Entries []dropboxEntry `json:"entries"`
+	Cursor  string         `json:"cursor"`
+	HasMore bool           `json:"has_more"`
+}
+
+// DropboxAPI is an ImportClient for the Dropbox HTTP API
+type DropboxAPI struct {
+	// Client must add the user's access token to requests, e.g. one from
+	// oauth2.NewClient
+	Client *http.Client
+	// APIURL and ContentURL default to Dropbox's own. They are only set to
+	// point the client at something else, like a fake in tests.
+	APIURL     string
+	ContentURL string
+}
+
+const (
+	dropboxAPIURL     = "https://api.dropboxapi.com"
+	dropboxContentURL = "https://content.dropboxapi.com"
+)
+
+// ListFolder lists the folder at the given path. Dropbox's cursors point
+// into the folder already, so the path is only used for the first page.
+func (api *DropboxAPI) ListFolder(ctx context.Context, folder, cursor string) (*ImportFolder, error) {
+	var result dropboxFolder
+	var err error
+	if cursor != "" {
+		arg := struct {
+			Cursor string `json:"cursor"`
+		}{cursor}
+		err = api.rpc(ctx, "/2/files/list_folder/continue", arg, &result)
+	} else {
+		arg := struct {
+			Path string `json:"path"`
+		}{folder}
+		err = api.rpc(ctx, "/2/files/list_folder", arg, &result)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list dropbox folder %q: %w", folder, err)
+	}
+	list := ImportFolder{
+		Cursor:  result.Cursor,
+		HasMore: result.HasMore,
+	}
+	for _, entry := range result.Entries {
+		if entry.Tag == "deleted" {
+			continue
+		}
+		list.Entries = append(list.Entries, ImportEntry{
+			ID:     entry.PathLower,
+			Name:   entry.Name,
+			Folder: entry.Tag == "folder",
+		})
+	}
+	return &list, nil
+}
+
+// Download the file at the given path
+func (api *DropboxAPI) Download(ctx context.Context, file string) (string, io.ReadCloser, error) {
+	arg, err := dropboxAPIArg(struct {
+		Path string `json:"path"`
+	}{file})
+	if err != nil {
+		return "", nil, fmt.Errorf("download %q from dropbox: %w", file, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.contentURL()+"/2/files/download", nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("download %q from dropbox: %w", file, err)
+	}
+	req.Header.Set("Dropbox-API-Arg", arg)
+	res, err := api.Client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("download %q from dropbox: %w", file, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return "", nil, fmt.Errorf("download %q from dropbox: %w", file, dropboxError(res))
+	}
+	// The path is lower cased, but the file's metadata has its real name
+	filename := path.Base(file)
+	var metadata struct {
+		Name string `json:"name"`
+	}
+	if json.Unmarshal([]byte(res.Header.Get("Dropbox-API-Result")), &metadata) == nil && metadata.Name != "" {
+		filename = metadata.Name
+	}
+	return filename, res.Body, nil
+}
+
+// Call an RPC endpoint, which takes and returns JSON
+func (api *DropboxAPI) rpc(ctx context.Context, endpoint string, arg, result interface{}) error {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.apiURL()+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := api.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return dropboxError(res)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+func (api *DropboxAPI) apiURL() string {
+	if api.APIURL == "" {
+		return dropboxAPIURL
+	}
+	return api.APIURL
+}
+
+func (api *DropboxAPI) contentURL() string {
+	if api.ContentURL == "" {
+		return dropboxContentURL
+	}
+	return api.ContentURL
+}
+
+// Dropbox explains failed calls with an error_summary, e.g.
+// "path/not_found/..", which says more than the status does
+func dropboxError(res *http.Response) error {
+	var body struct {
+		ErrorSummary string `json:"error_summary"`
+	}
+	err := json.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&body)
+	if err != nil || body.ErrorSummary == "" {
+		return fmt.Errorf("dropbox: %s", res.Status)
+	}
+	return fmt.Errorf("dropbox: %s: %s", res.Status, body.ErrorSummary)
+}
+
+// The Dropbox-API-Arg header is JSON, but HTTP headers must be ASCII so
+// Dropbox wants every other character escaped
+func dropboxAPIArg(arg interface{}) (string, error) {
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, r := range string(b) {
+		switch {
+		case r < 0x7f:
+			sb.WriteRune(r)
+		case r > 0xffff:
+			// Outside the BMP, which JSON escapes as a surrogate pair
+			r -= 0x10000
+			fmt.Fprintf(&sb, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+		default:
+			fmt.Fprintf(&sb, `\u%04x`, r)
+		}
+	}
+	return sb.String(), nil
+}
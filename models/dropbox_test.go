@@ -0,0 +1,179 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeDropbox serves a small part of the Dropbox API: one folder listed
+// over two pages, and the files in it
+type fakeDropbox struct {
+	t *testing.T
+	// files maps lower cased paths to their real names and contents
+	files map[string][2]string
+}
+
+func newFakeDropbox(t *testing.T) *DropboxAPI {
+	fake := &fakeDropbox{t: t, files: map[string][2]string{
+		"/photos/café.jpg": {"Café.jpg", "jpeg bytes"},
+	}}
+	api := httptest.NewServer(http.HandlerFunc(fake.api))
+	t.Cleanup(api.Close)
+	content := httptest.NewServer(http.HandlerFunc(fake.content))
+	t.Cleanup(content.Close)
+	return &DropboxAPI{
+		Client:     api.Client(),
+		APIURL:     api.URL,
+		ContentURL: content.URL,
+	}
+}
+
+func (fake *fakeDropbox) api(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		fake.t.Errorf("%s %s with Content-Type %q", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+	}
+	var arg struct {
+		Path   string `json:"path"`
+		Cursor string `json:"cursor"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&arg); err != nil {
+		fake.t.Errorf("%s: decode argument: %v", r.URL.Path, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/2/files/list_folder" && arg.Path == "/photos":
+		io.WriteString(w, `{
+			"entries": [
+				{".tag": "folder", "name": "Holiday", "path_lower": "/photos/holiday"},
+				{".tag": "deleted", "name": "Gone.jpg", "path_lower": "/photos/gone.jpg"}
+			],
+			"cursor": "page-2",
+			"has_more": true
+		}`)
+	case r.URL.Path == "/2/files/list_folder/continue" && arg.Cursor == "page-2":
+		io.WriteString(w, `{
+			"entries": [
+				{".tag": "file", "name": "Café.jpg", "path_lower": "/photos/café.jpg"}
+			],
+			"cursor": "page-3",
+			"has_more": false
+		}`)
+	default:
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, `{"error_summary": "path/not_found/.."}`)
+	}
+}
+
+func (fake *fakeDropbox) content(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/2/files/download" {
+		fake.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}
+	header := r.Header.Get("Dropbox-API-Arg")
+	for _, c := range header {
+		if c > 0x7f {
+			fake.t.Errorf("Dropbox-API-Arg %q isn't ASCII", header)
+			break
+		}
+	}
+	var arg struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal([]byte(header), &arg); err != nil {
+		fake.t.Errorf("decode Dropbox-API-Arg %q: %v", header, err)
+	}
+	file, ok := fake.files[arg.Path]
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, `{"error_summary": "path/not_found/.."}`)
+		return
+	}
+	result, _ := dropboxAPIArg(struct {
+		Name string `json:"name"`
+	}{file[0]})
+	w.Header().Set("Dropbox-API-Result", result)
+	io.WriteString(w, file[1])
+}
+
+func TestDropboxListFolder(t *testing.T) {
+	api := newFakeDropbox(t)
+	ctx := context.Background()
+
+	first, err := api.ListFolder(ctx, "/photos", "")
+	if err != nil {
+		t.Fatalf("ListFolder() err = %v", err)
+	}
+	want := &ImportFolder{
+		Entries: []ImportEntry{{ID: "/photos/holiday", Name: "Holiday", Folder: true}},
+		Cursor:  "page-2",
+		HasMore: true,
+	}
+	if !reflect.DeepEqual(first, want) {
+		t.Errorf("ListFolder() = %+v, want %+v", first, want)
+	}
+
+	next, err := api.ListFolder(ctx, "/photos", first.Cursor)
+	if err != nil {
+		t.Fatalf("ListFolder(cursor) err = %v", err)
+	}
+	want = &ImportFolder{
+		Entries: []ImportEntry{{ID: "/photos/café.jpg", Name: "Café.jpg"}},
+		Cursor:  "page-3",
+	}
+	if !reflect.DeepEqual(next, want) {
+		t.Errorf("ListFolder(cursor) = %+v, want %+v", next, want)
+	}
+
+	_, err = api.ListFolder(ctx, "/missing", "")
+	if err == nil || !strings.Contains(err.Error(), "path/not_found") {
+		t.Errorf("ListFolder(missing) err = %v, want the error summary", err)
+	}
+}
+
+func TestDropboxDownload(t *testing.T) {
+	api := newFakeDropbox(t)
+	ctx := context.Background()
+
+	filename, contents, err := api.Download(ctx, "/photos/café.jpg")
+	if err != nil {
+		t.Fatalf("Download() err = %v", err)
+	}
+	defer contents.Close()
+	b, err := io.ReadAll(contents)
+	if err != nil {
+		t.Fatalf("read download: %v", err)
+	}
+	if filename != "Café.jpg" || string(b) != "jpeg bytes" {
+		t.Errorf("Download() = %q, %q; want %q, %q", filename, b, "Café.jpg", "jpeg bytes")
+	}
+
+	_, _, err = api.Download(ctx, "/photos/missing.jpg")
+	if err == nil || !strings.Contains(err.Error(), "path/not_found") {
+		t.Errorf("Download(missing) err = %v, want the error summary", err)
+	}
+}
+
+func TestDropboxAPIArg(t *testing.T) {
+	tests := map[string]string{
+		"/a.jpg": `{"path":"/a.jpg"}`,
+		"/café":  `{"path":"/caf\u00e9"}`,
+		"/📷.jpg": `{"path":"/\ud83d\udcf7.jpg"}`,
+	}
+	for path, want := range tests {
+		got, err := dropboxAPIArg(struct {
+			Path string `json:"path"`
+		}{path})
+		if err != nil {
+			t.Fatalf("dropboxAPIArg(%q) err = %v", path, err)
+		}
+		if got != want {
+			t.Errorf("dropboxAPIArg(%q) = %s, want %s", path, got, want)
+		}
+	}
+}
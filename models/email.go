@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"html"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -103,3 +104,62 @@ func (es *EmailService) SendUpdateEmail(to, resetURL string) error {
 	}
 	return nil
 }
+
+// Let the old address know about an email change, in case its owner didn't
+// ask for it
+func (es *EmailService) EmailChangeRequested(to, newEmail, cancelURL string) error {
+	email := Email{
+		Subject:   "Your email is being changed",
+		To:        to,
+		Plaintext: "Someone asked to change the email address of your Lenslocked account to " + newEmail + ". If this wasn't you, please visit the following link to cancel the change: " + cancelURL,
+		HTML:      `<p>Someone asked to change the email address of your Lenslocked account to ` + html.EscapeString(newEmail) + `. If this wasn't you, please visit the following link to cancel the change: <a href="` + cancelURL + `">` + cancelURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("email change requested: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) VerifyEmail(to, verifyURL string) error {
+	email := Email{
+		Subject:   "Verify your email address",
+		To:        to,
+		Plaintext: "Welcome to Lenslocked! To verify your email address, please visit the following link: " + verifyURL,
+		HTML:      `<p>Welcome to Lenslocked! To verify your email address, please visit the following link: <a href="` + verifyURL + `">` + verifyURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("verify email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) UnlockAccount(to, unlockURL string) error {
+	email := Email{
+		Subject:   "Your account has been locked",
+		To:        to,
+		Plaintext: "There have been too many failed attempts to sign in to your account, so we have temporarily locked it. If this was you, you can unlock your account by visiting the following link: " + unlockURL + "\n\nIf this wasn't you, someone may be trying to guess your password. Your account will unlock itself after a while, but you may want to reset your password.",
+		HTML:      `<p>There have been too many failed attempts to sign in to your account, so we have temporarily locked it. If this was you, you can unlock your account by visiting the following link: <a href="` + unlockURL + `">` + unlockURL + `</a></p><p>If this wasn't you, someone may be trying to guess your password. Your account will unlock itself after a while, but you may want to reset your password.</p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("unlock account email: %w", err)
+	}
+	return nil
+}
+
+// Invite someone to become a member of a gallery
+func (es *EmailService) GalleryInvitation(to, inviter, galleryTitle, acceptURL string) error {
+	email := Email{
+		Subject:   inviter + " invited you to a gallery on Lenslocked",
+		To:        to,
+		Plaintext: inviter + " invited you to the gallery \"" + galleryTitle + "\" on Lenslocked. To accept, please visit the following link: " + acceptURL,
+		HTML:      `<p>` + html.EscapeString(inviter) + ` invited you to the gallery "` + html.EscapeString(galleryTitle) + `" on Lenslocked. To accept, please visit the following link: <a href="` + acceptURL + `">` + acceptURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("gallery invitation email: %w", err)
+	}
+	return nil
+}
@@ -4,7 +4,9 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/joncalhoun/lenslocked/rand"
@@ -13,10 +15,17 @@ import (
 type EmailReset struct {
 	ID     int
 	UserID int
+	// NewEmail is the address the account will be changed to. It is stored
+	// with the token so the link can't be pointed at a different address.
+	NewEmail string
 	// Token is only set when a EmailReset is being created.
 	Token     string
 	TokenHash string
-	ExpiresAt time.Time
+	// CancelToken is sent to the old address so its owner can stop a change
+	// they didn't ask for. It is only set when a EmailReset is being created.
+	CancelToken     string
+	CancelTokenHash string
+	ExpiresAt       time.Time
 }
 
 type EmailResetService struct {
@@ -31,11 +40,27 @@ type EmailResetService struct {
 	Duration time.Duration
 }
 
-// Create a new email_reset record
-func (service *EmailResetService) Create(userID int) (*EmailReset, error) {
+// Create a new email_reset record for changing the user's email to newEmail.
+// Returns ErrEmailTaken if another account already uses newEmail.
+func (service *EmailResetService) Create(userID int, newEmail string) (*EmailReset, error) {
+	newEmail = strings.ToLower(newEmail)
+
+	// Catch the conflict now rather than after the new address is confirmed.
+	var existingID int
+	row := service.DB.QueryRow(`
+		SELECT id
+		FROM users
+		WHERE email = $1;`, newEmail)
+	err := row.Scan(&existingID)
+	if err == nil {
+		return nil, ErrEmailTaken
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("create: %w", err)
+	}
 
 	bytesPerToken := service.BytesPerToken
-	if bytesPerToken == 0 {
+	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
 	}
 
@@ -43,6 +68,10 @@ func (service *EmailResetService) Create(userID int) (*EmailReset, error) {
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
+	cancelToken, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
 
 	duration := service.Duration
 	if duration == 0 {
@@ -50,18 +79,22 @@ func (service *EmailResetService) Create(userID int) (*EmailReset, error) {
 	}
 
 	emailReset := EmailReset{
-		UserID:    userID,
-		Token:     token,
-		TokenHash: service.hash(token),
-		ExpiresAt: time.Now().Add(duration),
+		UserID:          userID,
+		NewEmail:        newEmail,
+		Token:           token,
+		TokenHash:       service.hash(token),
+		CancelToken:     cancelToken,
+		CancelTokenHash: service.hash(cancelToken),
+		ExpiresAt:       time.Now().Add(duration),
 	}
 
-	row := service.DB.QueryRow(`
-		INSERT INTO email_resets (user_id, token_hash, expires_at)
-		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
+	row = service.DB.QueryRow(`
+		INSERT INTO email_resets (user_id, new_email, token_hash, cancel_token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id) DO
 		UPDATE
-		SET token_hash = $2, expires_at = $3
-		RETURNING id;`, emailReset.UserID, emailReset.TokenHash, emailReset.ExpiresAt)
+		SET new_email = $2, token_hash = $3, cancel_token_hash = $4, expires_at = $5
+		RETURNING id;`, emailReset.UserID, emailReset.NewEmail, emailReset.TokenHash,
+		emailReset.CancelTokenHash, emailReset.ExpiresAt)
 	err = row.Scan(&emailReset.ID)
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
@@ -69,39 +102,60 @@ func (service *EmailResetService) Create(userID int) (*EmailReset, error) {
 	return &emailReset, nil
 }
 
-// We are going to consume a token and return the user associated with it, or return an error if the token wasn't valid for any reason.
-func (service *EmailResetService) Consume(token string) (*User, error) {
+// We are going to consume a token and return the email reset associated with it.
+// Returns ErrTokenInvalid for unknown tokens and ErrTokenExpired for expired ones.
+// The reset's NewEmail is the only address the account may be changed to.
+func (service *EmailResetService) Consume(token string) (*EmailReset, error) {
 	tokenHash := service.hash(token)
-	var user User
 	var emailReset EmailReset
 	row := service.DB.QueryRow(`
 		SELECT 
-			e.id,
-			e.expires_at,
-			u.id,
-			u.password_hash
-		FROM email_resets AS e
-		JOIN users AS u
-			ON u.id = e.user_id
-		WHERE e.token_hash = $1;`, tokenHash)
+			id,
+			user_id,
+			new_email,
+			expires_at
+		FROM email_resets
+		WHERE token_hash = $1;`, tokenHash)
 	err := row.Scan(
-		&emailReset.ID, &emailReset.ExpiresAt,
-		&user.ID, &user.PasswordHash)
+		&emailReset.ID, &emailReset.UserID,
+		&emailReset.NewEmail, &emailReset.ExpiresAt)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTokenInvalid
+		}
 		return nil, fmt.Errorf("consume: %w", err)
 	}
 	if time.Now().After(emailReset.ExpiresAt) {
-		return nil, fmt.Errorf("token expired: %v", token)
+		return nil, ErrTokenExpired
 	}
 
 	err = service.delete(emailReset.ID)
 	if err != nil {
 		return nil, fmt.Errorf("consume: %w", err)
 	}
-	return &user, nil
+	return &emailReset, nil
 
 }
 
+// Cancel the pending email change identified by the cancel token sent to
+// the old address. Returns ErrNotFound if there is no such change.
+func (service *EmailResetService) Cancel(cancelToken string) error {
+	res, err := service.DB.Exec(`
+		DELETE FROM email_resets
+		WHERE cancel_token_hash = $1;`, service.hash(cancelToken))
+	if err != nil {
+		return fmt.Errorf("cancel: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cancel: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 func (service *EmailResetService) delete(id int) error {
 	_, err := service.DB.Exec(`
 		DELETE FROM email_resets
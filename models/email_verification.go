@@ -0,0 +1,109 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/rand"
+)
+
+const (
+	// DefaultVerificationDuration is the default time that an
+	// EmailVerification is valid for.
+	DefaultVerificationDuration = 48 * time.Hour
+)
+
+type EmailVerification struct {
+	ID     int
+	UserID int
+	// Token is only set when an EmailVerification is being created.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailVerificationService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each verification token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+	// Duration is the amount of time that an EmailVerification is valid for.
+	// Defaults to DefaultVerificationDuration
+	Duration time.Duration
+}
+
+// Create a new email_verifications record, replacing any earlier one so
+// only the most recent link works
+func (service *EmailVerificationService) Create(userID int) (*EmailVerification, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultVerificationDuration
+	}
+
+	verification := EmailVerification{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO email_verifications (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, expires_at = $3
+		RETURNING id;`, verification.UserID, verification.TokenHash, verification.ExpiresAt)
+	err = row.Scan(&verification.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	return &verification, nil
+}
+
+// Consume a token and return the user associated with it. Returns
+// ErrTokenInvalid for unknown tokens and ErrTokenExpired for expired ones.
+// The token is deleted either way, since an expired one is no use.
+func (service *EmailVerificationService) Consume(token string) (*User, error) {
+	tokenHash := service.hash(token)
+	var user User
+	var verification EmailVerification
+	row := service.DB.QueryRow(`
+		DELETE FROM email_verifications AS v
+		USING users AS u
+		WHERE u.id = v.user_id AND v.token_hash = $1
+		RETURNING v.id, v.expires_at, u.id, u.email;`, tokenHash)
+	err := row.Scan(
+		&verification.ID, &verification.ExpiresAt,
+		&user.ID, &user.Email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTokenInvalid
+		}
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	if time.Now().After(verification.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return &user, nil
+}
+
+func (service *EmailVerificationService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
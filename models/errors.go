@@ -11,6 +11,32 @@ import (
 var (
 	ErrNotFound   = errors.New("models: resource could not be found")
 	ErrEmailTaken = errors.New("models: email address is already in use")
+
+	ErrInvalidCode = errors.New("models: invalid two-factor code")
+
+	ErrInvalidCredentials = errors.New("models: invalid email or password")
+	ErrAccountLocked      = errors.New("models: account is temporarily locked")
+
+	ErrTokenInvalid = errors.New("models: token is invalid")
+	ErrTokenExpired = errors.New("models: token has expired")
+
+	ErrWeakPassword = errors.New("models: password does not meet the password policy")
+
+	ErrEmailNotVerified = errors.New("models: identity provider has not verified the email address")
+	ErrIdentityTaken    = errors.New("models: identity is linked to another account")
+	ErrLastSignInMethod = errors.New("models: cannot remove the last way to sign in")
+	ErrPasskeyCloned    = errors.New("models: passkey signature counter went backwards, authenticator may be cloned")
+
+	ErrInvalidVisibility    = errors.New("models: invalid gallery visibility")
+	ErrWrongGalleryPassword = errors.New("models: wrong gallery password")
+	ErrInvalidStripMetadata = errors.New("models: invalid gallery metadata stripping")
+
+	ErrInvalidRole     = errors.New("models: invalid gallery member role")
+	ErrInvitationEmail = errors.New("models: invitation was sent to another email address")
+	ErrUnverifiedEmail = errors.New("models: email address has not been verified")
+
+	ErrTooManyImportFiles = errors.New("models: too many files to import at once")
+	ErrImportsRunning     = errors.New("models: too many imports are running")
 )
 
 type FileError struct {
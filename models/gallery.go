@@ -2,28 +2,148 @@ package models
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
-	"io/fs"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+
+	"github.com/joncalhoun/lenslocked/rand"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Who can see a gallery
+const (
+	// VisibilityPrivate galleries can only be seen by their owner
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted galleries can be seen by anyone with the link, but
+	// search engines are asked not to index them
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic galleries can be seen and indexed by anyone
+	VisibilityPublic = "public"
+	// VisibilityPassword galleries can be seen by anyone with the link and
+	// the gallery's password
+	VisibilityPassword = "password"
 )
 
 type Gallery struct {
-	ID     int
-	UserID int
-	Title  string
+	ID int
+	// PublicID identifies the gallery in URLs. Unlike ID it can't be
+	// guessed, and doesn't give away how many galleries there are.
+	PublicID   string
+	UserID     int
+	Title      string
+	Visibility string
+	// PasswordHash is only set for VisibilityPassword galleries
+	PasswordHash string
+	// TitleInURL adds the title to the gallery's slug, for nicer links
+	TitleInURL bool
+	// LegacyURLs is set for galleries from before public IDs, whose old
+	// numeric URLs still work
+	LegacyURLs bool
+	// StripMetadata is what metadata is removed from the gallery's
+	// images before they are sent: StripMetadataLocation or
+	// StripMetadataAll
+	StripMetadata string
+}
+
+// Slug identifies the gallery in URLs. It is the public ID, after the
+// title if TitleInURL is set, e.g. "summer-wedding-4f1c9a0e2b7d6c3a8e5f".
+// Only the public ID is needed to find the gallery, so links keep working
+// when the title changes.
+func (gallery *Gallery) Slug() string {
+	if gallery.TitleInURL {
+		if title := slugify(gallery.Title); title != "" {
+			return title + "-" + gallery.PublicID
+		}
+	}
+	return gallery.PublicID
+}
+
+// The longest the title part of a slug can be
+const maxSlugTitleLength = 60
+
+// Turn the title into something readable in a URL, e.g. "Summer Wedding!"
+// becomes "summer-wedding". Accents are dropped and any other characters
+// that aren't ASCII letters or digits separate words.
+func slugify(title string) string {
+	var slug strings.Builder
+	dash := false
+	for _, c := range norm.NFD.String(strings.ToLower(title)) {
+		if unicode.Is(unicode.Mn, c) {
+			continue
+		}
+		if ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+			if dash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			dash = false
+			slug.WriteRune(c)
+			if slug.Len() >= maxSlugTitleLength {
+				break
+			}
+			continue
+		}
+		dash = true
+	}
+	return slug.String()
+}
+
+// The number of random bytes in a public ID
+const publicIDBytes = 10
+
+func newPublicID() (string, error) {
+	b, err := rand.Bytes(publicIDBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 type Image struct {
+	ID int
+	// PublicID identifies the image in URLs without giving away its
+	// filename
+	PublicID  string
 	GalleryID int
-	Path      string
-	Filename  string
+	// StorageKey is where the file is kept in the GalleryService's
+	// storage
+	StorageKey string
+	// Filename is the name the file was uploaded with
+	Filename    string
+	ContentType string
+	Size        int64
+	// Width and Height are in pixels. They are 0 for the odd older image
+	// that couldn't be decoded.
+	Width  int
+	Height int
+	// Checksum is the hex SHA-256 of the file
+	Checksum string
+	// UploadedBy is the ID of the user who added the image, or 0 if they
+	// are gone
+	UploadedBy int
+	CreatedAt  time.Time
+	Metadata   ImageMetadata
+	// Legacy is set for images from before images were kept in the
+	// database, which can still be found by their filenames
+	Legacy bool
 }
 
 type GalleryService struct {
@@ -32,18 +152,44 @@ type GalleryService struct {
 	// images. If not set, the GalleryService will default to using the "images"
 	// directory.
 	ImagesDir string
+	// Storage keeps the image files. Defaults to LocalStorage in ImagesDir.
+	Storage BlobStorage
+	// ImageSizes are the widths, in pixels, smaller variants of each image
+	// are made in. Defaults to DefaultImageSizes.
+	ImageSizes []int
+	// MaxImageSize is the largest file, in bytes, that can be added as an
+	// image. Defaults to DefaultMaxImageSize.
+	MaxImageSize int64
+	// TransformKey signs the URLs of transformed images, which can't be
+	// bigger than MaxTransformSize pixels wide or high. MaxTransformSize
+	// defaults to DefaultMaxTransformSize.
+	TransformKey     []byte
+	MaxTransformSize int
+	// Hasher hashes gallery passwords. Defaults to Argon2idHasher.
+	Hasher PasswordHasher
+	// UnlockKey signs the tokens that remember a visitor has entered a
+	// gallery's password
+	UnlockKey []byte
 }
 
 // Create a new gallery
 func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
+	publicID, err := newPublicID()
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		PublicID:      publicID,
+		Title:         title,
+		UserID:        userID,
+		Visibility:    VisibilityPrivate,
+		StripMetadata: StripMetadataLocation,
 	}
 	row := service.DB.QueryRow(`
-		INSERT INTO galleries (title, user_id)
-		VALUES ($1, $2) RETURNING id;`, gallery.Title, gallery.UserID)
-	err := row.Scan(&gallery.ID)
+		INSERT INTO galleries (public_id, title, user_id, visibility, strip_metadata)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id;`, gallery.PublicID, gallery.Title, gallery.UserID,
+		gallery.Visibility, gallery.StripMetadata)
+	err = row.Scan(&gallery.ID)
 	if err != nil {
 		return nil, fmt.Errorf("create gallery: %w", err)
 	}
@@ -56,10 +202,12 @@ func (service *GalleryService) FindByID(id int) (*Gallery, error) {
 		ID: id,
 	}
 	row := service.DB.QueryRow(`
-		SELECT title, user_id
+		SELECT public_id, title, user_id, visibility, password_hash, title_in_url, legacy_urls,
+			strip_metadata
 		FROM galleries
 		WHERE id = $1;`, gallery.ID)
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+	err := row.Scan(&gallery.PublicID, &gallery.Title, &gallery.UserID, &gallery.Visibility,
+		&gallery.PasswordHash, &gallery.TitleInURL, &gallery.LegacyURLs, &gallery.StripMetadata)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
@@ -69,10 +217,32 @@ func (service *GalleryService) FindByID(id int) (*Gallery, error) {
 	return &gallery, nil
 }
 
+// Find the gallery by its slug. Only the public ID at the end of the slug
+// is used, so callers should check the slug is the gallery's current one.
+func (service *GalleryService) FindBySlug(slug string) (*Gallery, error) {
+	gallery := Gallery{
+		PublicID: slug[strings.LastIndex(slug, "-")+1:],
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, title, user_id, visibility, password_hash, title_in_url, legacy_urls,
+			strip_metadata
+		FROM galleries
+		WHERE public_id = $1;`, gallery.PublicID)
+	err := row.Scan(&gallery.ID, &gallery.Title, &gallery.UserID, &gallery.Visibility,
+		&gallery.PasswordHash, &gallery.TitleInURL, &gallery.LegacyURLs, &gallery.StripMetadata)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query gallery by slug: %w", err)
+	}
+	return &gallery, nil
+}
+
 // Find all galleries owned by a user
 func (service *GalleryService) FindByUserID(userID int) ([]Gallery, error) {
 	rows, err := service.DB.Query(`
-		  SELECT id, title
+		  SELECT id, public_id, title, visibility, title_in_url
 		  FROM galleries
 		  WHERE user_id = $1;`, userID)
 	if err != nil {
@@ -83,7 +253,7 @@ func (service *GalleryService) FindByUserID(userID int) ([]Gallery, error) {
 		gallery := Gallery{
 			UserID: userID,
 		}
-		err := rows.Scan(&gallery.ID, &gallery.Title)
+		err := rows.Scan(&gallery.ID, &gallery.PublicID, &gallery.Title, &gallery.Visibility, &gallery.TitleInURL)
 		if err != nil {
 			return nil, fmt.Errorf("query galleries by user: %w", err)
 		}
@@ -95,18 +265,125 @@ func (service *GalleryService) FindByUserID(userID int) ([]Gallery, error) {
 	return galleries, nil
 }
 
-// Update a gallery's title
+// Update a gallery's title, and whether it is in the gallery's slug
 func (service *GalleryService) Update(gallery *Gallery) error {
 	_, err := service.DB.Exec(`
 		UPDATE galleries
-		SET title = $2
-		WHERE id = $1;`, gallery.ID, gallery.Title)
+		SET title = $2, title_in_url = $3
+		WHERE id = $1;`, gallery.ID, gallery.Title, gallery.TitleInURL)
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
 	}
 	return nil
 }
 
+// SetVisibility changes who can see the gallery. password is required to
+// make a gallery VisibilityPassword, unless it already has one, in which
+// case an empty password keeps it. Returns ErrInvalidVisibility for
+// unknown visibilities and ErrWeakPassword for a missing password.
+func (service *GalleryService) SetVisibility(gallery *Gallery, visibility, password string) error {
+	switch visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		gallery.PasswordHash = ""
+	case VisibilityPassword:
+		if password != "" {
+			hash, err := service.hasher().Hash(password)
+			if err != nil {
+				return fmt.Errorf("set gallery visibility: %w", err)
+			}
+			gallery.PasswordHash = hash
+		}
+		if gallery.PasswordHash == "" {
+			return ErrWeakPassword
+		}
+	default:
+		return ErrInvalidVisibility
+	}
+	gallery.Visibility = visibility
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET visibility = $2, password_hash = $3
+		WHERE id = $1;`, gallery.ID, gallery.Visibility, gallery.PasswordHash)
+	if err != nil {
+		return fmt.Errorf("set gallery visibility: %w", err)
+	}
+	return nil
+}
+
+// SetStripMetadata changes what metadata is removed from the gallery's
+// images before they are sent. Returns ErrInvalidStripMetadata for
+// anything but StripMetadataLocation and StripMetadataAll.
+func (service *GalleryService) SetStripMetadata(gallery *Gallery, strip string) error {
+	if strip != StripMetadataLocation && strip != StripMetadataAll {
+		return ErrInvalidStripMetadata
+	}
+	gallery.StripMetadata = strip
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET strip_metadata = $2
+		WHERE id = $1;`, gallery.ID, gallery.StripMetadata)
+	if err != nil {
+		return fmt.Errorf("set gallery strip metadata: %w", err)
+	}
+	return nil
+}
+
+// Unlock a password protected gallery, returning a token that proves the
+// password was given. The token stops working when the password changes.
+// Returns ErrWrongGalleryPassword if the password is wrong.
+func (service *GalleryService) Unlock(gallery *Gallery, password string) (string, error) {
+	if gallery.Visibility != VisibilityPassword || gallery.PasswordHash == "" {
+		return "", ErrWrongGalleryPassword
+	}
+	ok, err := VerifyPassword(password, gallery.PasswordHash)
+	if err != nil {
+		return "", fmt.Errorf("unlock gallery: %w", err)
+	}
+	if !ok {
+		return "", ErrWrongGalleryPassword
+	}
+	mac, err := service.unlockMAC(gallery)
+	if err != nil {
+		return "", fmt.Errorf("unlock gallery: %w", err)
+	}
+	return base64.URLEncoding.EncodeToString(mac), nil
+}
+
+// Unlocked reports whether the token from Unlock is still good for the
+// gallery
+func (service *GalleryService) Unlocked(gallery *Gallery, token string) bool {
+	if gallery.Visibility != VisibilityPassword {
+		return false
+	}
+	got, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	want, err := service.unlockMAC(gallery)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, want)
+}
+
+// The MAC covers the password hash, which has a fresh salt every time the
+// password is set, so changing the password locks everyone out again
+func (service *GalleryService) unlockMAC(gallery *Gallery) ([]byte, error) {
+	if len(service.UnlockKey) == 0 {
+		return nil, fmt.Errorf("gallery unlock key is not set")
+	}
+	mac := hmac.New(sha256.New, service.UnlockKey)
+	fmt.Fprintf(mac, "%d:%s", gallery.ID, gallery.PasswordHash)
+	return mac.Sum(nil), nil
+}
+
+func (service *GalleryService) hasher() PasswordHasher {
+	if service.Hasher == nil {
+		return Argon2idHasher{}
+	}
+	return service.Hasher
+}
+
 // Delete the gallery and all its images
 func (service *GalleryService) Delete(id int) error {
 	_, err := service.DB.Exec(`
@@ -115,110 +392,396 @@ func (service *GalleryService) Delete(id int) error {
 	if err != nil {
 		return fmt.Errorf("delete gallery by id: %w", err)
 	}
-	err = os.RemoveAll(service.galleryDir(id))
+	ctx := context.Background()
+	blobs, err := service.storage().List(ctx, fmt.Sprintf("gallery-%d/", id))
 	if err != nil {
 		return fmt.Errorf("delete gallery images: %w", err)
 	}
+	for _, blob := range blobs {
+		err = service.storage().Delete(ctx, blob.Key)
+		if err != nil {
+			return fmt.Errorf("delete gallery images: %w", err)
+		}
+	}
 	return nil
 }
 
-// Get the path to images for the given gallery
-func (service *GalleryService) galleryDir(id int) string {
-	imagesDir := service.ImagesDir
-	if imagesDir == "" {
-		imagesDir = "images"
+// Get the directory images are stored in
+func (service *GalleryService) imagesDir() string {
+	if service.ImagesDir == "" {
+		return "images"
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
+	return service.ImagesDir
 }
 
-// Return all images in the given gallery
+func (service *GalleryService) storage() BlobStorage {
+	if service.Storage == nil {
+		return &LocalStorage{Dir: service.imagesDir()}
+	}
+	return service.Storage
+}
+
+// The columns scanImage reads, in order
+const imageColumns = `id, public_id, gallery_id, storage_key, filename, content_type,
+	size, width, height, checksum, uploaded_by, created_at, camera_make, camera_model,
+	lens, exposure_time, f_number, focal_length, iso, taken_at, orientation,
+	has_location, has_metadata, legacy`
+
+func (service *GalleryService) scanImage(row interface{ Scan(...any) error }) (Image, error) {
+	var image Image
+	var uploadedBy sql.NullInt64
+	var takenAt sql.NullTime
+	meta := &image.Metadata
+	err := row.Scan(&image.ID, &image.PublicID, &image.GalleryID, &image.StorageKey,
+		&image.Filename, &image.ContentType, &image.Size, &image.Width, &image.Height,
+		&image.Checksum, &uploadedBy, &image.CreatedAt, &meta.CameraMake, &meta.CameraModel,
+		&meta.Lens, &meta.ExposureTime, &meta.FNumber, &meta.FocalLength, &meta.ISO, &takenAt,
+		&meta.Orientation, &meta.HasLocation, &meta.HasMetadata, &image.Legacy)
+	if err != nil {
+		return Image{}, err
+	}
+	image.UploadedBy = int(uploadedBy.Int64)
+	meta.TakenAt = takenAt.Time
+	return image, nil
+}
+
+// Return all images in the given gallery, oldest first
 func (service *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(service.galleryDir(galleryID), "*")
-	allFiles, err := filepath.Glob(globPattern)
+	rows, err := service.DB.Query(`
+		SELECT `+imageColumns+`
+		FROM images
+		WHERE gallery_id = $1
+		ORDER BY created_at, id;`, galleryID)
 	if err != nil {
 		return nil, fmt.Errorf("retrieving gallery images: %w", err)
 	}
+	defer rows.Close()
 	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, service.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+	for rows.Next() {
+		image, err := service.scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving gallery images: %w", err)
 		}
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("retrieving gallery images: %w", err)
 	}
 	return images, nil
 }
 
-// Query for a given image
-func (service *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(service.galleryDir(galleryID), filename)
-	_, err := os.Stat(imagePath)
+// Query for the gallery's image with the given public ID
+func (service *GalleryService) Image(galleryID int, id string) (Image, error) {
+	row := service.DB.QueryRow(`
+		SELECT `+imageColumns+`
+		FROM images
+		WHERE gallery_id = $1 AND public_id = $2;`, galleryID, id)
+	image, err := service.scanImage(row)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
+		if errors.Is(err, sql.ErrNoRows) {
 			return Image{}, ErrNotFound
 		}
 		return Image{}, fmt.Errorf("querying for image: %w", err)
 	}
-	return Image{
-		Filename:  filename,
-		GalleryID: galleryID,
-		Path:      imagePath,
-	}, nil
+	return image, nil
+}
+
+// Query for the gallery's latest legacy image with the given filename,
+// for old URLs that had filenames instead of IDs. Images uploaded since
+// can't be found by their filenames.
+func (service *GalleryService) ImageByFilename(galleryID int, filename string) (Image, error) {
+	row := service.DB.QueryRow(`
+		SELECT `+imageColumns+`
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2 AND legacy
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1;`, galleryID, filename)
+	image, err := service.scanImage(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, fmt.Errorf("querying for image by filename: %w", err)
+	}
+	return image, nil
 }
 
-// Delete the image
-func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
-	image, err := service.Image(galleryID, filename)
+// Delete the image with the given public ID, and its file
+func (service *GalleryService) DeleteImage(galleryID int, id string) error {
+	var storageKey string
+	row := service.DB.QueryRow(`
+		DELETE FROM images
+		WHERE gallery_id = $1 AND public_id = $2
+		RETURNING storage_key;`, galleryID, id)
+	err := row.Scan(&storageKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("deleting image: %w", ErrNotFound)
+		}
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	ctx := context.Background()
+	err = service.storage().Delete(ctx, storageKey)
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
-	err = os.Remove(image.Path)
+	err = service.deleteVariants(ctx, Image{GalleryID: galleryID, PublicID: id})
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
 	return nil
 }
 
-// Create an image file in our file system
-func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.Reader) error {
+// OpenImage returns the image's file, which is only fetched from storage
+// as it is read
+func (service *GalleryService) OpenImage(ctx context.Context, image *Image) *BlobReader {
+	return NewBlobReader(ctx, service.storage(), image.StorageKey, image.Size)
+}
+
+// ImageURL returns a URL the image's file can be downloaded from directly
+// until it expires, or ErrPresignNotSupported if the storage can't make
+// one
+func (service *GalleryService) ImageURL(ctx context.Context, image *Image, expires time.Duration) (string, error) {
+	return service.storage().PresignGet(ctx, image.StorageKey, expires)
+}
+
+// Create an image in the gallery, uploaded by the user with the given ID.
+// The file is stored under a new name so uploads with the same filename
+// don't replace each other.
+func (service *GalleryService) CreateImage(galleryID, uploadedBy int, filename string, contents io.Reader) (*Image, error) {
 	// 1. Capture the bytes read during the check
 	readBytes, err := checkContentType(contents, service.imageContentTypes())
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 	err = checkExtension(filename, service.extensions())
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-
-	galleryDir := service.galleryDir(galleryID)
-	err = os.MkdirAll(galleryDir, 0755)
+	publicID, err := newPublicID()
 	if err != nil {
-		return fmt.Errorf("creating gallery-%d images directory: %w", galleryID, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-	imagePath := filepath.Join(galleryDir, filename)
-	dst, err := os.Create(imagePath)
-	if err != nil {
-		return fmt.Errorf("creating image file: %w", err)
+	image := Image{
+		PublicID:    publicID,
+		GalleryID:   galleryID,
+		StorageKey:  fmt.Sprintf("gallery-%d/%s%s", galleryID, publicID, strings.ToLower(filepath.Ext(filename))),
+		Filename:    filename,
+		ContentType: http.DetectContentType(readBytes),
+		UploadedBy:  uploadedBy,
 	}
-	defer dst.Close()
 
+	// The file is kept in a temporary file until it is checked, so nothing
+	// is stored for files that aren't images
+	tmp, err := os.CreateTemp("", "lenslocked-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating image file: %w", err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
 	// 2. Merge the read bytes and the leftover bytes into a single io.Reader using io.MultiReader
 	completeFile := io.MultiReader(
 		bytes.NewReader(readBytes),
 		contents,
 	)
-	// 3. Copy that file into the destination.
-	_, err = io.Copy(dst, completeFile)
+	// 3. Copy that file into the temporary file, hashing it on the way.
+	// One byte more than is allowed is read to tell if it is too big.
+	maxSize := service.ImageSizeLimit()
+	hash := sha256.New()
+	image.Size, err = io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(completeFile, maxSize+1))
 	if err != nil {
-		return fmt.Errorf("copying contents to image: %w", err)
+		return nil, fmt.Errorf("copying contents to image: %w", err)
 	}
-	return nil
+	if image.Size > maxSize {
+		return nil, fmt.Errorf("creating image %v: %w", filename,
+			FileError{Issue: fmt.Sprintf("larger than %d MB", maxSize>>20)})
+	}
+	image.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	// The rest is read back from the temporary file as it is needed
+	rewind := func() error {
+		_, err := tmp.Seek(0, io.SeekStart)
+		return err
+	}
+	if err = rewind(); err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	image.Width, image.Height, err = imageDimensions(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, FileError{Issue: "unreadable image"})
+	}
+	if image.Width*image.Height > maxTransformSourcePixels {
+		return nil, fmt.Errorf("creating image %v: %w", filename, FileError{Issue: "image is too large"})
+	}
+	// Metadata is read wherever it is in the file, which can be at the end
+	image.Metadata = readImageMetadata(tmp, image.Size)
+	if image.Metadata.Orientation >= 5 {
+		// The photo is turned on its side, so it is shown the other way
+		// around
+		image.Width, image.Height = image.Height, image.Width
+	}
+	ctx := context.Background()
+	if err = rewind(); err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = service.storage().Put(ctx, image.StorageKey, tmp, image.Size, image.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	err = service.insertImage(&image)
+	if err != nil {
+		service.storage().Delete(ctx, image.StorageKey)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	// Variants that can't be made now are made when they are first asked
+	// for, so a failure here doesn't fail the upload
+	if rewind() == nil {
+		service.createVariants(ctx, image, tmp, service.ImageWidths(image))
+	}
+	return &image, nil
 }
 
-func (service *GalleryService) CreateImageViaURL(galleryID int, url string) error {
+// Add the image's row, setting its ID, and its CreatedAt unless it is set
+func (service *GalleryService) insertImage(image *Image) error {
+	var uploadedBy sql.NullInt64
+	if image.UploadedBy != 0 {
+		uploadedBy = sql.NullInt64{Int64: int64(image.UploadedBy), Valid: true}
+	}
+	if image.CreatedAt.IsZero() {
+		image.CreatedAt = time.Now()
+	}
+	meta := image.Metadata
+	var takenAt sql.NullTime
+	if !meta.TakenAt.IsZero() {
+		takenAt = sql.NullTime{Time: meta.TakenAt, Valid: true}
+	}
+	if meta.Orientation == 0 {
+		meta.Orientation = 1
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO images (public_id, gallery_id, storage_key, filename, content_type,
+			size, width, height, checksum, uploaded_by, created_at, camera_make,
+			camera_model, lens, exposure_time, f_number, focal_length, iso, taken_at,
+			orientation, has_location, has_metadata, legacy)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16,
+			$17, $18, $19, $20, $21, $22, $23)
+		RETURNING id;`, image.PublicID, image.GalleryID, image.StorageKey, image.Filename,
+		image.ContentType, image.Size, image.Width, image.Height, image.Checksum,
+		uploadedBy, image.CreatedAt, meta.CameraMake, meta.CameraModel, meta.Lens,
+		meta.ExposureTime, meta.FNumber, meta.FocalLength, meta.ISO, takenAt,
+		meta.Orientation, meta.HasLocation, meta.HasMetadata, image.Legacy)
+	return row.Scan(&image.ID)
+}
+
+// IndexImages adds the image files in storage that aren't in the
+// database yet, like the ones uploaded before images were kept there, and
+// returns how many it added. Files of galleries that no longer exist are
+// skipped.
+func (service *GalleryService) IndexImages() (int, error) {
+	ctx := context.Background()
+	blobs, err := service.storage().List(ctx, "gallery-")
+	if err != nil {
+		return 0, fmt.Errorf("index images: %w", err)
+	}
+	galleries := make(map[int]*Gallery)
+	added := 0
+	for _, blob := range blobs {
+		dir, filename, ok := strings.Cut(blob.Key, "/")
+		if !ok || strings.Contains(filename, "/") || !hasExtension(filename, service.extensions()) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(dir, "gallery-"))
+		if err != nil {
+			continue
+		}
+		gallery, seen := galleries[id]
+		if !seen {
+			gallery, err = service.FindByID(id)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return added, fmt.Errorf("index images: %w", err)
+			}
+			galleries[id] = gallery
+		}
+		if gallery == nil {
+			continue
+		}
+		ok, err = service.indexImage(ctx, gallery, blob)
+		if err != nil {
+			return added, fmt.Errorf("index images: %w", err)
+		}
+		if ok {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// Add the gallery's image file to the database, unless it is there
+// already. The gallery's owner is taken to have uploaded it.
+func (service *GalleryService) indexImage(ctx context.Context, gallery *Gallery, blob BlobInfo) (bool, error) {
+	filename := path.Base(blob.Key)
+	publicID, err := newPublicID()
+	if err != nil {
+		return false, err
+	}
+	image := Image{
+		PublicID:   publicID,
+		GalleryID:  gallery.ID,
+		StorageKey: blob.Key,
+		Filename:   filename,
+		UploadedBy: gallery.UserID,
+		CreatedAt:  blob.ModTime,
+		Legacy:     true,
+	}
+	var exists bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM images WHERE storage_key = $1);`, image.StorageKey)
+	err = row.Scan(&exists)
+	if err != nil || exists {
+		return false, err
+	}
+
+	f, err := service.storage().Get(ctx, blob.Key, 0, -1)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", blob.Key, err)
+	}
+	image.ContentType = http.DetectContentType(data)
+	// Files that were already served are kept even if they can't be
+	// decoded, without dimensions
+	image.Width, image.Height, _ = imageDimensions(bytes.NewReader(data))
+	image.Metadata = readImageMetadata(bytes.NewReader(data), int64(len(data)))
+	if image.Metadata.Orientation >= 5 {
+		image.Width, image.Height = image.Height, image.Width
+	}
+	image.Size = blob.Size
+	checksum := sha256.Sum256(data)
+	image.Checksum = hex.EncodeToString(checksum[:])
+	err = service.insertImage(&image)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", blob.Key, err)
+	}
+	return true, nil
+}
+
+// The width and height of the image
+func imageDimensions(r io.Reader) (int, int, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+func (service *GalleryService) CreateImageViaURL(galleryID, uploadedBy int, url string) error {
 	filename := path.Base(url)
 	res, err := http.Get(url)
 	if err != nil {
@@ -228,7 +791,13 @@ func (service *GalleryService) CreateImageViaURL(galleryID int, url string) erro
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("downloading image: invalid status code %d", res.StatusCode)
 	}
-	return service.CreateImage(galleryID, filename, res.Body)
+	_, err = service.CreateImage(galleryID, uploadedBy, filename, res.Body)
+	return err
+}
+
+// IsImage reports whether the filename has an image extension we accept
+func (service *GalleryService) IsImage(filename string) bool {
+	return hasExtension(filename, service.extensions())
 }
 
 // Check if the file has any of the given extensions
@@ -243,12 +812,25 @@ func hasExtension(file string, extensions []string) bool {
 	return false
 }
 
+// DefaultMaxImageSize is the largest image file, in bytes, that can be
+// added when no other maximum is given
+const DefaultMaxImageSize = 50 << 20
+
+// ImageSizeLimit returns the largest file, in bytes, that can be added as
+// an image
+func (service *GalleryService) ImageSizeLimit() int64 {
+	if service.MaxImageSize <= 0 {
+		return DefaultMaxImageSize
+	}
+	return service.MaxImageSize
+}
+
 // Return a list of common extensions for images
 func (service *GalleryService) extensions() []string {
-	return []string{".png", ".jpg", ".jpeg", ".gif"}
+	return []string{".png", ".jpg", ".jpeg", ".gif", ".webp"}
 }
 
 // Return allowed content types
 func (service *GalleryService) imageContentTypes() []string {
-	return []string{"image/png", "image/jpg", "image/jpeg", "image/gif"}
+	return []string{"image/png", "image/jpg", "image/jpeg", "image/gif", "image/webp"}
 }
@@ -0,0 +1,370 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/rand"
+)
+
+// What a gallery's members can do. Each role can do everything the ones
+// before it can.
+const (
+	// RoleViewer members can see the gallery, whatever its visibility
+	RoleViewer = "viewer"
+	// RoleContributor members can add images too
+	RoleContributor = "contributor"
+	// RoleEditor members can also change the gallery's title and
+	// visibility, delete images and share the gallery
+	RoleEditor = "editor"
+	// RoleOwner is the user who created the gallery. Only they can delete
+	// it and manage its members. It is never a member's role.
+	RoleOwner = "owner"
+)
+
+const (
+	// DefaultInvitationDuration is the default time that a
+	// GalleryInvitation is valid for.
+	DefaultInvitationDuration = 7 * 24 * time.Hour
+)
+
+func roleRank(role string) int {
+	switch role {
+	case RoleViewer:
+		return 1
+	case RoleContributor:
+		return 2
+	case RoleEditor:
+		return 3
+	case RoleOwner:
+		return 4
+	}
+	return 0
+}
+
+// RoleAtLeast reports whether role can do everything min can
+func RoleAtLeast(role, min string) bool {
+	return roleRank(min) > 0 && roleRank(role) >= roleRank(min)
+}
+
+// Whether role can be given to a member
+func memberRole(role string) bool {
+	return role == RoleViewer || role == RoleContributor || role == RoleEditor
+}
+
+type GalleryMember struct {
+	GalleryID int
+	UserID    int
+	Email     string
+	Role      string
+	CreatedAt time.Time
+}
+
+// GalleryInvitation invites whoever has the email address to become a
+// member of a gallery
+type GalleryInvitation struct {
+	ID        int
+	GalleryID int
+	Email     string
+	Role      string
+	// InvitedBy is the ID of the user who sent the invitation
+	InvitedBy int
+	// Token is only set when a GalleryInvitation is being created.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// SharedGallery is a gallery the user is a member of
+type SharedGallery struct {
+	Gallery
+	Role string
+}
+
+type GalleryMemberService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each invitation token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+	// Duration is the amount of time that a GalleryInvitation is valid for.
+	// Defaults to DefaultInvitationDuration
+	Duration time.Duration
+}
+
+// Role returns the user's role in the gallery, or "" if they aren't a
+// member. It doesn't know about owners, who aren't members.
+func (service *GalleryMemberService) Role(galleryID, userID int) (string, error) {
+	var role string
+	row := service.DB.QueryRow(`
+		SELECT role
+		FROM gallery_members
+		WHERE gallery_id = $1 AND user_id = $2;`, galleryID, userID)
+	err := row.Scan(&role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("member role: %w", err)
+	}
+	return role, nil
+}
+
+// Members returns the gallery's members, in the order they joined
+func (service *GalleryMemberService) Members(galleryID int) ([]GalleryMember, error) {
+	rows, err := service.DB.Query(`
+		SELECT gallery_members.user_id, users.email, gallery_members.role, gallery_members.created_at
+		FROM gallery_members
+		JOIN users ON users.id = gallery_members.user_id
+		WHERE gallery_members.gallery_id = $1
+		ORDER BY gallery_members.created_at;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("gallery members: %w", err)
+	}
+	defer rows.Close()
+	var members []GalleryMember
+	for rows.Next() {
+		member := GalleryMember{
+			GalleryID: galleryID,
+		}
+		err = rows.Scan(&member.UserID, &member.Email, &member.Role, &member.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("gallery members: %w", err)
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("gallery members: %w", err)
+	}
+	return members, nil
+}
+
+// Galleries returns the galleries the user is a member of
+func (service *GalleryMemberService) Galleries(userID int) ([]SharedGallery, error) {
+	rows, err := service.DB.Query(`
+		SELECT galleries.id, galleries.public_id, galleries.user_id, galleries.title,
+			galleries.visibility, galleries.title_in_url, gallery_members.role
+		FROM gallery_members
+		JOIN galleries ON galleries.id = gallery_members.gallery_id
+		WHERE gallery_members.user_id = $1
+		ORDER BY galleries.title;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("shared galleries: %w", err)
+	}
+	defer rows.Close()
+	var galleries []SharedGallery
+	for rows.Next() {
+		var gallery SharedGallery
+		err = rows.Scan(&gallery.ID, &gallery.PublicID, &gallery.UserID, &gallery.Title,
+			&gallery.Visibility, &gallery.TitleInURL, &gallery.Role)
+		if err != nil {
+			return nil, fmt.Errorf("shared galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("shared galleries: %w", err)
+	}
+	return galleries, nil
+}
+
+// SetRole changes the member's role. Returns ErrInvalidRole for roles
+// members can't have.
+func (service *GalleryMemberService) SetRole(galleryID, userID int, role string) error {
+	if !memberRole(role) {
+		return ErrInvalidRole
+	}
+	_, err := service.DB.Exec(`
+		UPDATE gallery_members
+		SET role = $3
+		WHERE gallery_id = $1 AND user_id = $2;`, galleryID, userID, role)
+	if err != nil {
+		return fmt.Errorf("set member role: %w", err)
+	}
+	return nil
+}
+
+// Remove the user from the gallery's members
+func (service *GalleryMemberService) Remove(galleryID, userID int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM gallery_members
+		WHERE gallery_id = $1 AND user_id = $2;`, galleryID, userID)
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+	return nil
+}
+
+// Invite the email address to the gallery with the given role, replacing
+// any earlier invitation to it so only the most recent link works.
+// Returns ErrInvalidRole for roles members can't have.
+func (service *GalleryMemberService) Invite(galleryID, invitedBy int, email, role string) (*GalleryInvitation, error) {
+	if !memberRole(role) {
+		return nil, ErrInvalidRole
+	}
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("invite: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultInvitationDuration
+	}
+	invitation := GalleryInvitation{
+		GalleryID: galleryID,
+		Email:     strings.ToLower(strings.TrimSpace(email)),
+		Role:      role,
+		InvitedBy: invitedBy,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO gallery_invitations (gallery_id, email, role, invited_by, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (gallery_id, email) DO
+		UPDATE
+		SET role = $3, invited_by = $4, token_hash = $5, expires_at = $6
+		RETURNING id;`, invitation.GalleryID, invitation.Email, invitation.Role,
+		invitation.InvitedBy, invitation.TokenHash, invitation.ExpiresAt)
+	err = row.Scan(&invitation.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invite: %w", err)
+	}
+	return &invitation, nil
+}
+
+// Invitations returns the gallery's invitations that haven't been
+// accepted or expired yet
+func (service *GalleryMemberService) Invitations(galleryID int) ([]GalleryInvitation, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, email, role, invited_by, expires_at
+		FROM gallery_invitations
+		WHERE gallery_id = $1 AND expires_at > NOW()
+		ORDER BY email;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("gallery invitations: %w", err)
+	}
+	defer rows.Close()
+	var invitations []GalleryInvitation
+	for rows.Next() {
+		invitation := GalleryInvitation{
+			GalleryID: galleryID,
+		}
+		err = rows.Scan(&invitation.ID, &invitation.Email, &invitation.Role,
+			&invitation.InvitedBy, &invitation.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("gallery invitations: %w", err)
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("gallery invitations: %w", err)
+	}
+	return invitations, nil
+}
+
+// Invitation finds the invitation with the given token without using it
+// up. Returns ErrTokenInvalid if there is no such invitation and
+// ErrTokenExpired if it has expired.
+func (service *GalleryMemberService) Invitation(token string) (*GalleryInvitation, error) {
+	invitation := GalleryInvitation{
+		TokenHash: service.hash(token),
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, gallery_id, email, role, invited_by, expires_at
+		FROM gallery_invitations
+		WHERE token_hash = $1;`, invitation.TokenHash)
+	err := row.Scan(&invitation.ID, &invitation.GalleryID, &invitation.Email,
+		&invitation.Role, &invitation.InvitedBy, &invitation.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTokenInvalid
+		}
+		return nil, fmt.Errorf("invitation: %w", err)
+	}
+	if time.Now().After(invitation.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return &invitation, nil
+}
+
+// Accept the invitation with the given token on behalf of the user, who
+// becomes a member of the gallery. Returns ErrTokenInvalid or
+// ErrTokenExpired like Invitation, ErrUnverifiedEmail if the user hasn't
+// verified their email address, and ErrInvitationEmail if the invitation
+// was sent to another email address.
+func (service *GalleryMemberService) Accept(token string, user *User) (*GalleryMember, error) {
+	if !user.EmailVerified() {
+		return nil, ErrUnverifiedEmail
+	}
+	invitation, err := service.Invitation(token)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(invitation.Email, user.Email) {
+		return nil, ErrInvitationEmail
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`
+		DELETE FROM gallery_invitations
+		WHERE id = $1;`, invitation.ID)
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	// Someone else may have accepted it in the meantime
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, ErrTokenInvalid
+	}
+	member := GalleryMember{
+		GalleryID: invitation.GalleryID,
+		UserID:    user.ID,
+		Email:     user.Email,
+		Role:      invitation.Role,
+	}
+	row := tx.QueryRow(`
+		INSERT INTO gallery_members (gallery_id, user_id, role)
+		VALUES ($1, $2, $3) ON CONFLICT (gallery_id, user_id) DO
+		UPDATE
+		SET role = $3
+		RETURNING created_at;`, member.GalleryID, member.UserID, member.Role)
+	err = row.Scan(&member.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	return &member, nil
+}
+
+// RevokeInvitation deletes the gallery's invitation with the given ID
+func (service *GalleryMemberService) RevokeInvitation(galleryID, id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM gallery_invitations
+		WHERE id = $1 AND gallery_id = $2;`, id, galleryID)
+	if err != nil {
+		return fmt.Errorf("revoke invitation: %w", err)
+	}
+	return nil
+}
+
+func (service *GalleryMemberService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/rand"
+)
+
+const (
+	// DefaultShareDuration is how long a share link works when no other
+	// duration is given
+	DefaultShareDuration = 14 * 24 * time.Hour
+	// ShareViewGrace is how long the images of a link's last view can be
+	// loaded once it has no views left
+	ShareViewGrace = time.Hour
+)
+
+// GalleryShare is a link that lets anyone who has it see a gallery, no
+// matter its visibility, until it expires or runs out of views.
+type GalleryShare struct {
+	ID        int
+	GalleryID int
+	// Token is only set when a GalleryShare is being created.
+	Token     string
+	TokenHash string
+	// AllowDownloads lets viewers download the original images
+	AllowDownloads bool
+	// MaxViews is how many times the gallery can be viewed through the
+	// link, or 0 if there is no limit
+	MaxViews  int
+	Views     int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type GalleryShareService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each share token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+}
+
+// Create a share link for the gallery. It works for duration, which
+// defaults to DefaultShareDuration.
+func (service *GalleryShareService) Create(galleryID int, duration time.Duration, maxViews int, allowDownloads bool) (*GalleryShare, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create share: %w", err)
+	}
+	if duration <= 0 {
+		duration = DefaultShareDuration
+	}
+	if maxViews < 0 {
+		maxViews = 0
+	}
+	// Links that stopped working are cleaned up when there is a new one
+	_, err = service.DB.Exec(`
+		DELETE FROM gallery_shares
+		WHERE gallery_id = $1
+			AND (expires_at <= NOW() OR (max_views > 0 AND views >= max_views
+				AND (last_viewed_at IS NULL OR last_viewed_at <= $2)));`,
+		galleryID, time.Now().Add(-ShareViewGrace))
+	if err != nil {
+		return nil, fmt.Errorf("create share: %w", err)
+	}
+	now := time.Now()
+	share := GalleryShare{
+		GalleryID:      galleryID,
+		Token:          token,
+		TokenHash:      service.hash(token),
+		AllowDownloads: allowDownloads,
+		MaxViews:       maxViews,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(duration),
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO gallery_shares (gallery_id, token_hash, allow_downloads, max_views, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id;`, share.GalleryID, share.TokenHash, share.AllowDownloads,
+		share.MaxViews, share.CreatedAt, share.ExpiresAt)
+	err = row.Scan(&share.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create share: %w", err)
+	}
+	return &share, nil
+}
+
+// View counts a view of the gallery through the share link with the
+// given token. Returns ErrNotFound if there is no such link, it has
+// expired or it has no views left.
+func (service *GalleryShareService) View(token string) (*GalleryShare, error) {
+	share := GalleryShare{
+		TokenHash: service.hash(token),
+	}
+	row := service.DB.QueryRow(`
+		UPDATE gallery_shares
+		SET views = views + 1, last_viewed_at = NOW()
+		WHERE token_hash = $1 AND expires_at > NOW()
+			AND (max_views = 0 OR views < max_views)
+		RETURNING id, gallery_id, allow_downloads, max_views, views, created_at, expires_at;`, share.TokenHash)
+	err := row.Scan(&share.ID, &share.GalleryID, &share.AllowDownloads,
+		&share.MaxViews, &share.Views, &share.CreatedAt, &share.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("view share: %w", err)
+	}
+	return &share, nil
+}
+
+// ByToken finds the share link with the given token without counting a
+// view, for the images on a page that already counted one. Returns
+// ErrNotFound if there is no such link, it has expired, or it ran out of
+// views more than ShareViewGrace ago.
+func (service *GalleryShareService) ByToken(token string) (*GalleryShare, error) {
+	share := GalleryShare{
+		TokenHash: service.hash(token),
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, gallery_id, allow_downloads, max_views, views, created_at, expires_at
+		FROM gallery_shares
+		WHERE token_hash = $1 AND expires_at > NOW()
+			AND (max_views = 0 OR views < max_views OR last_viewed_at > $2);`,
+		share.TokenHash, time.Now().Add(-ShareViewGrace))
+	err := row.Scan(&share.ID, &share.GalleryID, &share.AllowDownloads,
+		&share.MaxViews, &share.Views, &share.CreatedAt, &share.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("share by token: %w", err)
+	}
+	return &share, nil
+}
+
+// ByGalleryID returns the gallery's share links that can still be viewed,
+// newest first
+func (service *GalleryShareService) ByGalleryID(galleryID int) ([]GalleryShare, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, allow_downloads, max_views, views, created_at, expires_at
+		FROM gallery_shares
+		WHERE gallery_id = $1 AND expires_at > NOW()
+			AND (max_views = 0 OR views < max_views)
+		ORDER BY created_at DESC;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("shares by gallery id: %w", err)
+	}
+	defer rows.Close()
+	var shares []GalleryShare
+	for rows.Next() {
+		share := GalleryShare{
+			GalleryID: galleryID,
+		}
+		err = rows.Scan(&share.ID, &share.AllowDownloads, &share.MaxViews,
+			&share.Views, &share.CreatedAt, &share.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("shares by gallery id: %w", err)
+		}
+		shares = append(shares, share)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("shares by gallery id: %w", err)
+	}
+	return shares, nil
+}
+
+// Delete revokes the gallery's share link with the given ID
+func (service *GalleryShareService) Delete(galleryID, id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM gallery_shares
+		WHERE id = $1 AND gallery_id = $2;`, id, galleryID)
+	if err != nil {
+		return fmt.Errorf("delete share: %w", err)
+	}
+	return nil
+}
+
+func (service *GalleryShareService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,966 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	stdimage "image"
+	"image/draw"
+	"io"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What is removed from the images of a gallery before they are sent
+const (
+	// StripMetadataLocation removes GPS coordinates, keeping the rest
+	StripMetadataLocation = "location"
+	// StripMetadataAll removes all metadata but the orientation, which is
+	// needed to show photos the right way up
+	StripMetadataAll = "all"
+)
+
+// ImageMetadata is what is read from a photo's EXIF and XMP metadata when
+// it is uploaded. Fields that aren't in the photo are left empty.
+type ImageMetadata struct {
+	CameraMake  string
+	CameraModel string
+	Lens        string
+	// ExposureTime is in seconds, like "1/250"
+	ExposureTime string
+	FNumber      float64
+	// FocalLength is in millimeters
+	FocalLength float64
+	ISO         int
+	// TakenAt is the camera's clock when the photo was taken, which has no
+	// time zone
+	TakenAt time.Time
+	// Orientation is the EXIF orientation, from 1, upright, to 8
+	Orientation int
+	// HasLocation is set when the file has GPS coordinates in it. The
+	// coordinates themselves are never read.
+	HasLocation bool
+	// HasMetadata is set when the file has any EXIF, XMP or text metadata
+	HasMetadata bool
+}
+
+// The largest EXIF or XMP block that is read. Bigger ones are treated as
+// if they had anything in them, a location included.
+const maxMetadataSize = 4 << 20
+
+// A piece of metadata in an image file
+type metadataBlock struct {
+	// kind is "exif", "xmp" or "text", or for JPEGs "mpf" for the index of
+	// the extra images after the main one, and "trailer" for anything
+	// after the main image, like those images
+	kind string
+	// start and end are the offsets of the whole segment or chunk that
+	// holds it
+	start, end int64
+	// payload is only read for EXIF and XMP, and is nil if it is bigger
+	// than maxMetadataSize
+	payload []byte
+}
+
+var errUnknownImageFormat = errors.New("unknown image format")
+
+// Read exactly n bytes at off
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	read, err := r.ReadAt(b, off)
+	if read == n {
+		return b, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// Read a block's payload, unless it is too big
+func readPayload(r io.ReaderAt, off, n int64) ([]byte, error) {
+	if n > maxMetadataSize {
+		return nil, nil
+	}
+	return readAt(r, off, int(n))
+}
+
+// Find the metadata in a JPEG, PNG or WebP file of the given size,
+// returning which of those it is. Only the metadata is read, so this
+// works on files of any size.
+func metadataBlocks(r io.ReaderAt, size int64) (string, []metadataBlock, error) {
+	head, err := readAt(r, 0, int(min(size, 12)))
+	if err != nil {
+		return "", nil, err
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("\xff\xd8")):
+		blocks, err := jpegMetadata(r, size)
+		return "jpeg", blocks, err
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		blocks, err := pngMetadata(r, size)
+		return "png", blocks, err
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		blocks, err := webpMetadata(r, size)
+		return "webp", blocks, err
+	}
+	return "", nil, errUnknownImageFormat
+}
+
+const (
+	jpegExifPrefix = "Exif\x00\x00"
+	jpegXMPPrefix  = "http://ns.adobe.com/xap/1.0/\x00"
+	// Extended XMP continues packets too big for one segment
+	jpegExtendedXMPPrefix = "http://ns.adobe.com/xmp/extension/\x00"
+	// The Multi-Picture Format lists images stored after the main one,
+	// like a phone's depth map, which can have their own EXIF
+	jpegMPFPrefix = "MPF\x00"
+	pngXMPKeyword = "XML:com.adobe.xmp\x00"
+)
+
+// JPEG metadata is in APP1 (EXIF and XMP), APP13 (IPTC) and comment
+// segments before the image data, and in anything after the image
+func jpegMetadata(r io.ReaderAt, size int64) ([]metadataBlock, error) {
+	var blocks []metadataBlock
+	i := int64(2)
+	for i+4 <= size {
+		header, err := readAt(r, i, 4)
+		if err != nil {
+			return blocks, err
+		}
+		if header[0] != 0xff {
+			return blocks, fmt.Errorf("invalid jpeg marker at %d", i)
+		}
+		marker := header[1]
+		if marker == 0xff {
+			// Fill byte
+			i++
+			continue
+		}
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		if marker == 0xd9 {
+			return append(blocks, jpegTrailer(i+2, size)...), nil
+		}
+		end := i + 2 + int64(binary.BigEndian.Uint16(header[2:]))
+		if end > size || end < i+4 {
+			return blocks, fmt.Errorf("invalid jpeg segment at %d", i)
+		}
+		switch marker {
+		case 0xda:
+			// The image data starts, and no metadata comes after it but
+			// what is after the end of the image
+			return append(blocks, jpegTrailer(jpegImageEnd(r, end, size), size)...), nil
+		case 0xe1, 0xe2:
+			payload, err := readAt(r, i+4, int(end-i-4))
+			if err != nil {
+				return blocks, err
+			}
+			switch {
+			case marker == 0xe1 && bytes.HasPrefix(payload, []byte(jpegExifPrefix)):
+				blocks = append(blocks, metadataBlock{"exif", i, end, payload[len(jpegExifPrefix):]})
+			case marker == 0xe1 && bytes.HasPrefix(payload, []byte(jpegXMPPrefix)):
+				blocks = append(blocks, metadataBlock{"xmp", i, end, payload[len(jpegXMPPrefix):]})
+			case marker == 0xe1 && bytes.HasPrefix(payload, []byte(jpegExtendedXMPPrefix)):
+				blocks = append(blocks, metadataBlock{"xmp", i, end, payload[len(jpegExtendedXMPPrefix):]})
+			case marker == 0xe2 && bytes.HasPrefix(payload, []byte(jpegMPFPrefix)):
+				blocks = append(blocks, metadataBlock{"mpf", i, end, nil})
+			}
+		case 0xed, 0xfe:
+			blocks = append(blocks, metadataBlock{"text", i, end, nil})
+		}
+		i = end
+	}
+	return blocks, nil
+}
+
+// Whatever follows the end of a JPEG's image
+func jpegTrailer(imageEnd, size int64) []metadataBlock {
+	if imageEnd >= size {
+		return nil
+	}
+	return []metadataBlock{{"trailer", imageEnd, size, nil}}
+}
+
+// Where a JPEG's image ends, after its end of image marker, or the size of
+// the file if it has none. The image data is entropy coded with any 0xff
+// bytes followed by 0x00, and progressive JPEGs have more segments and
+// scans between the scans.
+func jpegImageEnd(r io.ReaderAt, start, size int64) int64 {
+	br := bufio.NewReader(io.NewSectionReader(r, start, size-start))
+	at := start
+	for {
+		skipped, err := br.ReadSlice(0xff)
+		at += int64(len(skipped))
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return size
+		}
+		marker, err := br.ReadByte()
+		if err != nil {
+			return size
+		}
+		at++
+		switch {
+		case marker == 0xd9:
+			return at
+		case marker == 0x00 || (marker >= 0xd0 && marker <= 0xd7):
+		case marker == 0xff:
+			// A fill byte before the marker
+			br.UnreadByte()
+			at--
+		default:
+			header, err := br.Peek(2)
+			if err != nil {
+				return size
+			}
+			length := int64(binary.BigEndian.Uint16(header))
+			if length < 2 {
+				return size
+			}
+			discarded, err := br.Discard(int(length))
+			at += int64(discarded)
+			if err != nil {
+				return size
+			}
+		}
+	}
+}
+
+// PNG metadata is in eXIf chunks for EXIF, and text chunks, one of which
+// can be XMP
+func pngMetadata(r io.ReaderAt, size int64) ([]metadataBlock, error) {
+	var blocks []metadataBlock
+	i := int64(8)
+	for i+12 <= size {
+		header, err := readAt(r, i, 8)
+		if err != nil {
+			return blocks, err
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		chunkType := string(header[4:8])
+		end := i + 12 + length
+		if end > size {
+			return blocks, fmt.Errorf("invalid png chunk at %d", i)
+		}
+		var payload []byte
+		if chunkType == "eXIf" || chunkType == "iTXt" {
+			payload, err = readPayload(r, i+8, length)
+			if err != nil {
+				return blocks, err
+			}
+		}
+		switch {
+		case chunkType == "eXIf":
+			blocks = append(blocks, metadataBlock{"exif", i, end, payload})
+		case chunkType == "iTXt" && bytes.HasPrefix(payload, []byte(pngXMPKeyword)):
+			// The keyword is followed by compression flag and method, and
+			// empty language and translated keyword
+			xmp := payload[len(pngXMPKeyword):]
+			if len(xmp) >= 4 && xmp[0] == 0 {
+				xmp = xmp[4:]
+			}
+			blocks = append(blocks, metadataBlock{"xmp", i, end, xmp})
+		case chunkType == "iTXt" && payload == nil:
+			// Too big to tell if it is XMP
+			blocks = append(blocks, metadataBlock{"xmp", i, end, nil})
+		case chunkType == "tEXt" || chunkType == "zTXt" || chunkType == "iTXt" || chunkType == "tIME":
+			blocks = append(blocks, metadataBlock{"text", i, end, nil})
+		case chunkType == "IEND":
+			return blocks, nil
+		}
+		i = end
+	}
+	return blocks, nil
+}
+
+// WebP metadata is in EXIF and XMP chunks, usually after the image data
+func webpMetadata(r io.ReaderAt, size int64) ([]metadataBlock, error) {
+	var blocks []metadataBlock
+	i := int64(12)
+	for i+8 <= size {
+		header, err := readAt(r, i, 8)
+		if err != nil {
+			return blocks, err
+		}
+		chunkType := string(header[:4])
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		end := i + 8 + length + length%2
+		if end > size {
+			return blocks, fmt.Errorf("invalid webp chunk at %d", i)
+		}
+		switch chunkType {
+		case "EXIF":
+			payload, err := readPayload(r, i+8, length)
+			if err != nil {
+				return blocks, err
+			}
+			blocks = append(blocks, metadataBlock{"exif", i, end, bytes.TrimPrefix(payload, []byte(jpegExifPrefix))})
+		case "XMP ":
+			payload, err := readPayload(r, i+8, length)
+			if err != nil {
+				return blocks, err
+			}
+			blocks = append(blocks, metadataBlock{"xmp", i, end, payload})
+		}
+		i = end
+	}
+	return blocks, nil
+}
+
+// readImageMetadata reads the metadata of a JPEG, PNG or WebP file of the
+// given size. Other files give empty metadata.
+func readImageMetadata(r io.ReaderAt, size int64) ImageMetadata {
+	// What was found before the file stopped making sense is still read
+	_, blocks, _ := metadataBlocks(r, size)
+	return blocksMetadata(blocks)
+}
+
+func blocksMetadata(blocks []metadataBlock) ImageMetadata {
+	var meta ImageMetadata
+	for _, block := range blocks {
+		meta.HasMetadata = true
+		switch {
+		case block.kind == "trailer" || block.payload == nil && (block.kind == "exif" || block.kind == "xmp"):
+			// What isn't read, like the extra images after a JPEG with
+			// their own EXIF, could have a location
+			meta.HasLocation = true
+		case block.kind == "exif":
+			readEXIF(block.payload, &meta)
+		case block.kind == "xmp":
+			readXMP(string(block.payload), &meta)
+		}
+	}
+	return meta
+}
+
+// EXIF tags that are read
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagSubIFDs          = 0x014a
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagInteropIFD       = 0xa005
+	tagExposureTime     = 0x829a
+	tagFNumber          = 0x829d
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920a
+	tagLensModel        = 0xa434
+)
+
+// The EXIF date and time format
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// EXIF data is a TIFF file, with tags in image file directories (IFDs)
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// offset is where the entry is. The value is there if it fits in 4
+	// bytes, or it points to the value.
+	offset int
+}
+
+func newTIFF(data []byte) (*tiff, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("exif too short")
+	}
+	t := tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid exif byte order")
+	}
+	return &t, nil
+}
+
+// The entries of the IFD at offset, or none if it isn't valid
+func (t *tiff) ifd(offset int) []tiffEntry {
+	if offset <= 0 || offset+2 > len(t.data) {
+		return nil
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	if offset+2+count*12 > len(t.data) {
+		return nil
+	}
+	entries := make([]tiffEntry, count)
+	for i := range entries {
+		at := offset + 2 + i*12
+		entries[i] = tiffEntry{
+			tag:    t.order.Uint16(t.data[at:]),
+			typ:    t.order.Uint16(t.data[at+2:]),
+			count:  t.order.Uint32(t.data[at+4:]),
+			offset: at,
+		}
+	}
+	return entries
+}
+
+// The size of each value of the TIFF types
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// The entry's value bytes, or nil if they are out of range
+func (t *tiff) value(entry tiffEntry) []byte {
+	size := tiffTypeSizes[entry.typ] * int(entry.count)
+	if size <= 0 || entry.count > 1<<20 {
+		return nil
+	}
+	at := entry.offset + 8
+	if size > 4 {
+		at = int(t.order.Uint32(t.data[entry.offset+8:]))
+	}
+	if at < 0 || at+size > len(t.data) {
+		return nil
+	}
+	return t.data[at : at+size]
+}
+
+func (t *tiff) string(entry tiffEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(t.value(entry)), "\x00"))
+}
+
+// The first value of a SHORT or LONG entry
+func (t *tiff) uint(entry tiffEntry) int {
+	value := t.value(entry)
+	switch {
+	case entry.typ == 3 && len(value) >= 2:
+		return int(t.order.Uint16(value))
+	case entry.typ == 4 && len(value) >= 4:
+		return int(t.order.Uint32(value))
+	}
+	return 0
+}
+
+// The values of a SHORT, LONG or IFD entry
+func (t *tiff) uints(entry tiffEntry) []int {
+	value := t.value(entry)
+	var values []int
+	switch entry.typ {
+	case 3:
+		for i := 0; i+2 <= len(value); i += 2 {
+			values = append(values, int(t.order.Uint16(value[i:])))
+		}
+	case 4, 13:
+		for i := 0; i+4 <= len(value); i += 4 {
+			values = append(values, int(t.order.Uint32(value[i:])))
+		}
+	}
+	return values
+}
+
+// The most IFDs that are looked through for GPS data
+const maxIFDs = 64
+
+// The offsets of the GPS IFDs. Besides IFD0 they can be pointed to from
+// the IFDs after it, like IFD1 with the thumbnail, and from sub-IFDs like
+// the Exif IFD.
+func (t *tiff) gpsIFDs() []int {
+	var gps []int
+	queue := []int{int(t.order.Uint32(t.data[4:]))}
+	seen := make(map[int]bool)
+	for len(queue) > 0 && len(seen) < maxIFDs {
+		offset := queue[0]
+		queue = queue[1:]
+		if seen[offset] {
+			continue
+		}
+		seen[offset] = true
+		entries := t.ifd(offset)
+		for _, entry := range entries {
+			switch entry.tag {
+			case tagGPSIFD:
+				gps = append(gps, t.uints(entry)...)
+			case tagExifIFD, tagInteropIFD, tagSubIFDs:
+				queue = append(queue, t.uints(entry)...)
+			}
+		}
+		if next := offset + 2 + len(entries)*12; len(entries) > 0 && next+4 <= len(t.data) {
+			queue = append(queue, int(t.order.Uint32(t.data[next:])))
+		}
+		// Broken or hostile EXIF can point to far more IFDs than there are
+		queue = queue[:min(len(queue), maxIFDs)]
+		gps = gps[:min(len(gps), maxIFDs)]
+	}
+	return gps
+}
+
+// The first value of a RATIONAL entry, as its numerator and denominator
+func (t *tiff) rational(entry tiffEntry) (uint32, uint32) {
+	value := t.value(entry)
+	if entry.typ != 5 || len(value) < 8 {
+		return 0, 0
+	}
+	return t.order.Uint32(value), t.order.Uint32(value[4:])
+}
+
+func readEXIF(data []byte, meta *ImageMetadata) {
+	t, err := newTIFF(data)
+	if err != nil {
+		return
+	}
+	ifd0 := t.ifd(int(t.order.Uint32(data[4:])))
+	entries := ifd0
+	for _, entry := range ifd0 {
+		if entry.tag == tagExifIFD {
+			entries = append(entries, t.ifd(t.uint(entry))...)
+			break
+		}
+	}
+	for _, offset := range t.gpsIFDs() {
+		meta.HasLocation = meta.HasLocation || len(t.ifd(offset)) > 0
+	}
+	for _, entry := range entries {
+		switch entry.tag {
+		case tagMake:
+			meta.CameraMake = t.string(entry)
+		case tagModel:
+			meta.CameraModel = t.string(entry)
+		case tagLensModel:
+			meta.Lens = t.string(entry)
+		case tagOrientation:
+			if o := t.uint(entry); o >= 1 && o <= 8 {
+				meta.Orientation = o
+			}
+		case tagISO:
+			meta.ISO = t.uint(entry)
+		case tagExposureTime:
+			meta.ExposureTime = exposureTime(t.rational(entry))
+		case tagFNumber:
+			meta.FNumber = ratio(t.rational(entry))
+		case tagFocalLength:
+			meta.FocalLength = ratio(t.rational(entry))
+		case tagDateTimeOriginal:
+			takenAt, err := time.Parse(exifTimeLayout, t.string(entry))
+			if err == nil {
+				meta.TakenAt = takenAt
+			}
+		}
+	}
+}
+
+func ratio(num, den uint32) float64 {
+	if den == 0 {
+		return 0
+	}
+	return math.Round(float64(num)/float64(den)*10) / 10
+}
+
+// An exposure time like photographers write them: "1/250" or "2.5"
+func exposureTime(num, den uint32) string {
+	if num == 0 || den == 0 {
+		return ""
+	}
+	if num < den {
+		return fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+	}
+	return strconv.FormatFloat(ratio(num, den), 'f', -1, 64)
+}
+
+// XMP properties are attributes like exif:FNumber="28/10" or elements
+// like <exif:FNumber>28/10</exif:FNumber>. Lists like the ISO have their
+// first item read.
+var xmpProperty = regexp.MustCompile(`(\w+:\w+)(?:="([^"]*)"|>\s*(?:<rdf:\w+>\s*<rdf:li>)?([^<]*)<)`)
+
+// readXMP fills in what the EXIF didn't from an XMP packet
+func readXMP(packet string, meta *ImageMetadata) {
+	for _, match := range xmpProperty.FindAllStringSubmatch(packet, -1) {
+		name, value := match[1], strings.TrimSpace(match[2]+match[3])
+		if value == "" {
+			continue
+		}
+		switch name {
+		case "tiff:Make":
+			meta.CameraMake = firstOf(meta.CameraMake, value)
+		case "tiff:Model":
+			meta.CameraModel = firstOf(meta.CameraModel, value)
+		case "aux:Lens", "exifEX:LensModel":
+			meta.Lens = firstOf(meta.Lens, value)
+		case "exif:ExposureTime":
+			if meta.ExposureTime == "" {
+				meta.ExposureTime = exposureTime(xmpRational(value))
+			}
+		case "exif:FNumber":
+			if meta.FNumber == 0 {
+				meta.FNumber = ratio(xmpRational(value))
+			}
+		case "exif:FocalLength":
+			if meta.FocalLength == 0 {
+				meta.FocalLength = ratio(xmpRational(value))
+			}
+		case "exif:ISOSpeedRatings", "exifEX:PhotographicSensitivity":
+			if meta.ISO == 0 {
+				meta.ISO, _ = strconv.Atoi(value)
+			}
+		case "tiff:Orientation":
+			if o, _ := strconv.Atoi(value); meta.Orientation == 0 && o >= 1 && o <= 8 {
+				meta.Orientation = o
+			}
+		case "exif:DateTimeOriginal", "photoshop:DateCreated":
+			if meta.TakenAt.IsZero() && len(value) >= 19 {
+				takenAt, err := time.Parse("2006-01-02T15:04:05", value[:19])
+				if err == nil {
+					meta.TakenAt = takenAt
+				}
+			}
+		case "exif:GPSLatitude", "exif:GPSLongitude":
+			meta.HasLocation = true
+		}
+	}
+}
+
+func firstOf(current, value string) string {
+	if current != "" {
+		return current
+	}
+	return value
+}
+
+func xmpRational(value string) (uint32, uint32) {
+	numStr, denStr, ok := strings.Cut(value, "/")
+	if !ok {
+		denStr = "1"
+	}
+	num, err := strconv.ParseUint(numStr, 10, 32)
+	if err != nil {
+		return 0, 0
+	}
+	den, err := strconv.ParseUint(denStr, 10, 32)
+	if err != nil {
+		return 0, 0
+	}
+	return uint32(num), uint32(den)
+}
+
+// stripMetadata returns a copy of the JPEG, PNG or WebP file of the given
+// size without its location, or without any metadata but its orientation,
+// depending on strip. The copy is read from r as it is read, and its size
+// is returned with it.
+func stripMetadata(r io.ReaderAt, size int64, strip string) (io.Reader, int64, error) {
+	format, blocks, err := metadataBlocks(r, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	orientation := blocksMetadata(blocks).Orientation
+	var exif ImageMetadata
+	var xmp []byte
+	unreadXMP := false
+	for _, block := range blocks {
+		switch block.kind {
+		case "exif":
+			readEXIF(block.payload, &exif)
+		case "xmp":
+			xmp = append(xmp, block.payload...)
+			unreadXMP = unreadXMP || block.payload == nil
+		}
+	}
+	// XMP can't be rewritten as easily as EXIF, so it all goes when it has
+	// a location. So do the extra images after a JPEG, with their EXIF.
+	keepXMP := strip == StripMetadataLocation && !unreadXMP && !xmpHasLocation(xmp)
+	kept := func(block metadataBlock) bool {
+		switch block.kind {
+		case "exif":
+			return strip == StripMetadataLocation && block.payload != nil
+		case "xmp":
+			return keepXMP
+		case "text":
+			return strip == StripMetadataLocation
+		}
+		return false
+	}
+	// The orientation is needed to show the photo the right way up, so it
+	// is kept even when it was only in the XMP
+	if strip == StripMetadataLocation && (exif.Orientation != 0 || keepXMP) {
+		orientation = 0
+	}
+
+	var out strippedFile
+	last := int64(0)
+	for _, block := range blocks {
+		if orientation > 1 && !kept(block) {
+			at := block.start
+			if format == "png" {
+				// Right after the header chunk, before the image data, if
+				// nothing was kept before it
+				at = max(last, min(at, 33))
+			}
+			out.copy(r, last, at)
+			out.write(encodeEXIFBlock(format, orientationEXIF(orientation)))
+			out.exif = true
+			last = at
+			orientation = 0
+		}
+		out.copy(r, last, block.start)
+		last = block.end
+		switch {
+		case !kept(block):
+		case block.kind == "exif":
+			out.write(encodeEXIFBlock(format, withoutGPS(block.payload)))
+			out.exif = true
+		default:
+			out.copy(r, block.start, block.end)
+			out.xmp = out.xmp || block.kind == "xmp"
+		}
+	}
+	out.copy(r, last, size)
+	if format == "webp" {
+		err = out.fixWebPHeader()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return io.MultiReader(out.parts...), out.size, nil
+}
+
+// strippedFile is the parts a file is put back together from once its
+// metadata is stripped
+type strippedFile struct {
+	parts []io.Reader
+	size  int64
+	// Whether EXIF or XMP were written
+	exif, xmp bool
+}
+
+// Copy the original from start to end
+func (f *strippedFile) copy(r io.ReaderAt, start, end int64) {
+	if end <= start {
+		return
+	}
+	f.parts = append(f.parts, io.NewSectionReader(r, start, end-start))
+	f.size += end - start
+}
+
+// Write a block of metadata
+func (f *strippedFile) write(block []byte) {
+	f.parts = append(f.parts, bytes.NewReader(block))
+	f.size += int64(len(block))
+}
+
+// Set the WebP file's size, and the flags for the EXIF and XMP chunks it
+// has left. The header is always copied from the original, as metadata
+// chunks come after it.
+func (f *strippedFile) fixWebPHeader() error {
+	first, ok := f.parts[0].(*io.SectionReader)
+	if !ok || first.Size() < 12 {
+		return fmt.Errorf("invalid webp header")
+	}
+	headerSize := int64(12)
+	if first.Size() >= 30 {
+		headerSize = 30
+	}
+	header, err := readAt(first, 0, int(headerSize))
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(header[4:], uint32(f.size-8))
+	if headerSize == 30 && string(header[12:16]) == "VP8X" {
+		const exifFlag, xmpFlag = 0x08, 0x04
+		header[20] &^= exifFlag | xmpFlag
+		if f.exif {
+			header[20] |= exifFlag
+		}
+		if f.xmp {
+			header[20] |= xmpFlag
+		}
+	}
+	rest := io.NewSectionReader(first, headerSize, first.Size()-headerSize)
+	f.parts = append([]io.Reader{bytes.NewReader(header), rest}, f.parts[1:]...)
+	return nil
+}
+
+// The version of stripMetadata that stripped copies were made with. It is
+// in their keys, so copies made before it strips something new aren't
+// served.
+const strippedVersion = 2
+
+// ServedImage returns the copy of the original image that is sent to
+// clients, without the metadata the gallery strips. Copies are made the
+// first time they are asked for, and images with nothing to strip are
+// sent as they are.
+func (service *GalleryService) ServedImage(ctx context.Context, gallery *Gallery, image Image) (*Image, error) {
+	strip := gallery.StripMetadata
+	if strip != StripMetadataAll {
+		strip = StripMetadataLocation
+	}
+	if !image.Metadata.HasMetadata || (strip == StripMetadataLocation && !image.Metadata.HasLocation) {
+		return &image, nil
+	}
+
+	stripped := image
+	stripped.StorageKey = fmt.Sprintf("gallery-%d/stripped/%s-%s-%d%s",
+		image.GalleryID, image.PublicID, strip, strippedVersion, path.Ext(image.StorageKey))
+	stripped.Checksum = ""
+	info, err := service.storage().Stat(ctx, stripped.StorageKey)
+	if errors.Is(err, ErrNotFound) {
+		err = service.stripImage(ctx, image, stripped.StorageKey, strip)
+		if errors.Is(err, errUnknownImageFormat) {
+			// Formats metadata isn't read from, like GIF, are sent as
+			// they are
+			return &image, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("served image: %w", err)
+		}
+		info, err = service.storage().Stat(ctx, stripped.StorageKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("served image: %w", err)
+	}
+	stripped.Size = info.Size
+	return &stripped, nil
+}
+
+// Store a copy of the image without the metadata under key
+func (service *GalleryService) stripImage(ctx context.Context, image Image, key, strip string) error {
+	original, err := service.storage().Get(ctx, image.StorageKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	// The parts of the original that are kept are read from a temporary
+	// copy of it, rather than from memory
+	tmp, err := os.CreateTemp("", "lenslocked-strip-*")
+	if err != nil {
+		original.Close()
+		return err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	size, err := io.Copy(tmp, original)
+	original.Close()
+	if err != nil {
+		return err
+	}
+	stripped, strippedSize, err := stripMetadata(tmp, size, strip)
+	if err != nil {
+		return err
+	}
+	return service.storage().Put(ctx, key, stripped, strippedSize, image.ContentType)
+}
+
+func xmpHasLocation(packet []byte) bool {
+	return bytes.Contains(packet, []byte("GPSLatitude")) || bytes.Contains(packet, []byte("GPSLongitude"))
+}
+
+// A copy of the EXIF data with its GPS directories emptied. The offsets of
+// everything else stay the same.
+func withoutGPS(data []byte) []byte {
+	data = bytes.Clone(data)
+	t, err := newTIFF(data)
+	if err != nil {
+		return data
+	}
+	for _, offset := range t.gpsIFDs() {
+		gps := t.ifd(offset)
+		for _, gpsEntry := range gps {
+			if value := t.value(gpsEntry); len(value) > 4 {
+				clear(value)
+			}
+		}
+		if len(gps) > 0 {
+			// No entries, and no next IFD
+			clear(data[offset:min(offset+2+len(gps)*12+4, len(data))])
+		}
+	}
+	return data
+}
+
+// EXIF data with nothing but the orientation
+func orientationEXIF(orientation int) []byte {
+	data := []byte("II*\x00\x08\x00\x00\x00")
+	data = binary.LittleEndian.AppendUint16(data, 1)
+	data = binary.LittleEndian.AppendUint16(data, tagOrientation)
+	data = binary.LittleEndian.AppendUint16(data, 3)
+	data = binary.LittleEndian.AppendUint32(data, 1)
+	data = binary.LittleEndian.AppendUint32(data, uint32(orientation))
+	return binary.LittleEndian.AppendUint32(data, 0)
+}
+
+// The segment or chunk that holds EXIF data in the format
+func encodeEXIFBlock(format string, exif []byte) []byte {
+	var block []byte
+	switch format {
+	case "jpeg":
+		block = []byte{0xff, 0xe1}
+		block = binary.BigEndian.AppendUint16(block, uint16(2+len(jpegExifPrefix)+len(exif)))
+		block = append(block, jpegExifPrefix...)
+		block = append(block, exif...)
+	case "png":
+		block = binary.BigEndian.AppendUint32(block, uint32(len(exif)))
+		block = append(block, "eXIf"...)
+		block = append(block, exif...)
+		block = binary.BigEndian.AppendUint32(block, crc32.ChecksumIEEE(block[4:]))
+	case "webp":
+		block = append(block, "EXIF"...)
+		block = binary.LittleEndian.AppendUint32(block, uint32(len(exif)))
+		block = append(block, exif...)
+		if len(exif)%2 == 1 {
+			block = append(block, 0)
+		}
+	}
+	return block
+}
+
+// orientImage turns the decoded image the right way up, as its EXIF
+// orientation says
+func orientImage(src stdimage.Image, orientation int) stdimage.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	bounds := src.Bounds()
+	in := stdimage.NewNRGBA(stdimage.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(in, in.Bounds(), src, bounds.Min, draw.Src)
+	w, h := bounds.Dx(), bounds.Dy()
+	outW, outH := w, h
+	if orientation >= 5 {
+		outW, outH = h, w
+	}
+	out := stdimage.NewNRGBA(stdimage.Rect(0, 0, outW, outH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(out.Pix[dy*out.Stride+dx*4:dy*out.Stride+dx*4+4], in.Pix[y*in.Stride+x*4:y*in.Stride+x*4+4])
+		}
+	}
+	return out
+}
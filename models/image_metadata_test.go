@@ -0,0 +1,405 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	stdimage "image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test files are small images with metadata added, apart from the camera
+// samples in testdata
+
+// testIFD is the tags of an IFD. Values are strings for ASCII, uint16 for
+// SHORT, [2]uint32 for RATIONAL and testIFD for a pointer to another IFD.
+type testIFD []testTag
+
+type testTag struct {
+	tag   uint16
+	value interface{}
+}
+
+// Little endian EXIF data with the IFDs chained after each other, so the
+// second is IFD1
+func testEXIF(ifds ...testIFD) []byte {
+	data := []byte("II*\x00\x08\x00\x00\x00")
+	next := 4
+	for _, ifd := range ifds {
+		var at int
+		data, at = appendTestIFD(data, ifd)
+		binary.LittleEndian.PutUint32(data[next:], uint32(at))
+		next = at + 2 + 12*len(ifd)
+	}
+	return data
+}
+
+func appendTestIFD(data []byte, ifd testIFD) ([]byte, int) {
+	at := len(data)
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(ifd)))
+	data = append(data, make([]byte, 12*len(ifd)+4)...)
+	for i, tag := range ifd {
+		entry := at + 2 + 12*i
+		binary.LittleEndian.PutUint16(data[entry:], tag.tag)
+		var typ uint16
+		var count uint32 = 1
+		var value []byte
+		switch v := tag.value.(type) {
+		case string:
+			typ, count, value = 2, uint32(len(v)+1), append([]byte(v), 0)
+		case uint16:
+			typ, value = 3, binary.LittleEndian.AppendUint16(nil, v)
+		case [2]uint32:
+			typ = 5
+			value = binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, v[0]), v[1])
+		case testIFD:
+			var sub int
+			data, sub = appendTestIFD(data, v)
+			typ, value = 4, binary.LittleEndian.AppendUint32(nil, uint32(sub))
+		}
+		binary.LittleEndian.PutUint16(data[entry+2:], typ)
+		binary.LittleEndian.PutUint32(data[entry+4:], count)
+		if len(value) <= 4 {
+			copy(data[entry+8:], value)
+		} else {
+			binary.LittleEndian.PutUint32(data[entry+8:], uint32(len(data)))
+			data = append(data, value...)
+		}
+	}
+	return data, at
+}
+
+var testGPS = testIFD{
+	{0x0001, "N"},
+	{0x0002, [2]uint32{52, 1}},
+	{0x0003, "E"},
+	{0x0004, [2]uint32{13, 1}},
+}
+
+var testCamera = testIFD{
+	{tagMake, "Fujifilm"},
+	{tagModel, "X-T4"},
+}
+
+func testXMP(properties string) []byte {
+	return []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF><rdf:Description ` + properties + `/></rdf:RDF></x:xmpmeta>`)
+}
+
+// A small JPEG with the segments added after its start of image marker,
+// and the trailer after its end
+func testJPEG(t testing.TB, segments [][]byte, trailer []byte) []byte {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testPicture(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	out := append([]byte(nil), data[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	out = append(out, data[2:]...)
+	return append(out, trailer...)
+}
+
+func jpegSegment(marker byte, prefix string, payload []byte) []byte {
+	segment := []byte{0xff, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(2+len(prefix)+len(payload)))
+	segment = append(segment, prefix...)
+	return append(segment, payload...)
+}
+
+// A small PNG with the chunks added after its header chunk
+func testPNG(t testing.TB, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, testPicture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	out := append([]byte(nil), data[:33]...)
+	for _, chunk := range chunks {
+		out = append(out, chunk...)
+	}
+	return append(out, data[33:]...)
+}
+
+func pngChunk(chunkType string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, payload...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// A WebP container with an extended header and the chunks. The image data
+// isn't decoded, so it can be anything.
+func testWebP(chunks ...[]byte) []byte {
+	vp8x := make([]byte, 10)
+	data := []byte("RIFF\x00\x00\x00\x00WEBP")
+	data = append(data, webpChunk("VP8X", vp8x)...)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	data[20] = 0x08 | 0x04
+	return data
+}
+
+func webpChunk(chunkType string, payload []byte) []byte {
+	chunk := append([]byte(chunkType), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func testPicture() stdimage.Image {
+	img := stdimage.NewNRGBA(stdimage.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		img.Set(x, x%8, color.NRGBA{255, 0, 0, 255})
+	}
+	return img
+}
+
+func readTestFile(t testing.TB, name string) []byte {
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func metadataOf(data []byte) ImageMetadata {
+	return readImageMetadata(bytes.NewReader(data), int64(len(data)))
+}
+
+// The files the metadata tests and the fuzzer start with
+func testMetadataFiles(t testing.TB) map[string][]byte {
+	exifSegment := func(ifds ...testIFD) []byte {
+		return jpegSegment(0xe1, jpegExifPrefix, testEXIF(ifds...))
+	}
+	secondImage := testJPEG(t, [][]byte{exifSegment(testIFD{{tagGPSIFD, testGPS}})}, nil)
+	return map[string][]byte{
+		"canon sample": readTestFile(t, "canon-eos-rebel-xs.jpg"),
+		"gps in ifd0": testJPEG(t, [][]byte{
+			exifSegment(append(testIFD{{tagOrientation, uint16(6)}, {tagGPSIFD, testGPS}}, testCamera...)),
+		}, nil),
+		"gps in exif ifd": testJPEG(t, [][]byte{
+			exifSegment(append(testIFD{{tagExifIFD, testIFD{{tagISO, uint16(200)}, {tagGPSIFD, testGPS}}}}, testCamera...)),
+		}, nil),
+		"gps in ifd1": testJPEG(t, [][]byte{
+			exifSegment(testCamera, testIFD{{tagGPSIFD, testGPS}}),
+		}, nil),
+		"orientation in xmp": testJPEG(t, [][]byte{
+			jpegSegment(0xe1, jpegXMPPrefix, testXMP(`tiff:Orientation="8" exif:GPSLatitude="52,31N"`)),
+		}, nil),
+		"mpf": testJPEG(t, [][]byte{
+			exifSegment(testCamera),
+			jpegSegment(0xe2, jpegMPFPrefix, testEXIF(testIFD{{0xb000, "0100"}})),
+		}, secondImage),
+		"png": testPNG(t,
+			pngChunk("eXIf", testEXIF(testIFD{{tagOrientation, uint16(3)}, {tagExifIFD, testIFD{{tagGPSIFD, testGPS}}}})),
+			pngChunk("tEXt", []byte("Comment\x00hello")),
+		),
+		"webp": testWebP(
+			webpChunk("VP8 ", make([]byte, 101)),
+			webpChunk("EXIF", testEXIF(append(testIFD{{tagGPSIFD, testGPS}}, testCamera...))),
+			webpChunk("XMP ", testXMP(`tiff:Orientation="6"`)),
+		),
+	}
+}
+
+func TestReadImageMetadata(t *testing.T) {
+	files := testMetadataFiles(t)
+	tests := map[string]ImageMetadata{
+		"canon sample": {
+			CameraMake:   "Canon",
+			CameraModel:  "Canon EOS DIGITAL REBEL XS",
+			Lens:         "EF-S18-55mm f/3.5-5.6 IS",
+			ExposureTime: "1/60",
+			FNumber:      5,
+			FocalLength:  44,
+			ISO:          400,
+			TakenAt:      time.Date(2013, 6, 5, 9, 18, 38, 0, time.UTC),
+			Orientation:  1,
+			HasMetadata:  true,
+		},
+		"gps in ifd0": {
+			CameraMake:  "Fujifilm",
+			CameraModel: "X-T4",
+			Orientation: 6,
+			HasLocation: true,
+			HasMetadata: true,
+		},
+		"gps in exif ifd": {
+			CameraMake:  "Fujifilm",
+			CameraModel: "X-T4",
+			ISO:         200,
+			HasLocation: true,
+			HasMetadata: true,
+		},
+		"gps in ifd1": {
+			CameraMake:  "Fujifilm",
+			CameraModel: "X-T4",
+			HasLocation: true,
+			HasMetadata: true,
+		},
+		"orientation in xmp": {
+			Orientation: 8,
+			HasLocation: true,
+			HasMetadata: true,
+		},
+		// The second image's location isn't read, but could be there
+		"mpf": {
+			CameraMake:  "Fujifilm",
+			CameraModel: "X-T4",
+			HasLocation: true,
+			HasMetadata: true,
+		},
+		"png": {
+			Orientation: 3,
+			HasLocation: true,
+			HasMetadata: true,
+		},
+		"webp": {
+			CameraMake:  "Fujifilm",
+			CameraModel: "X-T4",
+			Orientation: 6,
+			HasLocation: true,
+			HasMetadata: true,
+		},
+	}
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := metadataOf(files[name]); got != want {
+				t.Errorf("readImageMetadata() = %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+// EXIF at the end of a WebP bigger than the metadata is
+func TestReadImageMetadataAfterLargeImage(t *testing.T) {
+	data := testWebP(
+		webpChunk("VP8 ", make([]byte, 2*maxMetadataSize)),
+		webpChunk("EXIF", testEXIF(testIFD{{tagGPSIFD, testGPS}})),
+	)
+	if !metadataOf(data).HasLocation {
+		t.Errorf("readImageMetadata() didn't find the location")
+	}
+}
+
+func TestReadImageMetadataTruncated(t *testing.T) {
+	for name, data := range testMetadataFiles(t) {
+		for _, size := range []int{0, 1, 3, 4, 12, 20, 21, 24, 40, 100, len(data) / 2, len(data) - 2, len(data) - 1} {
+			if size > len(data) {
+				continue
+			}
+			// Whatever comes out, it mustn't panic
+			meta := metadataOf(data[:size])
+			if name == "canon sample" && size == len(data)-2 && meta.CameraMake != "Canon" {
+				t.Errorf("%s cut to %d bytes: metadata before the cut wasn't read", name, size)
+			}
+		}
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	files := testMetadataFiles(t)
+	tests := []struct {
+		file  string
+		strip string
+		want  ImageMetadata
+	}{
+		{"canon sample", StripMetadataLocation, metadataOf(files["canon sample"])},
+		{"canon sample", StripMetadataAll, ImageMetadata{}},
+		{"gps in ifd0", StripMetadataLocation, ImageMetadata{CameraMake: "Fujifilm", CameraModel: "X-T4", Orientation: 6, HasMetadata: true}},
+		{"gps in ifd0", StripMetadataAll, ImageMetadata{Orientation: 6, HasMetadata: true}},
+		{"gps in exif ifd", StripMetadataLocation, ImageMetadata{CameraMake: "Fujifilm", CameraModel: "X-T4", ISO: 200, HasMetadata: true}},
+		{"gps in ifd1", StripMetadataLocation, ImageMetadata{CameraMake: "Fujifilm", CameraModel: "X-T4", HasMetadata: true}},
+		// The XMP goes for its location, but the orientation stays
+		{"orientation in xmp", StripMetadataLocation, ImageMetadata{Orientation: 8, HasMetadata: true}},
+		{"orientation in xmp", StripMetadataAll, ImageMetadata{Orientation: 8, HasMetadata: true}},
+		{"mpf", StripMetadataLocation, ImageMetadata{CameraMake: "Fujifilm", CameraModel: "X-T4", HasMetadata: true}},
+		{"mpf", StripMetadataAll, ImageMetadata{}},
+		{"png", StripMetadataLocation, ImageMetadata{Orientation: 3, HasMetadata: true}},
+		{"png", StripMetadataAll, ImageMetadata{Orientation: 3, HasMetadata: true}},
+		{"webp", StripMetadataLocation, ImageMetadata{CameraMake: "Fujifilm", CameraModel: "X-T4", Orientation: 6, HasMetadata: true}},
+		{"webp", StripMetadataAll, ImageMetadata{Orientation: 6, HasMetadata: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file+" "+tt.strip, func(t *testing.T) {
+			out := strip(t, files[tt.file], tt.strip)
+			if got := metadataOf(out); got != tt.want {
+				t.Errorf("metadata after stripping = %+v\nwant %+v", got, tt.want)
+			}
+			if bytes.Contains(out, []byte(jpegMPFPrefix)) {
+				t.Errorf("the MPF segment is still there")
+			}
+			switch {
+			case tt.file == "webp":
+				size := binary.LittleEndian.Uint32(out[4:])
+				if int(size) != len(out)-8 {
+					t.Errorf("RIFF size = %d, want %d", size, len(out)-8)
+				}
+				wantFlags := byte(0x08)
+				if tt.strip == StripMetadataLocation {
+					wantFlags |= 0x04
+				}
+				if out[20] != wantFlags {
+					t.Errorf("VP8X flags = %#x, want %#x", out[20], wantFlags)
+				}
+			default:
+				// The picture is left as it was
+				_, _, err := stdimage.Decode(bytes.NewReader(out))
+				if err != nil {
+					t.Errorf("decode stripped image: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func strip(t testing.TB, data []byte, strip string) []byte {
+	r, size, err := stripMetadata(bytes.NewReader(data), int64(len(data)), strip)
+	if err != nil {
+		t.Fatalf("stripMetadata(%s) err = %v", strip, err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("stripMetadata(%s) read err = %v", strip, err)
+	}
+	if int64(len(out)) != size {
+		t.Fatalf("stripMetadata(%s) size = %d, but %d bytes were read", strip, size, len(out))
+	}
+	return out
+}
+
+func FuzzStripMetadata(f *testing.F) {
+	for _, data := range testMetadataFiles(f) {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, mode := range []string{StripMetadataLocation, StripMetadataAll} {
+			if _, _, err := stripMetadata(bytes.NewReader(data), int64(len(data)), mode); err != nil {
+				// Files that can't be stripped aren't sent at all
+				continue
+			}
+			out := strip(t, data, mode)
+			meta := metadataOf(out)
+			if meta.HasLocation {
+				t.Errorf("%s: location left after stripping: %+v", mode, meta)
+			}
+			if mode == StripMetadataAll && (meta.CameraMake != "" || meta.CameraModel != "" || !meta.TakenAt.IsZero()) {
+				t.Errorf("%s: metadata left after stripping: %+v", mode, meta)
+			}
+		}
+	})
+}
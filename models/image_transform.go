@@ -0,0 +1,421 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	stdimage "image"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// ErrInvalidTransform is returned for transform options that can't be
+	// parsed or ask for too much
+	ErrInvalidTransform = errors.New("models: invalid image transform")
+	// ErrTransformSignature is returned when a transform URL's signature
+	// doesn't match, or it has expired
+	ErrTransformSignature = errors.New("models: invalid image transform signature")
+)
+
+const (
+	// DefaultMaxTransformSize is the largest width or height, in pixels,
+	// images can be transformed to when no other maximum is given
+	DefaultMaxTransformSize = 2000
+	// Images with more pixels than this aren't decoded, as that takes
+	// too much memory
+	maxTransformSourcePixels = 50_000_000
+)
+
+// How images are resized to a width and height
+const (
+	// ResizeFit keeps the aspect ratio, with the image as large as it can
+	// be inside the width and height
+	ResizeFit = "fit"
+	// ResizeFill keeps the aspect ratio, covering the width and height and
+	// cutting off what doesn't fit
+	ResizeFill = "fill"
+	// ResizeForce stretches the image to the width and height
+	ResizeForce = "force"
+)
+
+// Where crops are taken from, as compass directions
+var gravities = map[string]bool{
+	"ce": true, "no": true, "so": true, "ea": true, "we": true,
+	"noea": true, "nowe": true, "soea": true, "sowe": true,
+}
+
+// TransformOptions say how to transform an image. In URLs they are a path
+// of options like imgproxy's:
+//
+//	rs:{fit|fill|force}:{width}:{height}  resize; 0 keeps the aspect ratio
+//	w:{width} and h:{height}              set just the width or height
+//	c:{width}:{height}[:{gravity}]        crop the original first
+//	g:{gravity}                           where fill cuts from: ce, no, so...
+//	f:{jpeg|png|webp}                     format, the original's by default
+//	q:{1-100}                             quality for JPEG and WebP
+//	exp:{unix time}                       when the URL stops working
+type TransformOptions struct {
+	Resize     string
+	Width      int
+	Height     int
+	CropWidth  int
+	CropHeight int
+	// CropGravity is also used by ResizeFill. It defaults to "ce".
+	CropGravity string
+	Format      string
+	Quality     int
+	// Expires is when a signed URL with the options stops working. It
+	// isn't part of what is cached.
+	Expires time.Time
+}
+
+// ParseTransformOptions parses an options path like "rs:fill:300:200/f:webp"
+func ParseTransformOptions(path string) (TransformOptions, error) {
+	var opts TransformOptions
+	for _, option := range strings.Split(path, "/") {
+		if option == "" {
+			continue
+		}
+		args := strings.Split(option, ":")
+		name, args := args[0], args[1:]
+		var err error
+		switch {
+		case name == "rs" && len(args) >= 1 && len(args) <= 3:
+			opts.Resize = args[0]
+			if len(args) > 1 {
+				opts.Width, err = parseSize(args[1])
+			}
+			if err == nil && len(args) > 2 {
+				opts.Height, err = parseSize(args[2])
+			}
+		case name == "w" && len(args) == 1:
+			opts.Width, err = parseSize(args[0])
+		case name == "h" && len(args) == 1:
+			opts.Height, err = parseSize(args[0])
+		case name == "c" && (len(args) == 2 || len(args) == 3):
+			opts.CropWidth, err = parseSize(args[0])
+			if err == nil {
+				opts.CropHeight, err = parseSize(args[1])
+			}
+			if len(args) == 3 {
+				opts.CropGravity = args[2]
+			}
+		case name == "g" && len(args) == 1:
+			opts.CropGravity = args[0]
+		case name == "f" && len(args) == 1:
+			opts.Format = args[0]
+		case name == "q" && len(args) == 1:
+			opts.Quality, err = strconv.Atoi(args[0])
+		case name == "exp" && len(args) == 1:
+			var unix int64
+			unix, err = strconv.ParseInt(args[0], 10, 64)
+			opts.Expires = time.Unix(unix, 0)
+		default:
+			err = fmt.Errorf("unknown option %q", option)
+		}
+		if err != nil {
+			return TransformOptions{}, fmt.Errorf("%w: %v", ErrInvalidTransform, err)
+		}
+	}
+	return opts, opts.validate()
+}
+
+func parseSize(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
+
+func (opts TransformOptions) validate() error {
+	var err error
+	switch {
+	case opts.Resize != "" && opts.Resize != ResizeFit && opts.Resize != ResizeFill && opts.Resize != ResizeForce:
+		err = fmt.Errorf("unknown resize %q", opts.Resize)
+	case (opts.Resize == ResizeFill || opts.Resize == ResizeForce) && (opts.Width == 0 || opts.Height == 0):
+		err = fmt.Errorf("%s needs a width and height", opts.Resize)
+	case (opts.CropWidth == 0) != (opts.CropHeight == 0):
+		err = fmt.Errorf("crop needs a width and height")
+	case opts.CropGravity != "" && !gravities[opts.CropGravity]:
+		err = fmt.Errorf("unknown gravity %q", opts.CropGravity)
+	case opts.Format != "" && opts.Format != FormatJPEG && opts.Format != FormatWebP && opts.Format != "png":
+		err = fmt.Errorf("unknown format %q", opts.Format)
+	case opts.Format == FormatWebP && !webpEncoding:
+		err = fmt.Errorf("webp is not supported")
+	case opts.Quality < 0 || opts.Quality > 100:
+		err = fmt.Errorf("invalid quality %d", opts.Quality)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTransform, err)
+	}
+	return nil
+}
+
+// Path returns the options as a path, the way ParseTransformOptions reads
+// them. It is the same for the same options, so it can be used as a
+// cache key when Expires is left out.
+func (opts TransformOptions) Path() string {
+	var parts []string
+	if opts.Resize != "" || opts.Width != 0 || opts.Height != 0 {
+		resize := opts.Resize
+		if resize == "" {
+			resize = ResizeFit
+		}
+		parts = append(parts, fmt.Sprintf("rs:%s:%d:%d", resize, opts.Width, opts.Height))
+	}
+	if opts.CropWidth != 0 {
+		parts = append(parts, fmt.Sprintf("c:%d:%d", opts.CropWidth, opts.CropHeight))
+	}
+	if opts.CropGravity != "" && opts.CropGravity != "ce" {
+		parts = append(parts, "g:"+opts.CropGravity)
+	}
+	if opts.Format != "" {
+		parts = append(parts, "f:"+opts.Format)
+	}
+	if opts.Quality != 0 {
+		parts = append(parts, fmt.Sprintf("q:%d", opts.Quality))
+	}
+	if !opts.Expires.IsZero() {
+		parts = append(parts, fmt.Sprintf("exp:%d", opts.Expires.Unix()))
+	}
+	return strings.Join(parts, "/")
+}
+
+func (service *GalleryService) maxTransformSize() int {
+	if service.MaxTransformSize <= 0 {
+		return DefaultMaxTransformSize
+	}
+	return service.MaxTransformSize
+}
+
+// TransformURL returns the signed path the image can be fetched from,
+// transformed with the given options, until it expires. Anyone with the
+// path can fetch the image, so only sign it for users who can see the
+// gallery.
+func (service *GalleryService) TransformURL(gallery *Gallery, image Image, opts TransformOptions, expires time.Duration) (string, error) {
+	if expires <= 0 {
+		return "", fmt.Errorf("transform url: expiry must be positive")
+	}
+	opts.Expires = time.Now().Add(expires)
+	rest := opts.Path() + "/" + gallery.PublicID + "/" + image.PublicID
+	signature, err := service.transformSignature(rest)
+	if err != nil {
+		return "", fmt.Errorf("transform url: %w", err)
+	}
+	return "/img/" + signature + "/" + rest, nil
+}
+
+func (service *GalleryService) transformSignature(path string) (string, error) {
+	if len(service.TransformKey) == 0 {
+		return "", fmt.Errorf("image transform key is not set")
+	}
+	mac := hmac.New(sha256.New, service.TransformKey)
+	mac.Write([]byte(path))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyTransform checks the signature of a transform URL's path, which is
+// the options followed by the gallery's and the image's public IDs, and
+// returns what it is for. URLs without an expiry are never valid. Whether
+// the gallery can still be seen is up to the caller.
+func (service *GalleryService) VerifyTransform(signature, path string) (*Gallery, *Image, TransformOptions, error) {
+	expected, err := service.transformSignature(path)
+	if err != nil {
+		return nil, nil, TransformOptions{}, fmt.Errorf("verify transform: %w", err)
+	}
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, nil, TransformOptions{}, ErrTransformSignature
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return nil, nil, TransformOptions{}, ErrInvalidTransform
+	}
+	opts, err := ParseTransformOptions(strings.Join(parts[:len(parts)-2], "/"))
+	if err != nil {
+		return nil, nil, TransformOptions{}, err
+	}
+	if opts.Expires.IsZero() || time.Now().After(opts.Expires) {
+		return nil, nil, TransformOptions{}, ErrTransformSignature
+	}
+	gallery, err := service.FindBySlug(parts[len(parts)-2])
+	if err != nil {
+		return nil, nil, TransformOptions{}, fmt.Errorf("verify transform: %w", err)
+	}
+	image, err := service.Image(gallery.ID, parts[len(parts)-1])
+	if err != nil {
+		return nil, nil, TransformOptions{}, fmt.Errorf("verify transform: %w", err)
+	}
+	return gallery, &image, opts, nil
+}
+
+// TransformImage returns the image transformed with the options. Results
+// are kept in storage, so each is only made once.
+func (service *GalleryService) TransformImage(ctx context.Context, image Image, opts TransformOptions) (*Image, error) {
+	maxSize := service.maxTransformSize()
+	if opts.Width > maxSize || opts.Height > maxSize {
+		return nil, fmt.Errorf("%w: larger than %dpx", ErrInvalidTransform, maxSize)
+	}
+	if image.Width == 0 || image.Width*image.Height > maxTransformSourcePixels {
+		return nil, fmt.Errorf("%w: image can't be transformed", ErrInvalidTransform)
+	}
+	format := opts.Format
+	if format == "" {
+		format = FormatJPEG
+		if image.ContentType == "image/png" {
+			format = "png"
+		}
+	}
+
+	// Keep the expiry out of the cache key, so the result is shared by
+	// every URL with the same options
+	opts.Expires = time.Time{}
+	key := sha256.Sum256([]byte(opts.Path() + "/" + image.Checksum))
+	result := image
+	result.StorageKey = fmt.Sprintf("gallery-%d/transforms/%s-%s.%s", image.GalleryID,
+		image.PublicID, hex.EncodeToString(key[:16]), strings.Replace(format, "jpeg", "jpg", 1))
+	result.ContentType = "image/" + format
+	result.Checksum = ""
+	info, err := service.storage().Stat(ctx, result.StorageKey)
+	if errors.Is(err, ErrNotFound) {
+		err = service.transform(ctx, image, result.StorageKey, opts, format)
+		if err != nil {
+			return nil, fmt.Errorf("transform image: %w", err)
+		}
+		info, err = service.storage().Stat(ctx, result.StorageKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("transform image: %w", err)
+	}
+	result.Size = info.Size
+	return &result, nil
+}
+
+// Transform the image and store the result under key
+func (service *GalleryService) transform(ctx context.Context, image Image, key string, opts TransformOptions, format string) error {
+	original, err := service.storage().Get(ctx, image.StorageKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	src, err := decodeImage(original)
+	original.Close()
+	if err != nil {
+		return fmt.Errorf("decoding %s: %w", image.StorageKey, err)
+	}
+	src = orientImage(src, image.Metadata.Orientation)
+	if opts.CropWidth != 0 {
+		src = cropImage(src, opts.CropWidth, opts.CropHeight, opts.CropGravity)
+	}
+	dst := resizeTransform(src, opts, service.maxTransformSize())
+
+	var buf bytes.Buffer
+	switch format {
+	case FormatWebP:
+		quality := webpQuality
+		if opts.Quality != 0 {
+			quality = opts.Quality
+		}
+		err = encodeWebP(&buf, dst, quality)
+	case "png":
+		err = png.Encode(&buf, dst)
+	default:
+		quality := jpegQuality
+		if opts.Quality != 0 {
+			quality = opts.Quality
+		}
+		err = jpeg.Encode(&buf, flatten(dst), &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", key, err)
+	}
+	return service.storage().Put(ctx, key, &buf, int64(buf.Len()), "image/"+format)
+}
+
+// Resize the image as the options say. Images are never made bigger than
+// they are, or than maxSize.
+func resizeTransform(src stdimage.Image, opts TransformOptions, maxSize int) stdimage.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	width, height := opts.Width, opts.Height
+	resize := opts.Resize
+	if width == 0 && height == 0 {
+		width, height, resize = srcW, srcH, ResizeForce
+	}
+	switch resize {
+	case ResizeFill:
+		// Cut the source to the target's aspect ratio first
+		cropW, cropH := srcW, srcW*height/width
+		if cropH > srcH {
+			cropW, cropH = srcH*width/height, srcH
+		}
+		src = cropImage(src, max(cropW, 1), max(cropH, 1), opts.CropGravity)
+		srcW, srcH = cropW, cropH
+	case ResizeForce:
+	default:
+		scale := 0.0
+		if width != 0 {
+			scale = float64(width) / float64(srcW)
+		}
+		if height != 0 && (scale == 0 || float64(height)/float64(srcH) < scale) {
+			scale = float64(height) / float64(srcH)
+		}
+		width = int(float64(srcW)*scale + 0.5)
+		height = int(float64(srcH)*scale + 0.5)
+	}
+	// Never enlarge, keeping the aspect ratio
+	if width > srcW || height > srcH {
+		scale := min(float64(srcW)/float64(width), float64(srcH)/float64(height))
+		width, height = int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	}
+	if width > maxSize || height > maxSize {
+		scale := min(float64(maxSize)/float64(width), float64(maxSize)/float64(height))
+		width, height = int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	}
+	width, height = max(width, 1), max(height, 1)
+	dst := stdimage.NewNRGBA(stdimage.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// Cut a width by height part out of the image, at the side the gravity
+// says or its center. Crops bigger than the image are the whole image.
+func cropImage(src stdimage.Image, width, height int, gravity string) stdimage.Image {
+	bounds := src.Bounds()
+	width, height = min(width, bounds.Dx()), min(height, bounds.Dy())
+	x := bounds.Min.X + (bounds.Dx()-width)/2
+	y := bounds.Min.Y + (bounds.Dy()-height)/2
+	if strings.HasPrefix(gravity, "no") {
+		y = bounds.Min.Y
+	}
+	if strings.HasPrefix(gravity, "so") {
+		y = bounds.Max.Y - height
+	}
+	if strings.HasSuffix(gravity, "we") {
+		x = bounds.Min.X
+	}
+	if strings.HasSuffix(gravity, "ea") {
+		x = bounds.Max.X - width
+	}
+	dst := stdimage.NewNRGBA(stdimage.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), src, stdimage.Point{X: x, Y: y}, draw.Src)
+	return dst
+}
+
+// The image on a white background, for formats without transparency
+func flatten(src stdimage.Image) stdimage.Image {
+	dst := stdimage.NewRGBA(src.Bounds())
+	draw.Draw(dst, dst.Bounds(), stdimage.White, stdimage.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	stdimage "image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// DefaultImageSizes are the widths, in pixels, images are resized to
+// when no other sizes are given
+var DefaultImageSizes = []int{320, 800, 1600}
+
+// The formats image variants are made in. Browsers that can't show WebP
+// get JPEG.
+const (
+	FormatWebP = "webp"
+	FormatJPEG = "jpeg"
+)
+
+// ImageFormats returns the formats image variants are made in, which only
+// includes WebP in builds with cgo
+func ImageFormats() []string {
+	if webpEncoding {
+		return []string{FormatWebP, FormatJPEG}
+	}
+	return []string{FormatJPEG}
+}
+
+// ErrImageSize is returned when asking for an image variant in a size or
+// format that isn't made
+var ErrImageSize = errors.New("models: image size is not available")
+
+var errImageTooLarge = errors.New("image has too many pixels")
+
+// Encoding quality, out of 100
+const (
+	jpegQuality = 82
+	webpQuality = 80
+)
+
+func (service *GalleryService) imageSizes() []int {
+	if len(service.ImageSizes) == 0 {
+		return DefaultImageSizes
+	}
+	return service.ImageSizes
+}
+
+// ImageWidths returns the widths the image has smaller variants in,
+// smallest first. Images are never made bigger, and there are none for
+// images that couldn't be decoded.
+func (service *GalleryService) ImageWidths(image Image) []int {
+	var widths []int
+	for _, width := range service.imageSizes() {
+		if width < image.Width {
+			widths = append(widths, width)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+// The storage key of the image's variant. Variants are kept in a
+// directory next to the gallery's originals.
+func variantKey(image Image, width int, format string) string {
+	ext := ".jpg"
+	if format == FormatWebP {
+		ext = ".webp"
+	}
+	return fmt.Sprintf("gallery-%d/sizes/%s-%d%s", image.GalleryID, image.PublicID, width, ext)
+}
+
+// ImageVariant returns the image resized to the given width, in the given
+// format, as an Image that can be served like the original. Variants that
+// are missing, like those of images uploaded before variants were made,
+// are made now. Asking for a width the image is no wider than returns the
+// original.
+func (service *GalleryService) ImageVariant(ctx context.Context, image Image, width int, format string) (*Image, error) {
+	if !slices.Contains(ImageFormats(), format) {
+		return nil, ErrImageSize
+	}
+	sized := false
+	for _, size := range service.imageSizes() {
+		sized = sized || size == width
+	}
+	if !sized {
+		return nil, ErrImageSize
+	}
+	if width >= image.Width {
+		return &image, nil
+	}
+
+	variant := image
+	variant.StorageKey = variantKey(image, width, format)
+	variant.ContentType = "image/" + format
+	variant.Filename = strings.TrimSuffix(image.Filename, path.Ext(image.Filename)) + path.Ext(variant.StorageKey)
+	variant.Width = width
+	variant.Height = variantHeight(image, width)
+	variant.Checksum = ""
+	info, err := service.storage().Stat(ctx, variant.StorageKey)
+	if errors.Is(err, ErrNotFound) {
+		err = service.createVariant(ctx, image, width)
+		if err != nil {
+			return nil, fmt.Errorf("image variant: %w", err)
+		}
+		info, err = service.storage().Stat(ctx, variant.StorageKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("image variant: %w", err)
+	}
+	variant.Size = info.Size
+	return &variant, nil
+}
+
+// Make the image's variants in the given width from its original in
+// storage
+func (service *GalleryService) createVariant(ctx context.Context, image Image, width int) error {
+	original, err := service.storage().Get(ctx, image.StorageKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer original.Close()
+	return service.createVariants(ctx, image, original, []int{width})
+}
+
+// Make the image's variants in the given widths, in every format, from
+// the contents of its original. The original is only decoded once.
+func (service *GalleryService) createVariants(ctx context.Context, image Image, original io.Reader, widths []int) error {
+	if len(widths) == 0 {
+		return nil
+	}
+	src, err := decodeImage(original)
+	if err != nil {
+		return fmt.Errorf("decoding %s: %w", image.StorageKey, err)
+	}
+	src = orientImage(src, image.Metadata.Orientation)
+	for _, width := range widths {
+		resized := resizeImage(src, width, variantHeight(image, width))
+		for _, format := range ImageFormats() {
+			var buf bytes.Buffer
+			if format == FormatWebP {
+				err = encodeWebP(&buf, resized, webpQuality)
+			} else {
+				err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: jpegQuality})
+			}
+			if err != nil {
+				return fmt.Errorf("encoding %s: %w", variantKey(image, width, format), err)
+			}
+			err = service.storage().Put(ctx, variantKey(image, width, format),
+				&buf, int64(buf.Len()), "image/"+format)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete all of the image's variants, transformed and stripped copies
+func (service *GalleryService) deleteVariants(ctx context.Context, image Image) error {
+	for _, dir := range []string{"sizes", "transforms", "stripped"} {
+		blobs, err := service.storage().List(ctx, fmt.Sprintf("gallery-%d/%s/%s-", image.GalleryID, dir, image.PublicID))
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			err = service.storage().Delete(ctx, blob.Key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Decode the image, checking its size first. Files can say they are far
+// bigger than they are, and decoding them would take all the memory
+// there is.
+func decodeImage(r io.Reader) (stdimage.Image, error) {
+	var head bytes.Buffer
+	config, _, err := stdimage.DecodeConfig(io.TeeReader(r, &head))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxTransformSourcePixels {
+		return nil, errImageTooLarge
+	}
+	src, _, err := stdimage.Decode(io.MultiReader(&head, r))
+	return src, err
+}
+
+// The height of the image when it is resized to width, keeping its
+// aspect ratio
+func variantHeight(image Image, width int) int {
+	height := (image.Height*width + image.Width/2) / image.Width
+	if height < 1 {
+		return 1
+	}
+	return height
+}
+
+// Scale the image to the given size. Transparent parts become white, as
+// JPEG can't keep them.
+func resizeImage(src stdimage.Image, width, height int) *stdimage.RGBA {
+	dst := stdimage.NewRGBA(stdimage.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), stdimage.NewUniform(color.White), stdimage.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
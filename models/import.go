@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// ImportProvider is a cloud storage service users can connect to import
+// photos from, like Dropbox
+type ImportProvider struct {
+	// Name is used in URLs and stored with each token, e.g. "dropbox"
+	Name string
+	// DisplayName is shown to users, e.g. "Dropbox"
+	DisplayName string
+	Config      *oauth2.Config
+	// AuthParams are added to the authorization URL. Most providers need
+	// one to hand out a refresh token.
+	AuthParams []oauth2.AuthCodeOption
+	// PKCE is set for providers that support PKCE with S256 challenges
+	PKCE bool
+	// NewClient returns a client for the provider's API. The HTTP client
+	// adds the user's access token to its requests.
+	NewClient func(client *http.Client) ImportClient
+	// Revoke the token at the provider. It is nil for providers that can't.
+	Revoke func(ctx context.Context, token *oauth2.Token) error
+}
+
+// ImportEntry is a file or folder at an import provider
+type ImportEntry struct {
+	// ID is what the provider identifies the entry by. For Dropbox it is the
+	// path, for others it is opaque.
+	ID     string
+	Name   string
+	Folder bool
+}
+
+// ImportFolder is one page of a folder listing. If HasMore is set, pass
+// Cursor to ListFolder for the next page.
+type ImportFolder struct {
+	Entries []ImportEntry
+	Cursor  string
+	HasMore bool
+}
+
+// ImportClient is what we need from an import provider's API to let users
+// browse their files and import photos
+type ImportClient interface {
+	// ListFolder lists the folder with the given ID, starting at cursor if
+	// it is set. The root folder's ID is "".
+	ListFolder(ctx context.Context, folder, cursor string) (*ImportFolder, error)
+	// Download the file with the given ID. The caller must close contents.
+	Download(ctx context.Context, file string) (filename string, contents io.ReadCloser, err error)
+}
@@ -0,0 +1,271 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultMaxImportFiles is the most files one import can have when no
+	// other maximum is given
+	DefaultMaxImportFiles = 100
+	// DefaultMaxRunningImports is how many imports each user can have
+	// running at once when no other maximum is given
+	DefaultMaxRunningImports = 2
+	// Imports that haven't finished after this long are taken to have
+	// stopped with the server, and don't count as running
+	staleImportAge = 6 * time.Hour
+	// How many files of an import are downloaded at once
+	importConcurrency = 4
+)
+
+// How an imported file went
+const (
+	ImportPending  = "pending"
+	ImportImported = "imported"
+	ImportFailed   = "failed"
+)
+
+// Import is a batch of files imported into a gallery from an import
+// provider
+type Import struct {
+	ID        int
+	GalleryID int
+	UserID    int
+	// Provider is the name of the ImportProvider
+	Provider  string
+	CreatedAt time.Time
+	// FinishedAt is zero while the import is running
+	FinishedAt time.Time
+	Files      []ImportFile
+}
+
+// ImportFile is one of the files of an import
+type ImportFile struct {
+	ID int
+	// File is the provider's ID for the file
+	File     string
+	Filename string
+	Status   string
+	// Error says why the file failed, in a way that can be shown to users
+	Error string
+}
+
+// ImportService keeps a record of imports, and runs them
+type ImportService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	// MaxFiles is the most files an import can have, and MaxRunning how
+	// many imports each user can have running at once. They default to
+	// DefaultMaxImportFiles and DefaultMaxRunningImports.
+	MaxFiles   int
+	MaxRunning int
+}
+
+// MaxImportFiles returns the most files an import can have
+func (service *ImportService) MaxImportFiles() int {
+	if service.MaxFiles <= 0 {
+		return DefaultMaxImportFiles
+	}
+	return service.MaxFiles
+}
+
+func (service *ImportService) maxRunning() int {
+	if service.MaxRunning <= 0 {
+		return DefaultMaxRunningImports
+	}
+	return service.MaxRunning
+}
+
+// Start records a new import of the files with the given IDs into the
+// gallery, on behalf of the user, which Run then runs. Returns
+// ErrTooManyImportFiles if there are more files than an import can have,
+// and ErrImportsRunning if the user already has as many imports running
+// as they can.
+func (service *ImportService) Start(galleryID, userID int, provider string, files []string) (*Import, error) {
+	if len(files) > service.MaxImportFiles() {
+		return nil, ErrTooManyImportFiles
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("start import: %w", err)
+	}
+	defer tx.Rollback()
+	// Lock the user, so two requests can't both start the last import
+	// they are allowed
+	var locked int
+	err = tx.QueryRow(`
+		SELECT id FROM users WHERE id = $1 FOR UPDATE;`, userID).Scan(&locked)
+	if err != nil {
+		return nil, fmt.Errorf("start import: %w", err)
+	}
+	var running int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM imports
+		WHERE user_id = $1 AND finished_at IS NULL AND created_at > $2;`,
+		userID, time.Now().Add(-staleImportAge)).Scan(&running)
+	if err != nil {
+		return nil, fmt.Errorf("start import: %w", err)
+	}
+	if running >= service.maxRunning() {
+		return nil, ErrImportsRunning
+	}
+
+	imp := Import{
+		GalleryID: galleryID,
+		UserID:    userID,
+		Provider:  provider,
+	}
+	err = tx.QueryRow(`
+		INSERT INTO imports (gallery_id, user_id, provider)
+		VALUES ($1, $2, $3) RETURNING id, created_at;`, galleryID, userID, provider).Scan(&imp.ID, &imp.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("start import: %w", err)
+	}
+	for _, file := range files {
+		importFile := ImportFile{
+			File: file,
+			// Until the file is downloaded and its real name is known
+			Filename: path.Base(file),
+			Status:   ImportPending,
+		}
+		err = tx.QueryRow(`
+			INSERT INTO import_files (import_id, file, filename, status)
+			VALUES ($1, $2, $3, $4) RETURNING id;`, imp.ID, importFile.File,
+			importFile.Filename, importFile.Status).Scan(&importFile.ID)
+		if err != nil {
+			return nil, fmt.Errorf("start import: %w", err)
+		}
+		imp.Files = append(imp.Files, importFile)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("start import: %w", err)
+	}
+	return &imp, nil
+}
+
+// Run downloads the import's files from the provider's client into its
+// gallery, recording how each one went. It keeps going when a file fails,
+// so one bad file doesn't stop the rest. The errors returned are the
+// details of the failures, for logging.
+func (service *ImportService) Run(ctx context.Context, imp *Import, client ImportClient) error {
+	// Imports older than this no longer count as running, so make sure
+	// they aren't
+	ctx, cancel := context.WithTimeout(ctx, staleImportAge)
+	defer cancel()
+	var eg errgroup.Group
+	eg.SetLimit(importConcurrency)
+	errs := make([]error, len(imp.Files))
+	for i := range imp.Files {
+		i := i
+		eg.Go(func() error {
+			errs[i] = service.importFile(ctx, imp, client, &imp.Files[i])
+			return nil
+		})
+	}
+	eg.Wait()
+	_, err := service.DB.Exec(`
+		UPDATE imports SET finished_at = NOW() WHERE id = $1;`, imp.ID)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("import %d: %w", imp.ID, err)
+	}
+	return nil
+}
+
+// Import the file and record how it went
+func (service *ImportService) importFile(ctx context.Context, imp *Import, client ImportClient, file *ImportFile) error {
+	filename, contents, err := client.Download(ctx, file.File)
+	if err == nil {
+		file.Filename = path.Base(filename)
+		_, err = service.GalleryService.CreateImage(imp.GalleryID, imp.UserID, file.Filename, contents)
+		contents.Close()
+	}
+	file.Status = ImportImported
+	if err != nil {
+		err = fmt.Errorf("%s: %w", file.File, err)
+		file.Status = ImportFailed
+		file.Error = "couldn't be imported"
+		var fileErr FileError
+		if errors.As(err, &fileErr) {
+			file.Error = fileErr.Issue
+		}
+	}
+	_, saveErr := service.DB.Exec(`
+		UPDATE import_files
+		SET filename = $2, status = $3, error = $4
+		WHERE id = $1;`, file.ID, file.Filename, file.Status, file.Error)
+	if saveErr != nil {
+		return errors.Join(err, fmt.Errorf("%s: %w", file.File, saveErr))
+	}
+	return err
+}
+
+// Recent returns the gallery's latest imports with their files, newest
+// first
+func (service *ImportService) Recent(galleryID, limit int) ([]Import, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, user_id, provider, created_at, finished_at
+		FROM imports
+		WHERE gallery_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2;`, galleryID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("recent imports: %w", err)
+	}
+	defer rows.Close()
+	var imports []Import
+	for rows.Next() {
+		imp := Import{
+			GalleryID: galleryID,
+		}
+		var finishedAt sql.NullTime
+		err = rows.Scan(&imp.ID, &imp.UserID, &imp.Provider, &imp.CreatedAt, &finishedAt)
+		if err != nil {
+			return nil, fmt.Errorf("recent imports: %w", err)
+		}
+		imp.FinishedAt = finishedAt.Time
+		imports = append(imports, imp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("recent imports: %w", err)
+	}
+	for i := range imports {
+		imports[i].Files, err = service.files(imports[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("recent imports: %w", err)
+		}
+	}
+	return imports, nil
+}
+
+func (service *ImportService) files(importID int) ([]ImportFile, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, file, filename, status, error
+		FROM import_files
+		WHERE import_id = $1
+		ORDER BY id;`, importID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []ImportFile
+	for rows.Next() {
+		var file ImportFile
+		err = rows.Scan(&file.ID, &file.File, &file.Filename, &file.Status, &file.Error)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
@@ -0,0 +1,275 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// OAuthClaims is what an identity provider tells us about the user who
+// signed in with it
+type OAuthClaims struct {
+	// Subject is the provider's ID for the user. Unlike the email it never
+	// changes, so identities are looked up by it.
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// OAuthIdentity links an account at an identity provider to a user
+type OAuthIdentity struct {
+	ID        int
+	UserID    int
+	Provider  string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+type OAuthIdentityService struct {
+	DB *sql.DB
+}
+
+// SignIn returns the user for the identity, linking the identity to the
+// account with the same email or creating a new account the first time.
+// The provider must have verified the email, otherwise anyone could sign
+// in to an account by claiming its address. Returns ErrEmailNotVerified if
+// it hasn't.
+func (service *OAuthIdentityService) SignIn(provider string, claims OAuthClaims) (*User, error) {
+	user, err := service.find(provider, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("oauth sign in: %w", err)
+	}
+	if !claims.EmailVerified || claims.Email == "" {
+		return nil, ErrEmailNotVerified
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("oauth sign in: %w", err)
+	}
+	defer tx.Rollback()
+
+	email := strings.ToLower(claims.Email)
+	user = &User{
+		Email: email,
+	}
+	var emailVerifiedAt sql.NullTime
+	row := tx.QueryRow(`
+		SELECT id, password_hash, email_verified_at
+		FROM users
+		WHERE email = $1
+		FOR UPDATE;`, email)
+	err = row.Scan(&user.ID, &user.PasswordHash, &emailVerifiedAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// A new account with no password. The user can add one, or other
+		// identities, from their settings.
+		row = tx.QueryRow(`
+			INSERT INTO users (email, password_hash, email_verified_at)
+			VALUES ($1, '', NOW())
+			RETURNING id;`, email)
+		err = row.Scan(&user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("oauth sign in: %w", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("oauth sign in: %w", err)
+	case !emailVerifiedAt.Valid:
+		// Whoever signed up with this email never proved they own it, but
+		// the provider says this user does. Throw out the password and
+		// sessions they set up, so they can't hijack the account later.
+		_, err = tx.Exec(`
+			UPDATE users
+			SET password_hash = '', email_verified_at = NOW()
+			WHERE id = $1;`, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("oauth sign in: %w", err)
+		}
+		_, err = tx.Exec(`
+			DELETE FROM sessions
+			WHERE user_id = $1;`, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("oauth sign in: %w", err)
+		}
+		user.PasswordHash = ""
+	}
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
+	} else {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	err = service.insert(tx, user.ID, provider, claims)
+	if err != nil {
+		return nil, fmt.Errorf("oauth sign in: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("oauth sign in: %w", err)
+	}
+	return user, nil
+}
+
+// Link an identity to a signed in user. Returns ErrIdentityTaken if the
+// identity already belongs to another user.
+func (service *OAuthIdentityService) Link(userID int, provider string, claims OAuthClaims) error {
+	user, err := service.find(provider, claims.Subject)
+	if err == nil {
+		if user.ID == userID {
+			return nil
+		}
+		return ErrIdentityTaken
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("link identity: %w", err)
+	}
+	err = service.insert(service.DB, userID, provider, claims)
+	if err != nil {
+		return fmt.Errorf("link identity: %w", err)
+	}
+	return nil
+}
+
+// List the identities linked to the user
+func (service *OAuthIdentityService) List(userID int) ([]OAuthIdentity, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, provider, subject, email, created_at
+		FROM oauth_identities
+		WHERE user_id = $1
+		ORDER BY created_at;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list identities: %w", err)
+	}
+	defer rows.Close()
+	var identities []OAuthIdentity
+	for rows.Next() {
+		identity := OAuthIdentity{
+			UserID: userID,
+		}
+		err := rows.Scan(&identity.ID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("list identities: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list identities: %w", err)
+	}
+	return identities, nil
+}
+
+// Unlink one of the user's identities. Returns ErrNotFound if the user has
+// no such identity, and ErrLastSignInMethod if it is the only way left for
+// the user to sign in.
+func (service *OAuthIdentityService) Unlink(userID, id int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	defer tx.Rollback()
+
+	methods, err := signInMethods(tx, userID)
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	if methods <= 1 {
+		return ErrLastSignInMethod
+	}
+
+	res, err := tx.Exec(`
+		DELETE FROM oauth_identities
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	return nil
+}
+
+func (service *OAuthIdentityService) find(provider, subject string) (*User, error) {
+	var user User
+	var emailVerifiedAt sql.NullTime
+	row := service.DB.QueryRow(`
+		SELECT u.id, u.email, u.password_hash, u.email_verified_at
+		FROM oauth_identities AS i
+		JOIN users AS u
+			ON u.id = i.user_id
+		WHERE i.provider = $1 AND i.subject = $2;`, provider, subject)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &emailVerifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
+	}
+	return &user, nil
+}
+
+// Count the ways the user can sign in: their password, passkeys and
+// identities. The user's row is locked until tx ends, so two removals
+// can't race each other to leave the account with none.
+func signInMethods(tx *sql.Tx, userID int) (int, error) {
+	var hasPassword bool
+	var passkeys, identities int
+	row := tx.QueryRow(`
+		SELECT
+			u.password_hash <> '',
+			(SELECT COUNT(*) FROM passkeys WHERE user_id = u.id),
+			(SELECT COUNT(*) FROM oauth_identities WHERE user_id = u.id)
+		FROM users AS u
+		WHERE u.id = $1
+		FOR UPDATE;`, userID)
+	err := row.Scan(&hasPassword, &passkeys, &identities)
+	if err != nil {
+		return 0, err
+	}
+	methods := passkeys + identities
+	if hasPassword {
+		methods++
+	}
+	return methods, nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (service *OAuthIdentityService) insert(db execer, userID int, provider string, claims OAuthClaims) error {
+	_, err := db.Exec(`
+		INSERT INTO oauth_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4);`, userID, provider, claims.Subject, strings.ToLower(claims.Email))
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) {
+			if pgError.Code == pgerrcode.UniqueViolation {
+				return ErrIdentityTaken
+			}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// OAuthProvider is an identity provider users can sign in with
+type OAuthProvider struct {
+	// Name is used in URLs and stored with each identity, e.g. "google"
+	Name string
+	// DisplayName is shown on buttons, e.g. "Google"
+	DisplayName string
+	Config      *oauth2.Config
+	// PKCE is set for providers that support PKCE with S256 challenges
+	PKCE bool
+	// Verifier validates the ID tokens of OpenID Connect providers. It is
+	// nil for plain OAuth2 providers, which use UserInfo instead.
+	Verifier *oidc.IDTokenVerifier
+	// UserInfo asks a plain OAuth2 provider who the user is
+	UserInfo func(ctx context.Context, client *http.Client) (*OAuthClaims, error)
+}
+
+// NewOIDCProvider discovers an OpenID Connect provider from its issuer URL.
+// Google's issuer is https://accounts.google.com.
+func NewOIDCProvider(ctx context.Context, name, displayName, issuer, clientID, clientSecret string) (*OAuthProvider, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("new oidc provider %s: %w", name, err)
+	}
+	var discovery struct {
+		CodeChallengeMethods []string `json:"code_challenge_methods_supported"`
+	}
+	err = provider.Claims(&discovery)
+	if err != nil {
+		return nil, fmt.Errorf("new oidc provider %s: %w", name, err)
+	}
+	pkce := false
+	for _, method := range discovery.CodeChallengeMethods {
+		if method == "S256" {
+			pkce = true
+		}
+	}
+	return &OAuthProvider{
+		Name:        name,
+		DisplayName: displayName,
+		Config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email"},
+		},
+		PKCE:     pkce,
+		Verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+	}, nil
+}
+
+// NewGitHubProvider returns a provider for signing in with GitHub, which
+// doesn't support OpenID Connect.
+func NewGitHubProvider(clientID, clientSecret string) *OAuthProvider {
+	return &OAuthProvider{
+		Name:        "github",
+		DisplayName: "GitHub",
+		Config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     github.Endpoint,
+			Scopes:       []string{"read:user", "user:email"},
+		},
+		UserInfo: githubUserInfo,
+	}
+}
+
+// Claims returns who the user that the token was issued for is. The ID
+// tokens of OpenID Connect providers must carry the nonce the sign in was
+// started with.
+func (p *OAuthProvider) Claims(ctx context.Context, token *oauth2.Token, nonce string) (*OAuthClaims, error) {
+	if p.Verifier == nil {
+		claims, err := p.UserInfo(ctx, p.Config.Client(ctx, token))
+		if err != nil {
+			return nil, fmt.Errorf("%s claims: %w", p.Name, err)
+		}
+		return claims, nil
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%s claims: no id_token in token response", p.Name)
+	}
+	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%s claims: %w", p.Name, err)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%s claims: id_token nonce doesn't match", p.Name)
+	}
+	var idClaims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	err = idToken.Claims(&idClaims)
+	if err != nil {
+		return nil, fmt.Errorf("%s claims: %w", p.Name, err)
+	}
+	return &OAuthClaims{
+		Subject:       idToken.Subject,
+		Email:         idClaims.Email,
+		EmailVerified: idClaims.EmailVerified,
+	}, nil
+}
+
+// GitHub's user ID is the subject, and the email is the user's primary
+// address if GitHub has verified it.
+func githubUserInfo(ctx context.Context, client *http.Client) (*OAuthClaims, error) {
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	err := getJSON(ctx, client, "https://api.github.com/user", &user)
+	if err != nil {
+		return nil, err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	err = getJSON(ctx, client, "https://api.github.com/user/emails", &emails)
+	if err != nil {
+		return nil, err
+	}
+	claims := OAuthClaims{
+		Subject: strconv.FormatInt(user.ID, 10),
+	}
+	for _, email := range emails {
+		if email.Primary {
+			claims.Email = email.Email
+			claims.EmailVerified = email.Verified
+		}
+	}
+	return &claims, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
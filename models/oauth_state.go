@@ -0,0 +1,140 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/rand"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultOAuthStateDuration is how long a user has to finish an OAuth
+	// flow once they are sent to the provider
+	DefaultOAuthStateDuration = 10 * time.Minute
+)
+
+// OAuthState is an OAuth flow in progress. Its token is sent to the
+// provider as the state parameter, and can only be used once.
+type OAuthState struct {
+	ID int
+	// Token is only set when an OAuthState is being created.
+	Token     string
+	TokenHash string
+	Provider  string
+	// UserID is the signed in user who started the flow, or 0 if nobody
+	// was. The flow must be finished by the same user.
+	UserID int
+	// Link is set when the user is linking an identity to their account
+	// rather than signing in with it
+	Link bool
+	// CodeVerifier is the PKCE code verifier. Its challenge is sent with
+	// the authorization request, and the verifier with the code exchange.
+	CodeVerifier string
+	// Nonce is bound to OpenID Connect ID tokens, so one can't be replayed
+	// into another sign in
+	Nonce string
+	// ReturnTo is the local path to send the user to once they're done
+	ReturnTo  string
+	ExpiresAt time.Time
+}
+
+type OAuthStateService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each state token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+	// Duration is the amount of time that an OAuthState is valid for.
+	// Defaults to DefaultOAuthStateDuration
+	Duration time.Duration
+}
+
+// Create the state for a new flow with the provider
+func (service *OAuthStateService) Create(provider string, userID int, link bool, returnTo string) (*OAuthState, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create oauth state: %w", err)
+	}
+	nonce, err := rand.String(MinBytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create oauth state: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultOAuthStateDuration
+	}
+
+	state := OAuthState{
+		Token:        token,
+		TokenHash:    service.hash(token),
+		Provider:     provider,
+		UserID:       userID,
+		Link:         link,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Nonce:        nonce,
+		ReturnTo:     returnTo,
+		ExpiresAt:    time.Now().Add(duration),
+	}
+	var dbUserID sql.NullInt64
+	if userID != 0 {
+		dbUserID = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO oauth_states (token_hash, provider, user_id, link, code_verifier, nonce, return_to, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id;`, state.TokenHash, state.Provider, dbUserID, state.Link,
+		state.CodeVerifier, state.Nonce, state.ReturnTo, state.ExpiresAt)
+	err = row.Scan(&state.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create oauth state: %w", err)
+	}
+	return &state, nil
+}
+
+// Consume the state with the given token, so it can't be used again.
+// Expired states are cleaned up along the way. Returns ErrNotFound if
+// there is no such state for the provider, or it has expired.
+func (service *OAuthStateService) Consume(provider, token string) (*OAuthState, error) {
+	_, err := service.DB.Exec(`
+		DELETE FROM oauth_states
+		WHERE expires_at <= NOW();`)
+	if err != nil {
+		return nil, fmt.Errorf("consume oauth state: %w", err)
+	}
+	state := OAuthState{
+		TokenHash: service.hash(token),
+		Provider:  provider,
+	}
+	var userID sql.NullInt64
+	row := service.DB.QueryRow(`
+		DELETE FROM oauth_states
+		WHERE token_hash = $1 AND provider = $2
+		RETURNING id, user_id, link, code_verifier, nonce, return_to, expires_at;`, state.TokenHash, state.Provider)
+	err = row.Scan(&state.ID, &userID, &state.Link, &state.CodeVerifier, &state.Nonce, &state.ReturnTo, &state.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("consume oauth state: %w", err)
+	}
+	if time.Now().After(state.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	state.UserID = int(userID.Int64)
+	return &state, nil
+}
+
+func (service *OAuthStateService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/rand"
+	"golang.org/x/oauth2"
+)
+
+// OAuthConnection is a service a user has connected their account to
+type OAuthConnection struct {
+	UserID    int
+	Provider  string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// OAuthTokenService stores the OAuth tokens of connected services,
+// encrypted with AES-GCM so a leaked database doesn't leak access to
+// users' accounts elsewhere.
+type OAuthTokenService struct {
+	DB *sql.DB
+	// Key is the 32 byte AES-256 key tokens are encrypted with
+	Key []byte
+}
+
+// Save the user's token for the provider, replacing any earlier one
+func (service *OAuthTokenService) Save(userID int, provider string, token *oauth2.Token) error {
+	sealed, err := service.seal(userID, provider, token)
+	if err != nil {
+		return fmt.Errorf("save token: %w", err)
+	}
+	_, err = service.DB.Exec(`
+		INSERT INTO oauth_tokens (user_id, provider, token)
+		VALUES ($1, $2, $3) ON CONFLICT (user_id, provider) DO
+		UPDATE
+		SET token = $3, updated_at = NOW();`, userID, provider, sealed)
+	if err != nil {
+		return fmt.Errorf("save token: %w", err)
+	}
+	return nil
+}
+
+// Find the user's token for the provider.
+// Returns ErrNotFound if the user hasn't connected it.
+func (service *OAuthTokenService) Find(userID int, provider string) (*oauth2.Token, error) {
+	var sealed []byte
+	row := service.DB.QueryRow(`
+		SELECT token
+		FROM oauth_tokens
+		WHERE user_id = $1 AND provider = $2;`, userID, provider)
+	err := row.Scan(&sealed)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("find token: %w", err)
+	}
+	token, err := service.open(userID, provider, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("find token: %w", err)
+	}
+	return token, nil
+}
+
+// TokenSource returns a source of valid tokens for the user and provider.
+// Expired tokens are refreshed with config, and the new token is saved
+// since providers may rotate the refresh token too.
+// Returns ErrNotFound if the user hasn't connected the provider.
+func (service *OAuthTokenService) TokenSource(ctx context.Context, userID int, provider string, config *oauth2.Config) (oauth2.TokenSource, error) {
+	token, err := service.Find(userID, provider)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.ReuseTokenSource(token, &savingTokenSource{
+		service:  service,
+		userID:   userID,
+		provider: provider,
+		source:   config.TokenSource(ctx, token),
+		last:     token.AccessToken,
+	}), nil
+}
+
+// ImportClient returns a client for the user's account at the import
+// provider. Returns ErrNotFound if the user hasn't connected it.
+func (service *OAuthTokenService) ImportClient(ctx context.Context, userID int, provider *ImportProvider) (ImportClient, error) {
+	tokenSource, err := service.TokenSource(ctx, userID, provider.Name, provider.Config)
+	if err != nil {
+		return nil, err
+	}
+	return provider.NewClient(oauth2.NewClient(ctx, tokenSource)), nil
+}
+
+// List the services the user has connected
+func (service *OAuthTokenService) List(userID int) ([]OAuthConnection, error) {
+	rows, err := service.DB.Query(`
+		SELECT provider, created_at, updated_at
+		FROM oauth_tokens
+		WHERE user_id = $1
+		ORDER BY provider;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list connections: %w", err)
+	}
+	defer rows.Close()
+	var connections []OAuthConnection
+	for rows.Next() {
+		connection := OAuthConnection{
+			UserID: userID,
+		}
+		err := rows.Scan(&connection.Provider, &connection.CreatedAt, &connection.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("list connections: %w", err)
+		}
+		connections = append(connections, connection)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list connections: %w", err)
+	}
+	return connections, nil
+}
+
+// Delete the user's token for the provider
+func (service *OAuthTokenService) Delete(userID int, provider string) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM oauth_tokens
+		WHERE user_id = $1 AND provider = $2;`, userID, provider)
+	if err != nil {
+		return fmt.Errorf("delete token: %w", err)
+	}
+	return nil
+}
+
+// Encrypt the token. The user and provider are authenticated along with
+// it, so a sealed token copied to another row won't open.
+func (service *OAuthTokenService) seal(userID int, provider string, token *oauth2.Token) ([]byte, error) {
+	aead, err := service.aead()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := rand.Bytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, tokenAAD(userID, provider)), nil
+}
+
+func (service *OAuthTokenService) open(userID int, provider string, sealed []byte) (*oauth2.Token, error) {
+	aead, err := service.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed token is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, tokenAAD(userID, provider))
+	if err != nil {
+		return nil, err
+	}
+	var token oauth2.Token
+	err = json.Unmarshal(plaintext, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (service *OAuthTokenService) aead() (cipher.AEAD, error) {
+	if len(service.Key) != 32 {
+		return nil, fmt.Errorf("oauth token key must be 32 bytes, got %d", len(service.Key))
+	}
+	block, err := aes.NewCipher(service.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func tokenAAD(userID int, provider string) []byte {
+	return []byte(strconv.Itoa(userID) + ":" + provider)
+}
+
+// savingTokenSource saves tokens from the wrapped source whenever they
+// change
+type savingTokenSource struct {
+	service  *OAuthTokenService
+	userID   int
+	provider string
+	source   oauth2.TokenSource
+
+	mu   sync.Mutex
+	last string
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token.AccessToken != s.last {
+		err = s.service.Save(s.userID, s.provider, token)
+		if err != nil {
+			return nil, err
+		}
+		s.last = token.AccessToken
+	}
+	return token, nil
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// NewOneDriveProvider returns a provider for importing from OneDrive.
+// Scopes default to reading the user's files. Microsoft only hands out
+// refresh tokens with the offline_access scope, so keep it if you set your
+// own.
+func NewOneDriveProvider(clientID, clientSecret string, scopes []string) *ImportProvider {
+	if len(scopes) == 0 {
+		scopes = []string{"Files.Read", "offline_access"}
+	}
+	return &ImportProvider{
+		Name:        "onedrive",
+		DisplayName: "OneDrive",
+		Config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+				TokenURL: "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+			},
+		},
+		PKCE: true,
+		NewClient: func(client *http.Client) ImportClient {
+			return &OneDriveAPI{Client: client}
+		},
+		// Microsoft has no way to revoke a single token
+	}
+}
+
+// OneDriveAPI is an ImportClient for OneDrive through the Microsoft Graph
+// API
+type OneDriveAPI struct {
+	// Client must add the user's access token to requests, e.g. one from
+	// oauth2.NewClient
+	Client *http.Client
+	// URL defaults to Microsoft Graph. It is only set to point the client at
+	// something else, like a fake in tests.
+	URL string
+}
+
+type oneDriveItem struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Folder      *struct{} `json:"folder"`
+	File        *struct{} `json:"file"`
+	DownloadURL string    `json:"@microsoft.graph.downloadUrl"`
+}
+
+// ListFolder lists the folder with the given item ID. The cursor is the
+// link Graph gives us to the next page.
+func (api *OneDriveAPI) ListFolder(ctx context.Context, folder, cursor string) (*ImportFolder, error) {
+	listURL := api.url() + "/v1.0/me/drive/root/children"
+	if folder != "" {
+		listURL = api.url() + "/v1.0/me/drive/items/" + url.PathEscape(folder) + "/children"
+	}
+	if cursor != "" {
+		// The cursor comes back to us from the browser, so make sure it
+		// can't send the user's token anywhere else
+		if !strings.HasPrefix(cursor, api.url()+"/") {
+			return nil, fmt.Errorf("list onedrive folder %q: invalid cursor", folder)
+		}
+		listURL = cursor
+	}
+	var result struct {
+		Value    []oneDriveItem `json:"value"`
+		NextLink string         `json:"@odata.nextLink"`
+	}
+	err := getJSON(ctx, api.Client, listURL, &result)
+	if err != nil {
+		return nil, fmt.Errorf("list onedrive folder %q: %w", folder, err)
+	}
+	list := ImportFolder{
+		Cursor:  result.NextLink,
+		HasMore: result.NextLink != "",
+	}
+	for _, item := range result.Value {
+		if item.Folder == nil && item.File == nil {
+			continue
+		}
+		list.Entries = append(list.Entries, ImportEntry{
+			ID:     item.ID,
+			Name:   item.Name,
+			Folder: item.Folder != nil,
+		})
+	}
+	return &list, nil
+}
+
+// Download the file with the given item ID. Graph gives us a short lived
+// link to download it from, which needs no token.
+func (api *OneDriveAPI) Download(ctx context.Context, file string) (string, io.ReadCloser, error) {
+	var item oneDriveItem
+	err := getJSON(ctx, api.Client, api.url()+"/v1.0/me/drive/items/"+url.PathEscape(file), &item)
+	if err != nil {
+		return "", nil, fmt.Errorf("download %q from onedrive: %w", file, err)
+	}
+	if item.DownloadURL == "" {
+		return "", nil, fmt.Errorf("download %q from onedrive: not a file", file)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, item.DownloadURL, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("download %q from onedrive: %w", file, err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("download %q from onedrive: %w", file, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return "", nil, fmt.Errorf("download %q from onedrive: %s", file, res.Status)
+	}
+	return item.Name, res.Body, nil
+}
+
+func (api *OneDriveAPI) url() string {
+	if api.URL == "" {
+		return "https://graph.microsoft.com"
+	}
+	return api.URL
+}
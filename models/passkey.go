@@ -0,0 +1,403 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/joncalhoun/lenslocked/rand"
+)
+
+const (
+	// DefaultCeremonyDuration is how long a user has to complete a passkey
+	// registration or sign in after it is started.
+	DefaultCeremonyDuration = 5 * time.Minute
+)
+
+// Passkey is a WebAuthn credential a user can sign in with
+type Passkey struct {
+	ID         int
+	UserID     int
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	credential webauthn.Credential
+}
+
+// PasskeyCeremony is a registration or sign in that has been started but
+// not finished. Options are sent to the browser, and Token identifies the
+// ceremony when the browser's response comes back.
+type PasskeyCeremony struct {
+	// Token is only set when a PasskeyCeremony is being created.
+	Token   string
+	Options interface{}
+}
+
+// PasskeyService runs WebAuthn registration and assertion ceremonies and
+// stores the resulting credentials.
+type PasskeyService struct {
+	DB       *sql.DB
+	WebAuthn *webauthn.WebAuthn
+	// Duration is the amount of time that a ceremony is valid for.
+	// Defaults to DefaultCeremonyDuration
+	Duration time.Duration
+}
+
+// BeginRegistration starts registering a new passkey for the user
+func (service *PasskeyService) BeginRegistration(user *User) (*PasskeyCeremony, error) {
+	waUser, err := service.webauthnUser(user.ID, user.Email)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	options, session, err := service.beginRegistration(waUser)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	token, err := service.saveCeremony(&user.ID, session)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	return &PasskeyCeremony{
+		Token:   token,
+		Options: options,
+	}, nil
+}
+
+// FinishRegistration checks the browser's response to a registration
+// ceremony and stores the new passkey under the given name.
+func (service *PasskeyService) FinishRegistration(user *User, token, name string, response io.Reader) (*Passkey, error) {
+	session, ceremonyUserID, err := service.consumeCeremony(token)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	if ceremonyUserID == nil || *ceremonyUserID != user.ID {
+		return nil, fmt.Errorf("finish passkey registration: %w", ErrNotFound)
+	}
+	waUser, err := service.webauthnUser(user.ID, user.Email)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	credential, err := service.finishRegistration(waUser, *session, response)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	passkey := Passkey{
+		UserID:     user.ID,
+		Name:       name,
+		credential: *credential,
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO passkeys (user_id, credential_id, name, credential)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;`, passkey.UserID, credential.ID, passkey.Name, credentialJSON)
+	err = row.Scan(&passkey.ID, &passkey.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	return &passkey, nil
+}
+
+// BeginLogin starts a passwordless sign in. The browser lets the user
+// pick any passkey they have for this site, so no email is needed.
+func (service *PasskeyService) BeginLogin() (*PasskeyCeremony, error) {
+	options, session, err := service.beginLogin()
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey login: %w", err)
+	}
+	token, err := service.saveCeremony(nil, session)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey login: %w", err)
+	}
+	return &PasskeyCeremony{
+		Token:   token,
+		Options: options,
+	}, nil
+}
+
+// FinishLogin checks the browser's response to a sign in ceremony and
+// returns the user the passkey belongs to.
+func (service *PasskeyService) FinishLogin(token string, response io.Reader) (*User, error) {
+	session, _, err := service.consumeCeremony(token)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+	var user *User
+	credential, err := service.finishLogin(*session, response, func(userID int) (*webauthnUser, error) {
+		user = &User{ID: userID}
+		row := service.DB.QueryRow(`
+			SELECT email, password_hash
+			FROM users
+			WHERE id = $1;`, userID)
+		err := row.Scan(&user.Email, &user.PasswordHash)
+		if err != nil {
+			return nil, err
+		}
+		return service.webauthnUser(user.ID, user.Email)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+	_, err = service.DB.Exec(`
+		UPDATE passkeys
+		SET credential = $3, last_used_at = NOW()
+		WHERE user_id = $1 AND credential_id = $2;`, user.ID, credential.ID, credentialJSON)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+	return user, nil
+}
+
+// List the passkeys registered by the user
+func (service *PasskeyService) List(userID int) ([]Passkey, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, name, credential, created_at, last_used_at
+		FROM passkeys
+		WHERE user_id = $1
+		ORDER BY created_at;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list passkeys: %w", err)
+	}
+	defer rows.Close()
+	var passkeys []Passkey
+	for rows.Next() {
+		passkey := Passkey{
+			UserID: userID,
+		}
+		var credentialJSON []byte
+		var lastUsedAt sql.NullTime
+		err := rows.Scan(&passkey.ID, &passkey.Name, &credentialJSON, &passkey.CreatedAt, &lastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("list passkeys: %w", err)
+		}
+		if lastUsedAt.Valid {
+			passkey.LastUsedAt = &lastUsedAt.Time
+		}
+		err = json.Unmarshal(credentialJSON, &passkey.credential)
+		if err != nil {
+			return nil, fmt.Errorf("list passkeys: %w", err)
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list passkeys: %w", err)
+	}
+	return passkeys, nil
+}
+
+// Delete one of the user's passkeys.
+// Returns ErrNotFound if the user has no such passkey, and
+// ErrLastSignInMethod if it is the only way left for the user to sign in.
+func (service *PasskeyService) Delete(userID, id int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	defer tx.Rollback()
+
+	methods, err := signInMethods(tx, userID)
+	if err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	if methods <= 1 {
+		return ErrLastSignInMethod
+	}
+
+	res, err := tx.Exec(`
+		DELETE FROM passkeys
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	return nil
+}
+
+// The ceremonies themselves, apart from storing their state and results
+
+func (service *PasskeyService) beginRegistration(waUser *webauthnUser) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	var exclusions []protocol.CredentialDescriptor
+	for _, cred := range waUser.credentials {
+		exclusions = append(exclusions, cred.Descriptor())
+	}
+	return service.WebAuthn.BeginRegistration(waUser,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		}),
+		webauthn.WithExclusions(exclusions),
+	)
+}
+
+func (service *PasskeyService) finishRegistration(waUser *webauthnUser, session webauthn.SessionData, response io.Reader) (*webauthn.Credential, error) {
+	parsed, err := protocol.ParseCredentialCreationResponseBody(response)
+	if err != nil {
+		return nil, err
+	}
+	return service.WebAuthn.CreateCredential(waUser, session, parsed)
+}
+
+func (service *PasskeyService) beginLogin() (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	return service.WebAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+}
+
+// finishLogin checks the response with the credentials of the user it is
+// for, which findUser loads. The credential returned has the new signature
+// counter to store.
+func (service *PasskeyService) finishLogin(session webauthn.SessionData, response io.Reader, findUser func(userID int) (*webauthnUser, error)) (*webauthn.Credential, error) {
+	parsed, err := protocol.ParseCredentialRequestResponseBody(response)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := service.WebAuthn.ValidateDiscoverableLogin(
+		func(rawID, userHandle []byte) (webauthn.User, error) {
+			if len(userHandle) != 8 {
+				return nil, ErrNotFound
+			}
+			return findUser(int(binary.BigEndian.Uint64(userHandle)))
+		}, session, parsed)
+	if err != nil {
+		return nil, err
+	}
+	if credential.Authenticator.CloneWarning {
+		return nil, ErrPasskeyCloned
+	}
+	return credential, nil
+}
+
+// Load the user along with their credentials in the shape the webauthn
+// package expects
+func (service *PasskeyService) webauthnUser(userID int, email string) (*webauthnUser, error) {
+	passkeys, err := service.List(userID)
+	if err != nil {
+		return nil, err
+	}
+	waUser := webauthnUser{
+		id:    userID,
+		email: email,
+	}
+	for _, passkey := range passkeys {
+		waUser.credentials = append(waUser.credentials, passkey.credential)
+	}
+	return &waUser, nil
+}
+
+// Store the state of a ceremony until the browser responds
+func (service *PasskeyService) saveCeremony(userID *int, session *webauthn.SessionData) (string, error) {
+	token, err := rand.String(MinBytesPerToken)
+	if err != nil {
+		return "", err
+	}
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultCeremonyDuration
+	}
+	_, err = service.DB.Exec(`
+		INSERT INTO webauthn_ceremonies (user_id, token_hash, session_data, expires_at)
+		VALUES ($1, $2, $3, $4);`, userID, service.hash(token), sessionJSON, time.Now().Add(duration))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Load and delete the state of a ceremony. Each ceremony can only be
+// finished once.
+func (service *PasskeyService) consumeCeremony(token string) (*webauthn.SessionData, *int, error) {
+	var userID sql.NullInt64
+	var sessionJSON []byte
+	var expiresAt time.Time
+	row := service.DB.QueryRow(`
+		DELETE FROM webauthn_ceremonies
+		WHERE token_hash = $1
+		RETURNING user_id, session_data, expires_at;`, service.hash(token))
+	err := row.Scan(&userID, &sessionJSON, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	if time.Now().After(expiresAt) {
+		return nil, nil, fmt.Errorf("ceremony expired")
+	}
+	var session webauthn.SessionData
+	err = json.Unmarshal(sessionJSON, &session)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !userID.Valid {
+		return &session, nil, nil
+	}
+	id := int(userID.Int64)
+	return &session, &id, nil
+}
+
+func (service *PasskeyService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// webauthnUser adapts a User to the webauthn.User interface
+type webauthnUser struct {
+	id          int
+	email       string
+	credentials []webauthn.Credential
+}
+
+// The user handle is the user's ID so it can be mapped back to the user
+// during a discoverable sign in without revealing their email.
+func (u *webauthnUser) WebAuthnID() []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(u.id))
+	return handle
+}
+
+func (u *webauthnUser) WebAuthnName() string {
+	return u.email
+}
+
+func (u *webauthnUser) WebAuthnDisplayName() string {
+	return u.email
+}
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func (u *webauthnUser) WebAuthnIcon() string {
+	return ""
+}
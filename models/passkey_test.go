@@ -0,0 +1,259 @@
+package models
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	testRPID   = "lenslocked.test"
+	testOrigin = "https://lenslocked.test"
+)
+
+// softAuthenticator is a passkey kept in memory. It answers ceremonies
+// the way a browser passes on a real authenticator's answers.
+type softAuthenticator struct {
+	t          *testing.T
+	key        *ecdsa.PrivateKey
+	id         []byte
+	userHandle []byte
+	counter    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{t: t, key: key, id: id}
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge protocol.URLEncodedBase64) []byte {
+	b, err := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": challenge.String(),
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return b
+}
+
+// The authenticator data with the user present and verified, and the
+// current signature counter
+func (a *softAuthenticator) authData(flags protocol.AuthenticatorFlags) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], byte(flags|protocol.FlagUserPresent|protocol.FlagUserVerified))
+	return binary.BigEndian.AppendUint32(data, a.counter)
+}
+
+// Register answers a registration ceremony, with "none" attestation
+func (a *softAuthenticator) register(options *protocol.CredentialCreation) []byte {
+	a.userHandle = options.Response.User.ID.(protocol.URLEncodedBase64)
+	publicKey, err := webauthncbor.Marshal(map[int]interface{}{
+		1:  2,  // EC2 key
+		3:  -7, // ES256
+		-1: 1,  // P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	authData := a.authData(protocol.FlagAttestedCredentialData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.id)))
+	authData = append(authData, a.id...)
+	authData = append(authData, publicKey...)
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.response(map[string]string{
+		"clientDataJSON":    b64url(a.clientData("webauthn.create", options.Response.Challenge)),
+		"attestationObject": b64url(attestation),
+	})
+}
+
+// Sign answers a sign in ceremony, after counting the signature
+func (a *softAuthenticator) sign(options *protocol.CredentialAssertion) []byte {
+	a.counter++
+	clientData := a.clientData("webauthn.get", options.Response.Challenge)
+	authData := a.authData(0)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.response(map[string]string{
+		"clientDataJSON":    b64url(clientData),
+		"authenticatorData": b64url(authData),
+		"signature":         b64url(signature),
+		"userHandle":        b64url(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) response(response map[string]string) []byte {
+	b, err := json.Marshal(map[string]interface{}{
+		"id":       b64url(a.id),
+		"rawId":    b64url(a.id),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return b
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestPasskeyService(t *testing.T) *PasskeyService {
+	wa, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "Lenslocked",
+		RPID:          testRPID,
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PasskeyService{WebAuthn: wa}
+}
+
+// Register a passkey for the user, and return a lookup of the user and
+// their stored credential for sign ins
+func registerPasskey(t *testing.T, service *PasskeyService, authenticator *softAuthenticator, user *webauthnUser) func(userID int) (*webauthnUser, error) {
+	options, session, err := service.beginRegistration(user)
+	if err != nil {
+		t.Fatalf("beginRegistration() err = %v", err)
+	}
+	if options.Response.AuthenticatorSelection.UserVerification != protocol.VerificationRequired {
+		t.Errorf("registration doesn't require user verification")
+	}
+	credential, err := service.finishRegistration(user, *session, bytes.NewReader(authenticator.register(options)))
+	if err != nil {
+		t.Fatalf("finishRegistration() err = %v", err)
+	}
+	if !bytes.Equal(credential.ID, authenticator.id) {
+		t.Errorf("credential ID = %x, want %x", credential.ID, authenticator.id)
+	}
+	user.credentials = append(user.credentials, *credential)
+	return func(userID int) (*webauthnUser, error) {
+		if userID != user.id {
+			return nil, ErrNotFound
+		}
+		return user, nil
+	}
+}
+
+// Sign in with the authenticator, storing the new signature counter the
+// way FinishLogin does
+func signInWithPasskey(t *testing.T, service *PasskeyService, authenticator *softAuthenticator, user *webauthnUser, findUser func(int) (*webauthnUser, error)) error {
+	options, session, err := service.beginLogin()
+	if err != nil {
+		t.Fatalf("beginLogin() err = %v", err)
+	}
+	credential, err := service.finishLogin(*session, bytes.NewReader(authenticator.sign(options)), findUser)
+	if err != nil {
+		return err
+	}
+	user.credentials[0] = *credential
+	return nil
+}
+
+func TestPasskeyCeremonies(t *testing.T) {
+	service := newTestPasskeyService(t)
+	authenticator := newSoftAuthenticator(t)
+	user := &webauthnUser{id: 42, email: "jon@example.com"}
+	findUser := registerPasskey(t, service, authenticator, user)
+
+	for i := 1; i <= 2; i++ {
+		err := signInWithPasskey(t, service, authenticator, user, findUser)
+		if err != nil {
+			t.Fatalf("sign in %d: err = %v", i, err)
+		}
+		if got := user.credentials[0].Authenticator.SignCount; got != uint32(i) {
+			t.Errorf("sign in %d: stored counter = %d, want %d", i, got, i)
+		}
+	}
+
+	// Signing a ceremony's challenge doesn't sign another one
+	options, _, err := service.beginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, session, err := service.beginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.finishLogin(*session, bytes.NewReader(authenticator.sign(options)), findUser)
+	if err == nil {
+		t.Errorf("finishLogin() with another ceremony's challenge succeeded")
+	}
+}
+
+func TestPasskeyRejectsBackwardsCounter(t *testing.T) {
+	service := newTestPasskeyService(t)
+	authenticator := newSoftAuthenticator(t)
+	user := &webauthnUser{id: 42, email: "jon@example.com"}
+	findUser := registerPasskey(t, service, authenticator, user)
+	authenticator.counter = 10
+	err := signInWithPasskey(t, service, authenticator, user, findUser)
+	if err != nil {
+		t.Fatalf("sign in: err = %v", err)
+	}
+
+	// A copy of the key that has signed less often than the original
+	clone := *authenticator
+	clone.counter = 4
+	err = signInWithPasskey(t, service, &clone, user, findUser)
+	if !errors.Is(err, ErrPasskeyCloned) {
+		t.Errorf("sign in with a lower counter: err = %v, want ErrPasskeyCloned", err)
+	}
+
+	// Or the same number of times
+	clone.counter = 10
+	err = signInWithPasskey(t, service, &clone, user, findUser)
+	if !errors.Is(err, ErrPasskeyCloned) {
+		t.Errorf("sign in with a repeated counter: err = %v, want ErrPasskeyCloned", err)
+	}
+	if got := user.credentials[0].Authenticator.SignCount; got != 11 {
+		t.Errorf("stored counter = %d, want it left at 11", got)
+	}
+}
+
+func TestPasskeyRejectsUnknownUser(t *testing.T) {
+	service := newTestPasskeyService(t)
+	authenticator := newSoftAuthenticator(t)
+	user := &webauthnUser{id: 42, email: "jon@example.com"}
+	registerPasskey(t, service, authenticator, user)
+
+	err := signInWithPasskey(t, service, authenticator, user, func(int) (*webauthnUser, error) {
+		return nil, ErrNotFound
+	})
+	if err == nil {
+		t.Errorf("sign in for a user who doesn't exist succeeded")
+	}
+}
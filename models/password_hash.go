@@ -0,0 +1,181 @@
+package models
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/joncalhoun/lenslocked/rand"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Argon2id defaults follow the second recommended option of RFC 9106.
+	DefaultArgon2Memory      = 64 * 1024 // KiB
+	DefaultArgon2Iterations  = 3
+	DefaultArgon2Parallelism = 4
+	DefaultArgon2SaltLength  = 16
+	DefaultArgon2KeyLength   = 32
+)
+
+// PasswordHasher hashes new passwords. Hashes are tagged with the algorithm
+// and parameters used, so VerifyPassword can check them after the hasher
+// or its parameters change.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether a hash was made with another algorithm or
+	// weaker parameters than the hasher's, and should be replaced the next
+	// time the password is known.
+	NeedsRehash(hash string) bool
+}
+
+// VerifyPassword checks a password against a hash made by any of the
+// supported hashers. It returns false if the password doesn't match.
+func VerifyPassword(password, hash string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, fmt.Errorf("verify password: %w", err)
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, nil
+			}
+			return false, fmt.Errorf("verify password: %w", err)
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("verify password: unknown hash algorithm")
+	}
+}
+
+// BcryptHasher hashes passwords with bcrypt
+type BcryptHasher struct {
+	// Cost defaults to bcrypt.DefaultCost
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	if err != nil {
+		return "", fmt.Errorf("bcrypt: %w", err)
+	}
+	return string(hashedBytes), nil
+}
+
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost < h.cost()
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+// Argon2idHasher hashes passwords with Argon2id, storing them in the PHC
+// string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+type Argon2idHasher struct {
+	// Memory is in KiB and defaults to DefaultArgon2Memory
+	Memory uint32
+	// Iterations defaults to DefaultArgon2Iterations
+	Iterations uint32
+	// Parallelism defaults to DefaultArgon2Parallelism
+	Parallelism uint8
+	// SaltLength defaults to DefaultArgon2SaltLength
+	SaltLength int
+	// KeyLength defaults to DefaultArgon2KeyLength
+	KeyLength uint32
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	params := h.withDefaults()
+	salt, err := rand.Bytes(params.SaltLength)
+	if err != nil {
+		return "", fmt.Errorf("argon2id: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return true
+	}
+	stored, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	params := h.withDefaults()
+	return stored.Memory < params.Memory ||
+		stored.Iterations < params.Iterations ||
+		stored.Parallelism < params.Parallelism ||
+		len(salt) < params.SaltLength ||
+		uint32(len(key)) < params.KeyLength
+}
+
+func (h Argon2idHasher) withDefaults() Argon2idHasher {
+	if h.Memory == 0 {
+		h.Memory = DefaultArgon2Memory
+	}
+	if h.Iterations == 0 {
+		h.Iterations = DefaultArgon2Iterations
+	}
+	if h.Parallelism == 0 {
+		h.Parallelism = DefaultArgon2Parallelism
+	}
+	if h.SaltLength == 0 {
+		h.SaltLength = DefaultArgon2SaltLength
+	}
+	if h.KeyLength == 0 {
+		h.KeyLength = DefaultArgon2KeyLength
+	}
+	return h
+}
+
+// Parse the parameters, salt and key out of an Argon2id PHC string
+func decodeArgon2id(hash string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, fmt.Errorf("argon2id: malformed hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("argon2id: malformed version: %w", err)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("argon2id: unsupported version %d", version)
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("argon2id: malformed parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("argon2id: malformed salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("argon2id: malformed key: %w", err)
+	}
+	return params, salt, key, nil
+}
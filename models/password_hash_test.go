@@ -0,0 +1,259 @@
+package models
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap Argon2id parameters so the tests run quickly
+var testArgon2id = Argon2idHasher{Memory: 8 * 1024, Iterations: 2, Parallelism: 2}
+
+func testHash(t *testing.T, hasher PasswordHasher, password string) string {
+	hash, err := hasher.Hash(password)
+	if err != nil {
+		t.Fatalf("Hash() err = %v", err)
+	}
+	return hash
+}
+
+func TestVerifyPassword(t *testing.T) {
+	const password = "correct horse battery staple"
+	tests := map[string]string{
+		"legacy bcrypt": testHash(t, BcryptHasher{Cost: bcrypt.MinCost}, password),
+		"argon2id":      testHash(t, testArgon2id, password),
+	}
+	for name, hash := range tests {
+		t.Run(name, func(t *testing.T) {
+			match, err := VerifyPassword(password, hash)
+			if err != nil || !match {
+				t.Errorf("VerifyPassword(right password) = %v, %v; want true", match, err)
+			}
+			match, err = VerifyPassword(password+"!", hash)
+			if err != nil || match {
+				t.Errorf("VerifyPassword(wrong password) = %v, %v; want false", match, err)
+			}
+		})
+	}
+}
+
+func TestVerifyPasswordMalformed(t *testing.T) {
+	hash := testHash(t, testArgon2id, "password")
+	parts := strings.Split(hash, "$")
+	tests := map[string]string{
+		"empty":               "",
+		"plain text":          "password",
+		"unknown algorithm":   "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5",
+		"truncated bcrypt":    "$2a$10$short",
+		"missing key":         strings.Join(parts[:5], "$"),
+		"extra field":         hash + "$more",
+		"unsupported version": strings.Replace(hash, "v=19", "v=16", 1),
+		"bad parameters":      strings.Replace(hash, parts[3], "m=lots,t=3,p=4", 1),
+		"bad salt":            strings.Replace(hash, parts[4], "!!!!", 1),
+		"bad key":             strings.Replace(hash, parts[5], "!!!!", 1),
+	}
+	for name, hash := range tests {
+		t.Run(name, func(t *testing.T) {
+			match, err := VerifyPassword("password", hash)
+			if err == nil || match {
+				t.Errorf("VerifyPassword(%q) = %v, %v; want an error", hash, match, err)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	weaker := func(change func(h *Argon2idHasher)) string {
+		h := testArgon2id
+		change(&h)
+		return testHash(t, h, "password")
+	}
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		hash   string
+		want   bool
+	}{
+		{"bcrypt to argon2id", testArgon2id, testHash(t, BcryptHasher{Cost: bcrypt.MinCost}, "password"), true},
+		{"less memory", testArgon2id, weaker(func(h *Argon2idHasher) { h.Memory /= 2 }), true},
+		{"fewer iterations", testArgon2id, weaker(func(h *Argon2idHasher) { h.Iterations-- }), true},
+		{"less parallelism", testArgon2id, weaker(func(h *Argon2idHasher) { h.Parallelism-- }), true},
+		{"shorter salt", testArgon2id, weaker(func(h *Argon2idHasher) { h.SaltLength = 8 }), true},
+		{"shorter key", testArgon2id, weaker(func(h *Argon2idHasher) { h.KeyLength = 16 }), true},
+		{"current parameters", testArgon2id, testHash(t, testArgon2id, "password"), false},
+		{"stronger parameters", testArgon2id, weaker(func(h *Argon2idHasher) { h.Iterations++ }), false},
+		{"malformed argon2id", testArgon2id, "$argon2id$v=19$m=8192", true},
+		{"lower bcrypt cost", BcryptHasher{Cost: bcrypt.MinCost + 1}, testHash(t, BcryptHasher{Cost: bcrypt.MinCost}, "password"), true},
+		{"current bcrypt cost", BcryptHasher{Cost: bcrypt.MinCost}, testHash(t, BcryptHasher{Cost: bcrypt.MinCost}, "password"), false},
+		{"argon2id to bcrypt", BcryptHasher{Cost: bcrypt.MinCost}, testHash(t, testArgon2id, "password"), true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.hasher.NeedsRehash(tc.hash); got != tc.want {
+				t.Errorf("NeedsRehash(%q) = %v, want %v", tc.hash, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateUpgradesHash(t *testing.T) {
+	const password = "correct horse battery staple"
+	legacy := testHash(t, BcryptHasher{Cost: bcrypt.MinCost}, password)
+	db := openFakeUsers(t, &fakeUser{id: 7, email: "jon@example.com", passwordHash: legacy})
+	us := UserService{DB: db.DB, Hasher: testArgon2id}
+
+	_, err := us.Authenticate("jon@example.com", "wrong password")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Authenticate(wrong password) err = %v, want ErrInvalidCredentials", err)
+	}
+	if db.user.passwordHash != legacy || db.updates != 0 {
+		t.Fatalf("a wrong password changed the stored hash")
+	}
+
+	user, err := us.Authenticate("Jon@Example.com", password)
+	if err != nil {
+		t.Fatalf("Authenticate() err = %v", err)
+	}
+	if user.ID != 7 || user.PasswordHash != db.user.passwordHash {
+		t.Errorf("Authenticate() = %+v, want user 7 with the stored hash", user)
+	}
+	if !strings.HasPrefix(db.user.passwordHash, "$argon2id$") {
+		t.Fatalf("stored hash = %q, want it upgraded to argon2id", db.user.passwordHash)
+	}
+	if match, err := VerifyPassword(password, db.user.passwordHash); err != nil || !match {
+		t.Errorf("VerifyPassword(upgraded hash) = %v, %v; want true", match, err)
+	}
+
+	// The upgraded hash is current, so it is left alone from now on
+	_, err = us.Authenticate("jon@example.com", password)
+	if err != nil {
+		t.Fatalf("Authenticate() after upgrade err = %v", err)
+	}
+	if db.updates != 1 {
+		t.Errorf("hash updated %d times, want once", db.updates)
+	}
+}
+
+// fakeUsers is a database/sql driver holding a single user, answering
+// just the queries Authenticate makes
+type fakeUsers struct {
+	*sql.DB
+	mu      sync.Mutex
+	user    *fakeUser
+	updates int
+}
+
+type fakeUser struct {
+	id           int
+	email        string
+	passwordHash string
+}
+
+var (
+	fakeUsersMu  sync.Mutex
+	fakeUsersDBs = map[string]*fakeUsers{}
+)
+
+func init() {
+	sql.Register("fakeusers", fakeUsersDriver{})
+}
+
+func openFakeUsers(t *testing.T, user *fakeUser) *fakeUsers {
+	db := &fakeUsers{user: user}
+	fakeUsersMu.Lock()
+	fakeUsersDBs[t.Name()] = db
+	fakeUsersMu.Unlock()
+	sqlDB, err := sql.Open("fakeusers", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	db.DB = sqlDB
+	return db
+}
+
+type fakeUsersDriver struct{}
+
+func (fakeUsersDriver) Open(name string) (driver.Conn, error) {
+	fakeUsersMu.Lock()
+	defer fakeUsersMu.Unlock()
+	db, ok := fakeUsersDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database %q", name)
+	}
+	return fakeUsersConn{db}, nil
+}
+
+type fakeUsersConn struct {
+	db *fakeUsers
+}
+
+func (c fakeUsersConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeUsersStmt{db: c.db, query: query}, nil
+}
+
+func (c fakeUsersConn) Close() error { return nil }
+
+func (c fakeUsersConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakeusers: transactions aren't supported")
+}
+
+type fakeUsersStmt struct {
+	db    *fakeUsers
+	query string
+}
+
+func (s fakeUsersStmt) Close() error  { return nil }
+func (s fakeUsersStmt) NumInput() int { return -1 }
+
+func (s fakeUsersStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.Contains(s.query, "UPDATE users") || !strings.Contains(s.query, "SET password_hash") {
+		return nil, fmt.Errorf("fakeusers: unexpected query %q", s.query)
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	user := s.db.user
+	if args[0] != int64(user.id) || args[1] != user.passwordHash {
+		return driver.RowsAffected(0), nil
+	}
+	user.passwordHash = args[2].(string)
+	s.db.updates++
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeUsersStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.Contains(s.query, "SELECT id, password_hash, locked_until") {
+		return nil, fmt.Errorf("fakeusers: unexpected query %q", s.query)
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	rows := &fakeUsersRows{columns: []string{"id", "password_hash", "locked_until"}}
+	if user := s.db.user; args[0] == user.email {
+		rows.values = [][]driver.Value{{int64(user.id), user.passwordHash, nil}}
+	}
+	return rows, nil
+}
+
+type fakeUsersRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeUsersRows) Columns() []string { return r.columns }
+func (r *fakeUsersRows) Close() error      { return nil }
+
+func (r *fakeUsersRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/joncalhoun/lenslocked/errors"
+)
+
+const (
+	// DefaultMinPasswordLength is the fewest characters a password may have
+	// unless the policy says otherwise.
+	DefaultMinPasswordLength = 8
+	// MaxPasswordLength is the most bytes of a password bcrypt looks at.
+	// Anything after that would be silently ignored, so longer passwords
+	// are refused instead.
+	MaxPasswordLength = 72
+
+	// BreachedRecordSize is the size of each record in a breached password
+	// file: the first 8 bytes of the SHA-1 of the password, big-endian.
+	BreachedRecordSize = 8
+)
+
+// PasswordPolicy decides which passwords users may choose. A nil policy
+// applies the defaults.
+type PasswordPolicy struct {
+	// MinLength defaults to DefaultMinPasswordLength
+	MinLength int
+	// MaxLength is in bytes, unlike MinLength which counts characters. It
+	// defaults to MaxPasswordLength and can't be set any higher.
+	MaxLength int
+	// Breached is checked when set so passwords known to attackers are
+	// refused.
+	Breached *BreachedPasswords
+}
+
+// Check returns a public error wrapping ErrWeakPassword if the password
+// breaks the policy.
+func (p *PasswordPolicy) Check(email, password string) error {
+	var policy PasswordPolicy
+	if p != nil {
+		policy = *p
+	}
+	if policy.MinLength == 0 {
+		policy.MinLength = DefaultMinPasswordLength
+	}
+	if policy.MaxLength == 0 || policy.MaxLength > MaxPasswordLength {
+		policy.MaxLength = MaxPasswordLength
+	}
+
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return errors.Public(ErrWeakPassword,
+			fmt.Sprintf("Your password must be at least %d characters long.", policy.MinLength))
+	}
+	if len(password) > policy.MaxLength {
+		return errors.Public(ErrWeakPassword,
+			fmt.Sprintf("Your password can't be longer than %d bytes. Accented letters, symbols and emoji take more than one byte each.", policy.MaxLength))
+	}
+	email = strings.ToLower(email)
+	lower := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(email, "@")
+	if lower == email || lower == localPart {
+		return errors.Public(ErrWeakPassword, "Your password can't be your email address.")
+	}
+	if policy.Breached != nil {
+		breached, err := policy.Breached.Contains(password)
+		if err != nil {
+			return fmt.Errorf("check password: %w", err)
+		}
+		if breached {
+			return errors.Public(ErrWeakPassword,
+				"That password has appeared in a data breach and is easy to guess. Please choose another one.")
+		}
+	}
+	return nil
+}
+
+// BreachedPasswords looks passwords up in a list of known breached
+// passwords. The list is a file of BreachedRecordSize records sorted in
+// ascending order, so even huge lists can be binary searched on disk
+// without loading them into memory. cmd/breachedpw builds these files.
+type BreachedPasswords struct {
+	r     io.ReaderAt
+	count int64
+}
+
+// NewBreachedPasswords reads a breached password list of the given size
+// in bytes from r.
+func NewBreachedPasswords(r io.ReaderAt, size int64) (*BreachedPasswords, error) {
+	if size%BreachedRecordSize != 0 {
+		return nil, fmt.Errorf("breached passwords: size %d is not a multiple of %d", size, BreachedRecordSize)
+	}
+	return &BreachedPasswords{
+		r:     r,
+		count: size / BreachedRecordSize,
+	}, nil
+}
+
+// OpenBreachedPasswords opens a breached password list on disk. The file
+// stays open for as long as the list is used.
+func OpenBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open breached passwords: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open breached passwords: %w", err)
+	}
+	bp, err := NewBreachedPasswords(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open breached passwords: %w", err)
+	}
+	return bp, nil
+}
+
+// OpenBreachedPasswordsFS opens a breached password list from a file
+// system, such as the list bundled in the passwords package.
+func OpenBreachedPasswordsFS(fsys fs.FS, name string) (*BreachedPasswords, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open breached passwords: %w", err)
+	}
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("open breached passwords: %v does not support random access", name)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open breached passwords: %w", err)
+	}
+	bp, err := NewBreachedPasswords(r, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open breached passwords: %w", err)
+	}
+	return bp, nil
+}
+
+// Contains reports whether the password is in the list
+func (bp *BreachedPasswords) Contains(password string) (bool, error) {
+	target := BreachedPasswordKey(password)
+	record := make([]byte, BreachedRecordSize)
+	lo, hi := int64(0), bp.count
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		_, err := bp.r.ReadAt(record, mid*BreachedRecordSize)
+		if err != nil {
+			return false, fmt.Errorf("breached passwords: %w", err)
+		}
+		key := binary.BigEndian.Uint64(record)
+		switch {
+		case key == target:
+			return true, nil
+		case key < target:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// BreachedPasswordKey is the record stored for a password in a breached
+// password list
+func BreachedPasswordKey(password string) uint64 {
+	sum := sha1.Sum([]byte(password))
+	return binary.BigEndian.Uint64(sum[:BreachedRecordSize])
+}
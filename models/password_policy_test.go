@@ -0,0 +1,147 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/joncalhoun/lenslocked/passwords"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	breached := testBreachedPasswords(t, "correct horse battery staple")
+	tests := []struct {
+		name     string
+		policy   *PasswordPolicy
+		password string
+		weak     bool
+	}{
+		{"one short of the minimum", nil, "abcdefg", true},
+		{"the minimum", nil, "abcdefgh", false},
+		{"multibyte characters count once", nil, "ééééééé", true},
+		{"multibyte minimum", nil, "éééééééé", false},
+		{"custom minimum", &PasswordPolicy{MinLength: 12}, "abcdefghijk", true},
+		{"at the byte cap", nil, strings.Repeat("a", MaxPasswordLength), false},
+		{"over the byte cap", nil, strings.Repeat("a", MaxPasswordLength+1), true},
+		{"two byte characters at the cap", nil, strings.Repeat("é", MaxPasswordLength/2), false},
+		{"four byte characters at the cap", nil, strings.Repeat("📷", MaxPasswordLength/4), false},
+		{"multibyte over the cap", nil, strings.Repeat("é", MaxPasswordLength/2) + "a", true},
+		{"custom maximum", &PasswordPolicy{MaxLength: 10}, "abcdefghijk", true},
+		{"maximum can't be raised past the cap", &PasswordPolicy{MaxLength: 100}, strings.Repeat("a", MaxPasswordLength+1), true},
+		{"email address", nil, "Jon@Example.com", true},
+		{"contains the email local part", nil, "JON12345", false},
+		{"breached", &PasswordPolicy{Breached: breached}, "correct horse battery staple", true},
+		{"not breached", &PasswordPolicy{Breached: breached}, "correct horse battery stapler", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.Check("jon@example.com", tc.password)
+			if tc.weak && !errors.Is(err, ErrWeakPassword) {
+				t.Errorf("Check(%q) err = %v, want ErrWeakPassword", tc.password, err)
+			}
+			if !tc.weak && err != nil {
+				t.Errorf("Check(%q) err = %v, want nil", tc.password, err)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyRejectsLocalPart(t *testing.T) {
+	var policy *PasswordPolicy
+	err := policy.Check("jonathan@example.com", "JONATHAN")
+	if !errors.Is(err, ErrWeakPassword) {
+		t.Errorf("Check() err = %v, want ErrWeakPassword", err)
+	}
+}
+
+func TestBreachedPasswordsContains(t *testing.T) {
+	list := []string{"alpha", "bravo", "charlie", "delta", "echo"}
+	bp := testBreachedPasswords(t, list...)
+	for _, password := range list {
+		found, err := bp.Contains(password)
+		if err != nil || !found {
+			t.Errorf("Contains(%q) = %v, %v; want true", password, found, err)
+		}
+	}
+	for _, password := range []string{"", "Alpha", "foxtrot", "alpha "} {
+		found, err := bp.Contains(password)
+		if err != nil || found {
+			t.Errorf("Contains(%q) = %v, %v; want false", password, found, err)
+		}
+	}
+
+	empty := testBreachedPasswords(t)
+	found, err := empty.Contains("alpha")
+	if err != nil || found {
+		t.Errorf("empty list Contains() = %v, %v; want false", found, err)
+	}
+
+	_, err = NewBreachedPasswords(bytes.NewReader(make([]byte, 12)), 12)
+	if err == nil {
+		t.Errorf("NewBreachedPasswords() with a partial record succeeded")
+	}
+}
+
+// The bundled list must be what cmd/breachedpw builds from common.txt:
+// every password in it, sorted and without duplicates.
+func TestBundledBreachedPasswords(t *testing.T) {
+	bp, err := OpenBreachedPasswordsFS(passwords.FS, "common.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open("../passwords/common.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var keys []uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		password := strings.TrimRight(scanner.Text(), "\r")
+		if password == "" {
+			continue
+		}
+		keys = append(keys, BreachedPasswordKey(password))
+		found, err := bp.Contains(password)
+		if err != nil || !found {
+			t.Errorf("Contains(%q) = %v, %v; want true", password, found, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	if bp.count != int64(len(keys)) {
+		t.Errorf("common.bin has %d records, want %d; regenerate it with go generate ./passwords", bp.count, len(keys))
+	}
+
+	found, err := bp.Contains("lenslocked is not a common password")
+	if err != nil || found {
+		t.Errorf("Contains(uncommon) = %v, %v; want false", found, err)
+	}
+}
+
+// A breached password list of the given passwords, built the way
+// cmd/breachedpw builds one
+func testBreachedPasswords(t *testing.T, list ...string) *BreachedPasswords {
+	var keys []uint64
+	for _, password := range list {
+		keys = append(keys, BreachedPasswordKey(password))
+	}
+	slices.Sort(keys)
+	var b []byte
+	for _, key := range keys {
+		b = binary.BigEndian.AppendUint64(b, key)
+	}
+	bp, err := NewBreachedPasswords(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bp
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -38,6 +39,8 @@ type PasswordResetService struct {
 	Duration time.Duration
 }
 
+// Create a new password_resets record for the user with the given email.
+// Returns ErrNotFound if there is no such user.
 func (service *PasswordResetService) Create(email string) (*PasswordReset, error) {
 	email = strings.ToLower(email)
 	var userID int
@@ -45,12 +48,14 @@ func (service *PasswordResetService) Create(email string) (*PasswordReset, error
 		SELECT id FROM users WHERE email = $1;`, email)
 	err := row.Scan(&userID)
 	if err != nil {
-		// TODO: Consider returning a specific error when the user does not exist.
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
 		return nil, fmt.Errorf("create: %w", err)
 	}
 
 	bytesPerToken := service.BytesPerToken
-	if bytesPerToken == 0 {
+	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
 	}
 
@@ -85,7 +90,31 @@ func (service *PasswordResetService) Create(email string) (*PasswordReset, error
 }
 
 // We are going to consume a token and return the user associated with it, or return an error if the token wasn't valid for any reason.
+// Returns ErrTokenInvalid for unknown tokens and ErrTokenExpired for expired ones.
 func (service *PasswordResetService) Consume(token string) (*User, error) {
+	pwReset, user, err := service.find(token)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	err = service.delete(pwReset.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	return user, nil
+}
+
+// Check that a token can still be used without consuming it, so the reset
+// form can tell the user their link expired before they pick a password.
+// Returns the user associated with the token.
+func (service *PasswordResetService) Check(token string) (*User, error) {
+	_, user, err := service.find(token)
+	if err != nil {
+		return nil, fmt.Errorf("check: %w", err)
+	}
+	return user, nil
+}
+
+func (service *PasswordResetService) find(token string) (*PasswordReset, *User, error) {
 	tokenHash := service.hash(token)
 	var user User
 	var pwReset PasswordReset
@@ -104,18 +133,15 @@ func (service *PasswordResetService) Consume(token string) (*User, error) {
 		&pwReset.ID, &pwReset.ExpiresAt,
 		&user.ID, &user.Email, &user.PasswordHash)
 	if err != nil {
-		return nil, fmt.Errorf("consume: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrTokenInvalid
+		}
+		return nil, nil, err
 	}
 	if time.Now().After(pwReset.ExpiresAt) {
-		return nil, fmt.Errorf("token expired: %v", token)
-	}
-
-	err = service.delete(pwReset.ID)
-	if err != nil {
-		return nil, fmt.Errorf("consume: %w", err)
+		return nil, nil, ErrTokenExpired
 	}
-	return &user, nil
-
+	return &pwReset, &user, nil
 }
 
 func (service *PasswordResetService) delete(id int) error {
@@ -0,0 +1,287 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRateLimitWindow is how long failures are remembered after the
+	// most recent one.
+	DefaultRateLimitWindow = time.Hour
+	// DefaultFreeAttempts is how many failures are allowed before delays
+	// kick in.
+	DefaultFreeAttempts = 3
+	// DefaultBaseDelay is the delay after the first failure beyond the free
+	// attempts. It doubles with every further failure.
+	DefaultBaseDelay = time.Second
+	// DefaultMaxDelay caps the progressive delay.
+	DefaultMaxDelay = 15 * time.Minute
+	// DefaultLockoutThreshold is how many failures lock an account.
+	DefaultLockoutThreshold = 10
+	// DefaultLockoutDuration is how long an account stays locked unless
+	// the owner unlocks it from the email they are sent.
+	DefaultLockoutDuration = time.Hour
+	// memoryPruneInterval is how many failures MemoryRateLimiter records
+	// between sweeps for expired keys.
+	memoryPruneInterval = 1000
+)
+
+// Attempts is the failure history recorded for a key
+type Attempts struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// RateLimiter records failed attempts per key, forgetting them once a
+// window has passed without any new failure.
+type RateLimiter interface {
+	Get(key string) (Attempts, error)
+	Fail(key string) (Attempts, error)
+	Reset(key string) error
+}
+
+// MemoryRateLimiter keeps attempts in process memory. It is only suitable
+// when a single server is running.
+type MemoryRateLimiter struct {
+	// Window defaults to DefaultRateLimitWindow
+	Window time.Duration
+
+	mu       sync.Mutex
+	attempts map[string]Attempts
+	// Failures recorded since the last prune
+	fails int
+}
+
+func (rl *MemoryRateLimiter) Get(key string) (Attempts, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.get(key), nil
+}
+
+func (rl *MemoryRateLimiter) Fail(key string) (Attempts, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.attempts == nil {
+		rl.attempts = make(map[string]Attempts)
+	}
+	attempts := rl.get(key)
+	attempts.Failures++
+	attempts.LastFailure = time.Now()
+	rl.attempts[key] = attempts
+	rl.fails++
+	if rl.fails >= memoryPruneInterval {
+		rl.prune()
+	}
+	return attempts, nil
+}
+
+func (rl *MemoryRateLimiter) Reset(key string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.attempts, key)
+	return nil
+}
+
+// Callers must hold rl.mu
+func (rl *MemoryRateLimiter) get(key string) Attempts {
+	attempts, ok := rl.attempts[key]
+	if !ok || time.Since(attempts.LastFailure) > rateLimitWindow(rl.Window) {
+		return Attempts{}
+	}
+	return attempts
+}
+
+// Drop keys whose window has passed so the map doesn't grow forever. It
+// walks the whole map, so Fail only calls it every memoryPruneInterval
+// failures. Callers must hold rl.mu
+func (rl *MemoryRateLimiter) prune() {
+	rl.fails = 0
+	window := rateLimitWindow(rl.Window)
+	for key, attempts := range rl.attempts {
+		if time.Since(attempts.LastFailure) > window {
+			delete(rl.attempts, key)
+		}
+	}
+}
+
+// PostgresRateLimiter keeps attempts in the rate_limits table so every
+// server sees the same counts.
+type PostgresRateLimiter struct {
+	DB *sql.DB
+	// Window defaults to DefaultRateLimitWindow
+	Window time.Duration
+}
+
+func (rl *PostgresRateLimiter) Get(key string) (Attempts, error) {
+	var attempts Attempts
+	row := rl.DB.QueryRow(`
+		SELECT failures, last_failure_at
+		FROM rate_limits
+		WHERE key = $1 AND last_failure_at > $2;`, key, time.Now().Add(-rateLimitWindow(rl.Window)))
+	err := row.Scan(&attempts.Failures, &attempts.LastFailure)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Attempts{}, nil
+		}
+		return Attempts{}, fmt.Errorf("get attempts: %w", err)
+	}
+	return attempts, nil
+}
+
+func (rl *PostgresRateLimiter) Fail(key string) (Attempts, error) {
+	now := time.Now()
+	var attempts Attempts
+	// Start counting again if the previous failures fell out of the window
+	row := rl.DB.QueryRow(`
+		INSERT INTO rate_limits (key, failures, last_failure_at)
+		VALUES ($1, 1, $2) ON CONFLICT (key) DO
+		UPDATE
+		SET failures = CASE
+				WHEN rate_limits.last_failure_at > $3 THEN rate_limits.failures + 1
+				ELSE 1
+			END,
+			last_failure_at = $2
+		RETURNING failures, last_failure_at;`, key, now, now.Add(-rateLimitWindow(rl.Window)))
+	err := row.Scan(&attempts.Failures, &attempts.LastFailure)
+	if err != nil {
+		return Attempts{}, fmt.Errorf("record failure: %w", err)
+	}
+	return attempts, nil
+}
+
+func (rl *PostgresRateLimiter) Reset(key string) error {
+	_, err := rl.DB.Exec(`
+		DELETE FROM rate_limits
+		WHERE key = $1;`, key)
+	if err != nil {
+		return fmt.Errorf("reset attempts: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes rows whose window has passed
+func (rl *PostgresRateLimiter) DeleteExpired() error {
+	_, err := rl.DB.Exec(`
+		DELETE FROM rate_limits
+		WHERE last_failure_at <= $1;`, time.Now().Add(-rateLimitWindow(rl.Window)))
+	if err != nil {
+		return fmt.Errorf("delete expired attempts: %w", err)
+	}
+	return nil
+}
+
+func rateLimitWindow(window time.Duration) time.Duration {
+	if window == 0 {
+		return DefaultRateLimitWindow
+	}
+	return window
+}
+
+// Throttle turns the failures recorded by a RateLimiter into progressively
+// longer waits between attempts.
+type Throttle struct {
+	Limiter RateLimiter
+	// FreeAttempts defaults to DefaultFreeAttempts
+	FreeAttempts int
+	// BaseDelay defaults to DefaultBaseDelay
+	BaseDelay time.Duration
+	// MaxDelay defaults to DefaultMaxDelay
+	MaxDelay time.Duration
+	// LockoutThreshold defaults to DefaultLockoutThreshold
+	LockoutThreshold int
+	// LockoutDuration defaults to DefaultLockoutDuration
+	LockoutDuration time.Duration
+}
+
+// Wait returns how much longer the caller must wait before another attempt
+// is allowed for any of the keys. Zero means go ahead.
+func (t *Throttle) Wait(keys ...string) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range keys {
+		attempts, err := t.Limiter.Get(key)
+		if err != nil {
+			return 0, fmt.Errorf("throttle: %w", err)
+		}
+		remaining := time.Until(attempts.LastFailure.Add(t.delay(attempts.Failures)))
+		if remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, nil
+}
+
+// Fail records a failed attempt against every key and returns the highest
+// failure count among them.
+func (t *Throttle) Fail(keys ...string) (int, error) {
+	var most int
+	for _, key := range keys {
+		attempts, err := t.Limiter.Fail(key)
+		if err != nil {
+			return 0, fmt.Errorf("throttle: %w", err)
+		}
+		if attempts.Failures > most {
+			most = attempts.Failures
+		}
+	}
+	return most, nil
+}
+
+// Reset forgets the failures of every key
+func (t *Throttle) Reset(keys ...string) error {
+	for _, key := range keys {
+		err := t.Limiter.Reset(key)
+		if err != nil {
+			return fmt.Errorf("throttle: %w", err)
+		}
+	}
+	return nil
+}
+
+// ShouldLock reports whether the given failure count is the one that
+// should lock the account. It is only true once per window so the owner
+// isn't sent an unlock email for every further failure.
+func (t *Throttle) ShouldLock(failures int) bool {
+	threshold := t.LockoutThreshold
+	if threshold == 0 {
+		threshold = DefaultLockoutThreshold
+	}
+	return failures == threshold
+}
+
+// LockedUntil returns when a lock placed now should end
+func (t *Throttle) LockedUntil() time.Time {
+	duration := t.LockoutDuration
+	if duration == 0 {
+		duration = DefaultLockoutDuration
+	}
+	return time.Now().Add(duration)
+}
+
+// The delay required after the given number of failures
+func (t *Throttle) delay(failures int) time.Duration {
+	free, base, max := t.FreeAttempts, t.BaseDelay, t.MaxDelay
+	if free == 0 {
+		free = DefaultFreeAttempts
+	}
+	if base == 0 {
+		base = DefaultBaseDelay
+	}
+	if max == 0 {
+		max = DefaultMaxDelay
+	}
+	if failures <= free {
+		return 0
+	}
+	delay := base
+	for i := free + 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,360 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Storage keeps blobs in a bucket of Amazon S3 or a service with the
+// same API, like MinIO. Requests are signed with AWS Signature Version 4.
+type S3Storage struct {
+	// Endpoint is the base URL of the service, like
+	// https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Endpoint string
+	Region   string
+	Bucket   string
+	// AccessKeyID and SecretAccessKey are the credentials requests are
+	// signed with
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle puts the bucket in the URL's path rather than its host
+	// name, which MinIO and most other S3 compatible services need
+	PathStyle bool
+	// Client is used to send requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// The payload hash for requests that don't sign their body, which lets
+// uploads be streamed
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+func (s *S3Storage) Put(ctx context.Context, key string, contents io.Reader, size int64, contentType string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, contents)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	switch {
+	case length == 0:
+		return io.NopCloser(strings.NewReader("")), nil
+	case length > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	return res.Body, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", key, err)
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", key, err)
+	}
+	res.Body.Close()
+	info := BlobInfo{
+		Key:         key,
+		Size:        res.ContentLength,
+		ContentType: res.Header.Get("Content-Type"),
+	}
+	info.ModTime, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return &info, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("delete %s: %w", key, err)
+	}
+	res, err := s.do(req)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("delete %s: %w", key, err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	var continuationToken string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		res, err := s.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		for _, object := range result.Contents {
+			blobs = append(blobs, BlobInfo{
+				Key:     object.Key,
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// PresignGet returns a URL the blob can be downloaded from without
+// credentials until it expires, which can be at most 7 days
+func (s *S3Storage) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	u, err := s.objectURL(key, nil)
+	if err != nil {
+		return "", fmt.Errorf("presign %s: %w", key, err)
+	}
+	return s.presign(u, time.Now(), expires), nil
+}
+
+func (s *S3Storage) presign(u *url.URL, now time.Time, expires time.Duration) string {
+	now = now.UTC()
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.AccessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = s3Query(query)
+	header := http.Header{}
+	signature := s.signature(http.MethodGet, u, header, s3UnsignedPayload, now)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+// The URL of the object with the given key, or of the bucket if the key
+// is empty
+func (s *S3Storage) objectURL(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", s.Endpoint)
+	}
+	objectPath := "/" + key
+	if s.PathStyle {
+		objectPath = "/" + s.Bucket + objectPath
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	return u, nil
+}
+
+func (s *S3Storage) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// Sign and send the request. Responses other than 2xx are turned into
+// errors, ErrNotFound for a missing key.
+func (s *S3Storage) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	// HEAD responses have no body, so there might not be any details
+	xml.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&s3Err)
+	if s3Err.Code == "" {
+		return nil, fmt.Errorf("s3: status code %d", res.StatusCode)
+	}
+	return nil, fmt.Errorf("s3: status code %d: %s: %s", res.StatusCode, s3Err.Code, s3Err.Message)
+}
+
+// Add the Authorization header, signing the request's host and all of its
+// headers
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = s3UnsignedPayload
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	signature := s.signature(req.Method, req.URL, req.Header, payloadHash, now)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.AccessKeyID, s.scope(now), strings.Join(s3SignedHeaders(req.Header), ";"), signature))
+}
+
+// The Signature Version 4 signature of a request for u with the given
+// headers, which the host is added to
+func (s *S3Storage) signature(method string, u *url.URL, header http.Header, payloadHash string, now time.Time) string {
+	headers := s3SignedHeaders(header)
+	var canonicalHeaders strings.Builder
+	for _, name := range headers {
+		value := u.Host
+		if name != "host" {
+			value = strings.Join(header.Values(name), ",")
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		s3Query(u.Query()),
+		canonicalHeaders.String(),
+		strings.Join(headers, ";"),
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		s.scope(now),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), s.Region, "s3", "aws4_request"} {
+		key = s3HMAC(key, part)
+	}
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func (s *S3Storage) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// The lowercase, sorted names of the headers that are signed
+func s3SignedHeaders(header http.Header) []string {
+	names := []string{"host"}
+	for name := range header {
+		name = strings.ToLower(name)
+		if name != "authorization" && name != "host" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// The query string with sorted keys and every value escaped, the way it
+// is signed
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent-encode everything but unreserved characters, and slashes unless
+// escapeSlash is set
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -1,16 +1,34 @@
 package models
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/joncalhoun/lenslocked/rand"
 )
 
 const (
 	MinBytesPerToken = 32 // Big enough for attackers to guess a correct session token
+
+	// DefaultIdleTimeout is how long a regular session may go unused
+	// before it expires.
+	DefaultIdleTimeout = 2 * time.Hour
+	// DefaultAbsoluteTimeout is the longest a regular session can live,
+	// no matter how active it is.
+	DefaultAbsoluteTimeout = 24 * time.Hour
+	// DefaultRememberIdleTimeout and DefaultRememberAbsoluteTimeout are
+	// the equivalents for "remember me" sessions.
+	DefaultRememberIdleTimeout     = 14 * 24 * time.Hour
+	DefaultRememberAbsoluteTimeout = 90 * 24 * time.Hour
+
+	// Activity is recorded at most this often so that every request
+	// doesn't turn into a write.
+	sessionRenewInterval = time.Minute
 )
 
 // Session struct
@@ -19,18 +37,50 @@ type Session struct {
 	UserID int
 	// Token is only set when creating a new session
 	// and won't be stored in the database
-	Token     string
-	TokenHash string
+	Token      string
+	TokenHash  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	IPAddress  string
+	UserAgent  string
+	// Persistent sessions are backed by a cookie that survives closing
+	// the browser ("remember me").
+	Persistent bool
+	// Renewed is only set by Lookup and reports whether ExpiresAt was
+	// pushed back by this lookup.
+	Renewed bool
+	// Current is only set by List and reports whether this is the
+	// session the list was requested from.
+	Current bool
+}
+
+// Device describes the client a session was created from
+type Device struct {
+	IPAddress string
+	UserAgent string
 }
 
 // Session service struct
 type SessionService struct {
 	DB            *sql.DB
 	BytesPerToken int
+	// IdleTimeout is how long a session may go unused before it expires.
+	// Every use pushes the expiry back, up to AbsoluteTimeout after the
+	// session was created. Default to DefaultIdleTimeout and
+	// DefaultAbsoluteTimeout.
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+	// RememberIdleTimeout and RememberAbsoluteTimeout replace the above
+	// for persistent sessions. Default to DefaultRememberIdleTimeout and
+	// DefaultRememberAbsoluteTimeout.
+	RememberIdleTimeout     time.Duration
+	RememberAbsoluteTimeout time.Duration
 }
 
-// Create a new session for the given user
-func (ss *SessionService) Create(userID int) (*Session, error) {
+// Create a new session for the given user. Persistent sessions use the
+// longer "remember me" timeouts.
+func (ss *SessionService) Create(userID int, device Device, persistent bool) (*Session, error) {
 	// Create session token
 	bytesPerToken := ss.BytesPerToken
 	if bytesPerToken < MinBytesPerToken {
@@ -41,20 +91,27 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 		return nil, fmt.Errorf("Error creating session token: %w", err)
 	}
 
-	//Create/update a session and store it in database
+	//Create a session and store it in database
+	now := time.Now()
 	session := Session{
-		UserID:    userID,
-		Token:     token,
-		TokenHash: ss.hash(token),
+		UserID:     userID,
+		Token:      token,
+		TokenHash:  ss.hash(token),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		IPAddress:  device.IPAddress,
+		UserAgent:  device.UserAgent,
+		Persistent: persistent,
 	}
+	session.ExpiresAt = ss.expiry(&session, now)
 
 	row := ss.DB.QueryRow(`
-		INSERT INTO sessions (user_id, token_hash)
-		VALUES ($1, $2) ON CONFLICT (user_id) DO
-		UPDATE
-		SET token_hash = $2
+		INSERT INTO sessions (user_id, token_hash, created_at, last_seen_at,
+			expires_at, ip_address, user_agent, persistent)
+		VALUES ($1, $2, $3, $3, $4, $5, $6, $7)
 		RETURNING id;
-	`, session.UserID, session.TokenHash)
+	`, session.UserID, session.TokenHash, session.CreatedAt, session.ExpiresAt,
+		session.IPAddress, session.UserAgent, session.Persistent)
 	err = row.Scan(&session.ID)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating session: %w", err)
@@ -64,24 +121,151 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 
 // Query for the user with given session token
 func (ss *SessionService) User(token string) (*User, error) {
-	tokenHash := ss.hash(token)
+	_, user, err := ss.Lookup(token)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Lookup the unexpired session with the given token and the user it
+// belongs to. Using a session records activity on it and slides its
+// expiry forward; Renewed is set on the returned session when that
+// happened.
+func (ss *SessionService) Lookup(token string) (*Session, *User, error) {
+	session := Session{
+		Token:     token,
+		TokenHash: ss.hash(token),
+	}
 	var user User
+	var emailVerifiedAt sql.NullTime
 	row := ss.DB.QueryRow(`
-		SELECT 
+		SELECT
+			s.id,
+			s.created_at,
+			s.last_seen_at,
+			s.expires_at,
+			s.ip_address,
+			s.user_agent,
+			s.persistent,
 			u.id,
 			u.email,
-			u.password_hash
+			u.password_hash,
+			u.email_verified_at
 		FROM sessions AS s
 		JOIN users AS u
 			ON s.user_id = u.id
-		WHERE s.token_hash = $1;
-	`, tokenHash)
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+		WHERE s.token_hash = $1
+			AND s.expires_at > NOW();
+	`, session.TokenHash)
+	err := row.Scan(
+		&session.ID, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt,
+		&session.IPAddress, &session.UserAgent, &session.Persistent,
+		&user.ID, &user.Email, &user.PasswordHash, &emailVerifiedAt)
 	if err != nil {
-		return nil, fmt.Errorf("Erroring finding user: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("Erroring finding user: %w", err)
+	}
+	session.UserID = user.ID
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
 	}
 
-	return &user, nil
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) < sessionRenewInterval {
+		return &session, &user, nil
+	}
+	session.LastSeenAt = now
+	session.ExpiresAt = ss.expiry(&session, now)
+	_, err = ss.DB.Exec(`
+		UPDATE sessions
+		SET last_seen_at = $2, expires_at = $3
+		WHERE id = $1;
+	`, session.ID, session.LastSeenAt, session.ExpiresAt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error renewing session: %w", err)
+	}
+	session.Renewed = true
+	return &session, &user, nil
+}
+
+// List all sessions of the given user, most recently used first.
+// The session matching currentToken is marked as Current.
+func (ss *SessionService) List(userID int, currentToken string) ([]Session, error) {
+	currentHash := ss.hash(currentToken)
+	rows, err := ss.DB.Query(`
+		SELECT id, token_hash, created_at, last_seen_at, ip_address, user_agent
+		FROM sessions
+		WHERE user_id = $1 AND expires_at > NOW()
+		ORDER BY last_seen_at DESC;
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+		err := rows.Scan(&session.ID, &session.TokenHash, &session.CreatedAt,
+			&session.LastSeenAt, &session.IPAddress, &session.UserAgent)
+		if err != nil {
+			return nil, fmt.Errorf("list sessions: %w", err)
+		}
+		session.Current = session.TokenHash == currentHash
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// Revoke a single session belonging to the given user.
+// Returns ErrNotFound if the user has no such session.
+func (ss *SessionService) Revoke(userID, sessionID int) error {
+	res, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE id = $1 AND user_id = $2;
+	`, sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Revoke every session of the given user except the one with the given token
+func (ss *SessionService) RevokeAllExcept(userID int, token string) error {
+	_, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE user_id = $1 AND token_hash <> $2;
+	`, userID, ss.hash(token))
+	if err != nil {
+		return fmt.Errorf("revoke other sessions: %w", err)
+	}
+	return nil
+}
+
+// Revoke every session of the given user, signing them out everywhere
+func (ss *SessionService) RevokeAll(userID int) error {
+	_, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE user_id = $1;
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("revoke all sessions: %w", err)
+	}
+	return nil
 }
 
 // Delete a session
@@ -97,6 +281,65 @@ func (ss *SessionService) Delete(token string) error {
 	return nil
 }
 
+// Delete all expired sessions and return how many were removed
+func (ss *SessionService) DeleteExpired() (int64, error) {
+	res, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE expires_at <= NOW();
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return n, nil
+}
+
+// Sweep deletes expired sessions every interval until ctx is cancelled.
+// It is meant to be run in its own goroutine.
+func (ss *SessionService) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := ss.DeleteExpired()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// Calculate when the session expires if it is used at the given time
+func (ss *SessionService) expiry(session *Session, now time.Time) time.Time {
+	idle, absolute := ss.IdleTimeout, ss.AbsoluteTimeout
+	if idle == 0 {
+		idle = DefaultIdleTimeout
+	}
+	if absolute == 0 {
+		absolute = DefaultAbsoluteTimeout
+	}
+	if session.Persistent {
+		idle, absolute = ss.RememberIdleTimeout, ss.RememberAbsoluteTimeout
+		if idle == 0 {
+			idle = DefaultRememberIdleTimeout
+		}
+		if absolute == 0 {
+			absolute = DefaultRememberAbsoluteTimeout
+		}
+	}
+	expiresAt := now.Add(idle)
+	if limit := session.CreatedAt.Add(absolute); expiresAt.After(limit) {
+		expiresAt = limit
+	}
+	return expiresAt
+}
+
 // Hash a given session token and return the hash
 func (ss *SessionService) hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token)) // This is an array not slice
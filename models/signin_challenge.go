@@ -0,0 +1,141 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/rand"
+)
+
+const (
+	// DefaultChallengeDuration is the default time a user has to enter
+	// their second factor after entering their password.
+	DefaultChallengeDuration = 5 * time.Minute
+	// DefaultChallengeAttempts is how many wrong codes can be entered
+	// before the user has to start signing in again.
+	DefaultChallengeAttempts = 5
+)
+
+// SignInChallenge is a half finished sign in: the user has proven their
+// password but still needs to provide a second factor.
+type SignInChallenge struct {
+	ID     int
+	UserID int
+	// Email is the user's address. It is only set by Find, so wrong codes
+	// can be counted against the account like wrong passwords.
+	Email string
+	// Token is only set when a SignInChallenge is being created.
+	Token     string
+	TokenHash string
+	// Persistent is carried over to the session once the challenge is met.
+	Persistent bool
+	ExpiresAt  time.Time
+}
+
+type SignInChallengeService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each challenge token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+	// Duration is the amount of time that a SignInChallenge is valid for.
+	// Defaults to DefaultChallengeDuration
+	Duration time.Duration
+	// MaxAttempts defaults to DefaultChallengeAttempts
+	MaxAttempts int
+}
+
+// Create a new challenge for a user who has passed the first factor
+func (service *SignInChallengeService) Create(userID int, persistent bool) (*SignInChallenge, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create challenge: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultChallengeDuration
+	}
+
+	challenge := SignInChallenge{
+		UserID:     userID,
+		Token:      token,
+		TokenHash:  service.hash(token),
+		Persistent: persistent,
+		ExpiresAt:  time.Now().Add(duration),
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO signin_challenges (user_id, token_hash, persistent, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id;`, challenge.UserID, challenge.TokenHash, challenge.Persistent, challenge.ExpiresAt)
+	err = row.Scan(&challenge.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+// Find the open challenge with the given token. Returns ErrNotFound if it
+// doesn't exist, has expired or has run out of attempts.
+func (service *SignInChallengeService) Find(token string) (*SignInChallenge, error) {
+	maxAttempts := service.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultChallengeAttempts
+	}
+	challenge := SignInChallenge{
+		TokenHash: service.hash(token),
+	}
+	row := service.DB.QueryRow(`
+		SELECT c.id, c.user_id, u.email, c.persistent, c.expires_at
+		FROM signin_challenges AS c
+		JOIN users AS u
+			ON u.id = c.user_id
+		WHERE c.token_hash = $1
+			AND c.expires_at > NOW()
+			AND c.attempts < $2;`, challenge.TokenHash, maxAttempts)
+	err := row.Scan(&challenge.ID, &challenge.UserID, &challenge.Email, &challenge.Persistent, &challenge.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("find challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+// Record a wrong code against the challenge
+func (service *SignInChallengeService) Fail(id int) error {
+	_, err := service.DB.Exec(`
+		UPDATE signin_challenges
+		SET attempts = attempts + 1
+		WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("fail challenge: %w", err)
+	}
+	return nil
+}
+
+// Delete the challenge once it has been met, along with any expired ones
+func (service *SignInChallengeService) Delete(id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM signin_challenges
+		WHERE id = $1 OR expires_at <= NOW();`, id)
+	if err != nil {
+		return fmt.Errorf("delete challenge: %w", err)
+	}
+	return nil
+}
+
+func (service *SignInChallengeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,246 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrPresignNotSupported is returned by storage that can't hand out URLs
+// to its blobs, like LocalStorage
+var ErrPresignNotSupported = errors.New("models: storage can't presign URLs")
+
+// BlobStorage keeps files, or blobs, by key. Keys are slash separated
+// paths like "gallery-1/abc.jpg". Methods return ErrNotFound for keys
+// with no blob.
+type BlobStorage interface {
+	// Put stores size bytes from contents under key, replacing any blob
+	// that is there already
+	Put(ctx context.Context, key string, contents io.Reader, size int64, contentType string) error
+	// Get returns length bytes of the blob starting at offset, or the
+	// rest of it if length is negative. The caller must close it.
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+	// Delete the blob. Deleting a blob that doesn't exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// List the blobs with keys starting with prefix
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+	// PresignGet returns a URL anyone can download the blob from until it
+	// expires, or ErrPresignNotSupported
+	PresignGet(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// LocalStorage keeps blobs as files in a directory on disk
+type LocalStorage struct {
+	Dir string
+}
+
+// The file the key is stored in. Keys can't leave the directory.
+func (ls *LocalStorage) path(key string) string {
+	return filepath.Join(ls.Dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (ls *LocalStorage) Put(ctx context.Context, key string, contents io.Reader, size int64, contentType string) error {
+	file := ls.path(key)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	// Write to a temporary file first, so nobody sees half a blob
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("wrote %d bytes, expected %d", n, size)
+	}
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	err = os.Rename(tmp.Name(), file)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	return nil
+}
+
+func (ls *LocalStorage) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(ls.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	if offset > 0 {
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("get %s: %w", key, err)
+		}
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (ls *LocalStorage) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	info, err := os.Stat(ls.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("stat %s: %w", key, err)
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return &BlobInfo{
+		Key:         key,
+		Size:        info.Size(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		ModTime:     info.ModTime(),
+	}, nil
+}
+
+func (ls *LocalStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(ls.path(key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete %s: %w", key, err)
+	}
+	return nil
+}
+
+func (ls *LocalStorage) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := filepath.WalkDir(ls.Dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && file == ls.Dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.Dir, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{
+			Key:         key,
+			Size:        info.Size(),
+			ContentType: mime.TypeByExtension(path.Ext(key)),
+			ModTime:     info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", prefix, err)
+	}
+	return blobs, nil
+}
+
+func (ls *LocalStorage) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return "", ErrPresignNotSupported
+}
+
+// BlobReader reads a blob of known size as an io.ReadSeeker, so it can be
+// served with http.ServeContent, which handles Range requests. It only
+// fetches from storage when it is read, from wherever it was seeked to.
+type BlobReader struct {
+	ctx     context.Context
+	storage BlobStorage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func NewBlobReader(ctx context.Context, storage BlobStorage, key string, size int64) *BlobReader {
+	return &BlobReader{
+		ctx:     ctx,
+		storage: storage,
+		key:     key,
+		size:    size,
+	}
+}
+
+func (br *BlobReader) Read(p []byte) (int, error) {
+	if br.offset >= br.size {
+		return 0, io.EOF
+	}
+	if br.body == nil {
+		body, err := br.storage.Get(br.ctx, br.key, br.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		br.body = body
+	}
+	n, err := br.body.Read(p)
+	br.offset += int64(n)
+	return n, err
+}
+
+func (br *BlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += br.offset
+	case io.SeekEnd:
+		offset += br.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek %s: negative position", br.key)
+	}
+	if offset != br.offset {
+		br.Close()
+		br.offset = offset
+	}
+	return offset, nil
+}
+
+// Close the connection to storage, if there is one
+func (br *BlobReader) Close() error {
+	if br.body == nil {
+		return nil
+	}
+	err := br.body.Close()
+	br.body = nil
+	return err
+}
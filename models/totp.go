@@ -0,0 +1,326 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/joncalhoun/lenslocked/rand"
+)
+
+const (
+	// DefaultTOTPIssuer is the name authenticator apps show next to the
+	// account when TOTPService.Issuer isn't set.
+	DefaultTOTPIssuer = "Lenslocked"
+
+	totpPeriod        = 30 * time.Second
+	totpDigits        = 6
+	totpSecretBytes   = 20 // 160 bits, as recommended by RFC 4226
+	totpSkew          = 1  // Accept codes one step either side to allow for clock drift
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment holds what a user needs to add their account to an
+// authenticator app.
+type TOTPEnrollment struct {
+	UserID int
+	// Secret is the base32 encoded shared secret
+	Secret string
+	// URI is the otpauth:// provisioning URI, usually shown as a QR code
+	URI string
+}
+
+// TOTPService manages RFC 6238 time-based one-time passwords and the
+// recovery codes that go with them.
+type TOTPService struct {
+	DB *sql.DB
+	// Issuer is shown in authenticator apps. Defaults to DefaultTOTPIssuer.
+	Issuer string
+}
+
+// Enroll starts (or restarts) setting up two-factor authentication for
+// the user. The secret isn't used to sign in until it is confirmed.
+func (service *TOTPService) Enroll(user *User) (*TOTPEnrollment, error) {
+	enabled, err := service.Enabled(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("enroll: %w", err)
+	}
+	if enabled {
+		return nil, fmt.Errorf("enroll: two-factor authentication already enabled")
+	}
+	secretBytes, err := rand.Bytes(totpSecretBytes)
+	if err != nil {
+		return nil, fmt.Errorf("enroll: %w", err)
+	}
+	secret := totpEncoding.EncodeToString(secretBytes)
+	_, err = service.DB.Exec(`
+		INSERT INTO totp_secrets (user_id, secret)
+		VALUES ($1, $2) ON CONFLICT (user_id) DO
+		UPDATE
+		SET secret = $2, confirmed_at = NULL, last_used_step = 0;`, user.ID, secret)
+	if err != nil {
+		return nil, fmt.Errorf("enroll: %w", err)
+	}
+	return service.enrollment(user, secret), nil
+}
+
+// Pending returns the unconfirmed enrollment of the user, so the setup
+// page can be shown again.
+func (service *TOTPService) Pending(user *User) (*TOTPEnrollment, error) {
+	var secret string
+	row := service.DB.QueryRow(`
+		SELECT secret
+		FROM totp_secrets
+		WHERE user_id = $1 AND confirmed_at IS NULL;`, user.ID)
+	err := row.Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("pending enrollment: %w", err)
+	}
+	return service.enrollment(user, secret), nil
+}
+
+// Confirm finishes enrollment once the user proves their app generates
+// valid codes. It returns the user's recovery codes, which are only
+// ever available here.
+func (service *TOTPService) Confirm(userID int, code string) ([]string, error) {
+	var secret string
+	row := service.DB.QueryRow(`
+		SELECT secret
+		FROM totp_secrets
+		WHERE user_id = $1 AND confirmed_at IS NULL;`, userID)
+	err := row.Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("confirm: %w", err)
+	}
+	step, ok := checkTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	_, err = service.DB.Exec(`
+		UPDATE totp_secrets
+		SET confirmed_at = NOW(), last_used_step = $2
+		WHERE user_id = $1;`, userID, step)
+	if err != nil {
+		return nil, fmt.Errorf("confirm: %w", err)
+	}
+	codes, err := service.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		return nil, fmt.Errorf("confirm: %w", err)
+	}
+	return codes, nil
+}
+
+// Enabled reports whether the user has confirmed two-factor authentication
+func (service *TOTPService) Enabled(userID int) (bool, error) {
+	var enabled bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM totp_secrets
+			WHERE user_id = $1 AND confirmed_at IS NOT NULL
+		);`, userID)
+	err := row.Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("two-factor enabled: %w", err)
+	}
+	return enabled, nil
+}
+
+// Verify checks a code from the user's authenticator app, or one of their
+// recovery codes. Each code can only be used once. Returns ErrInvalidCode
+// if the code doesn't check out.
+func (service *TOTPService) Verify(userID int, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return service.useRecoveryCode(userID, code)
+	}
+	var secret string
+	row := service.DB.QueryRow(`
+		SELECT secret
+		FROM totp_secrets
+		WHERE user_id = $1 AND confirmed_at IS NOT NULL;`, userID)
+	err := row.Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidCode
+		}
+		return fmt.Errorf("verify: %w", err)
+	}
+	step, ok := checkTOTP(secret, code, time.Now())
+	if !ok {
+		return ErrInvalidCode
+	}
+	// Refuse to accept a code for a step that has already been used so a
+	// code that was observed can't be replayed.
+	res, err := service.DB.Exec(`
+		UPDATE totp_secrets
+		SET last_used_step = $2
+		WHERE user_id = $1 AND last_used_step < $2;`, userID, step)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Disable two-factor authentication and throw away the recovery codes
+func (service *TOTPService) Disable(userID int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM totp_secrets
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable two-factor: %w", err)
+	}
+	_, err = service.DB.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable two-factor: %w", err)
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes with a fresh
+// set. Only hashes are stored, so the returned codes can't be shown again.
+func (service *TOTPService) RegenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b, err := rand.Bytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:len(code)/2] + "-" + code[len(code)/2:]
+		_, err = tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash)
+			VALUES ($1, $2);`, userID, service.hash(code))
+		if err != nil {
+			return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+		}
+		codes = append(codes, code)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+// Consume one of the user's recovery codes
+func (service *TOTPService) useRecoveryCode(userID int, code string) error {
+	res, err := service.DB.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1 AND code_hash = $2;`, userID, service.hash(code))
+	if err != nil {
+		return fmt.Errorf("use recovery code: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("use recovery code: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (service *TOTPService) enrollment(user *User, secret string) *TOTPEnrollment {
+	issuer := service.Issuer
+	if issuer == "" {
+		issuer = DefaultTOTPIssuer
+	}
+	vals := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod.Seconds()))},
+	}
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + user.Email,
+		RawQuery: vals.Encode(),
+	}
+	return &TOTPEnrollment{
+		UserID: user.ID,
+		Secret: secret,
+		URI:    uri.String(),
+	}
+}
+
+// Recovery codes are normalized before hashing so users can type them
+// with or without the dash and in any case.
+func (service *TOTPService) hash(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	codeHash := sha256.Sum256([]byte(code))
+	return base64.URLEncoding.EncodeToString(codeHash[:])
+}
+
+// Check a code against the secret, allowing for a little clock drift.
+// Returns the time step the code matched.
+func checkTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		want := totpCode(key, step)
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Compute the code for a time step as described in RFC 4226 and RFC 6238
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, code%mod)
+}
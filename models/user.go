@@ -5,32 +5,55 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	ID           int
-	Email        string
-	PasswordHash string
+	ID              int
+	Email           string
+	PasswordHash    string
+	EmailVerifiedAt *time.Time
+}
+
+// HasPassword reports whether the user can sign in with a password.
+// Accounts created through an identity provider start without one.
+func (u *User) HasPassword() bool {
+	return u.PasswordHash != ""
+}
+
+// EmailVerified reports whether the user has proven they own their email
+// address. Unverified users can sign in, but can't share their work with
+// others until they verify.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
 }
 
 type UserService struct {
 	DB *sql.DB
+	// PasswordPolicy is checked whenever a password is set. A nil policy
+	// applies the defaults.
+	PasswordPolicy *PasswordPolicy
+	// Hasher hashes new passwords. Defaults to Argon2idHasher with its
+	// default parameters.
+	Hasher PasswordHasher
 }
 
 // Create a new user and insert it to database
 func (us *UserService) Create(email, password string) (*User, error) {
 	//Convert email to lower case
 	email = strings.ToLower(email)
+	err := us.PasswordPolicy.Check(email, password)
+	if err != nil {
+		return nil, err
+	}
 	//Hash the password
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	passwordHash, err := us.hasher().Hash(password)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating user: %w", err)
 	}
-	passwordHash := string(hashedBytes)
 
 	//Insert new user to database
 	user := User{
@@ -60,29 +83,96 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 	user := User{
 		Email: email,
 	}
+	var lockedUntil sql.NullTime
 	row := us.DB.QueryRow(`
-		SELECT id, password_hash
+		SELECT id, password_hash, locked_until
 		FROM users
 		WHERE email = $1
 	`, email)
-	err := row.Scan(&user.ID, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.PasswordHash, &lockedUntil)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidCredentials
+		}
 		return nil, fmt.Errorf("Error autheticating: %w", err)
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	// Don't even look at the password while the account is locked, so
+	// guessing can't continue in the meantime.
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		return nil, ErrAccountLocked
+	}
+	// Accounts created through an identity provider have no password
+	if user.PasswordHash == "" {
+		return nil, ErrInvalidCredentials
+	}
+	match, err := VerifyPassword(password, user.PasswordHash)
 	if err != nil {
 		return nil, fmt.Errorf("Error autheticating: %w", err)
 	}
+	if !match {
+		return nil, ErrInvalidCredentials
+	}
+	// This is the only time the password is known, so take the chance to
+	// move old hashes to the current algorithm and parameters.
+	if us.hasher().NeedsRehash(user.PasswordHash) {
+		err = us.rehash(&user, password)
+		if err != nil {
+			// The user still gets in, we'll try again next time
+			fmt.Println(err)
+		}
+	}
 	return &user, nil
 }
 
+// Replace the user's password hash with one from the current hasher
+func (us *UserService) rehash(user *User, password string) error {
+	passwordHash, err := us.hasher().Hash(password)
+	if err != nil {
+		return fmt.Errorf("rehash: %w", err)
+	}
+	// Don't overwrite a password that was changed in the meantime
+	_, err = us.DB.Exec(`
+		UPDATE users
+		SET password_hash = $3
+		WHERE id = $1 AND password_hash = $2;`, user.ID, user.PasswordHash, passwordHash)
+	if err != nil {
+		return fmt.Errorf("rehash: %w", err)
+	}
+	user.PasswordHash = passwordHash
+	return nil
+}
+
+func (us *UserService) hasher() PasswordHasher {
+	if us.Hasher == nil {
+		return Argon2idHasher{}
+	}
+	return us.Hasher
+}
+
+// Check a new password for the user against the password policy
+func (us *UserService) CheckPassword(userID int, password string) error {
+	var email string
+	row := us.DB.QueryRow(`
+		SELECT email
+		FROM users
+		WHERE id = $1;`, userID)
+	err := row.Scan(&email)
+	if err != nil {
+		return fmt.Errorf("check password: %w", err)
+	}
+	return us.PasswordPolicy.Check(email, password)
+}
+
 // Update the passord of the user
 func (us *UserService) UpdatePassword(userID int, password string) error {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	err := us.CheckPassword(userID, password)
+	if err != nil {
+		return err
+	}
+	passwordHash, err := us.hasher().Hash(password)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
-	passwordHash := string(hashedBytes)
 	_, err = us.DB.Exec(`
 	  UPDATE users
 		SET password_hash = $2
@@ -93,14 +183,69 @@ func (us *UserService) UpdatePassword(userID int, password string) error {
 	return nil
 }
 
-// Update the email of the user
+// Update the email of the user. The new address has been proven by the
+// link sent to it, so it counts as verified.
+// Returns ErrEmailTaken if another account already uses the address.
 func (us *UserService) UpdateEmail(userID int, email string) error {
+	email = strings.ToLower(email)
 	_, err := us.DB.Exec(`
 	  UPDATE users
-		SET email = $2
+		SET email = $2, email_verified_at = NOW()
 		WHERE id = $1;`, userID, email)
 	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) {
+			if pgError.Code == pgerrcode.UniqueViolation {
+				return ErrEmailTaken
+			}
+		}
 		return fmt.Errorf("update email: %w", err)
 	}
 	return nil
 }
+
+// Lock the account with the given email until the given time.
+// Returns ErrNotFound if there is no such account.
+func (us *UserService) Lock(email string, until time.Time) (*User, error) {
+	email = strings.ToLower(email)
+	user := User{
+		Email: email,
+	}
+	row := us.DB.QueryRow(`
+		UPDATE users
+		SET locked_until = $2
+		WHERE email = $1
+		RETURNING id;`, email, until)
+	err := row.Scan(&user.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("lock account: %w", err)
+	}
+	return &user, nil
+}
+
+// Unlock the account of the user
+func (us *UserService) Unlock(userID int) error {
+	_, err := us.DB.Exec(`
+		UPDATE users
+		SET locked_until = NULL
+		WHERE id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("unlock account: %w", err)
+	}
+	return nil
+}
+
+// Record that the user has verified their email address
+func (us *UserService) MarkEmailVerified(userID int) error {
+	_, err := us.DB.Exec(`
+		UPDATE users
+		SET email_verified_at = NOW()
+		WHERE id = $1 AND email_verified_at IS NULL;`, userID)
+	if err != nil {
+		return fmt.Errorf("mark email verified: %w", err)
+	}
+	return nil
+}
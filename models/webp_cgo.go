@@ -0,0 +1,18 @@
+//go:build cgo
+
+package models
+
+import (
+	stdimage "image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// WebP images are encoded with libwebp, which needs cgo. Builds without it
+// make JPEG variants only.
+const webpEncoding = true
+
+func encodeWebP(w io.Writer, img stdimage.Image, quality int) error {
+	return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+}
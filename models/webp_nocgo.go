@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package models
+
+import (
+	"errors"
+	stdimage "image"
+	"io"
+)
+
+// Without cgo there is no WebP encoder, so images are only made in JPEG
+// and PNG. WebP uploads can still be decoded.
+const webpEncoding = false
+
+func encodeWebP(w io.Writer, img stdimage.Image, quality int) error {
+	return errors.New("webp encoding needs a build with cgo")
+}
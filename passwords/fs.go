@@ -0,0 +1,9 @@
+package passwords
+
+import "embed"
+
+// common.bin is the bundled breached password list, built from common.txt.
+//
+//go:generate sh -c "go run ../cmd/breachedpw < common.txt > common.bin"
+//go:embed common.bin
+var FS embed.FS